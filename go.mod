@@ -8,6 +8,9 @@ require (
 	github.com/pion/interceptor v0.1.41
 	github.com/pion/webrtc/v4 v4.1.5
 	github.com/rs/zerolog v1.34.0
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -30,8 +33,6 @@ require (
 	github.com/pion/transport/v3 v3.0.8 // indirect
 	github.com/pion/turn/v4 v4.1.1 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
-	golang.org/x/crypto v0.33.0 // indirect
 	golang.org/x/exp v0.0.0-20240909161429-701f63a606c0 // indirect
 	golang.org/x/net v0.35.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 )
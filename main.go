@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"flag"
 	"fmt"
 	"mini-kvm/pkg"
+	"mini-kvm/pkg/auth"
+	"mini-kvm/pkg/config"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/rs/zerolog"
@@ -17,21 +22,63 @@ func init() {
 }
 
 func main() {
-	defer fmt.Println("exited")
+	configPath := flag.String("config", os.Getenv("MKVM_CONFIG"), "path to the YAML config file (env MKVM_CONFIG)")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its bcrypt hash for auth.users and exit")
+	overrides := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatal().Err(err).Msg("failed to read password")
+		}
+
+		hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+
+		fmt.Println(hash)
+		return
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load config")
+	}
+
+	if err := overrides.Apply(cfg); err != nil {
+		log.Fatal().Err(err).Msg("failed to apply flags")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("failed to validate config")
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	ctx, cancel := context.WithCancel(context.Background())
-	done := make(chan struct{}, 1)
+	done := make(chan error, 1)
 	go func() {
-		defer func() {
-			done <- struct{}{}
-		}()
-		if err := pkg.Run(ctx); err != nil {
-			panic(err)
-		}
+		done <- pkg.Run(ctx, cfg)
 	}()
 
-	<-c
-	cancel()
-	<-done
+	select {
+	case <-c:
+		log.Info().Msg("stopping, signal again to force")
+		go func() {
+			<-c
+			log.Fatal().Msg("forced exit")
+		}()
+		cancel()
+		err = <-done
+	case err = <-done:
+		cancel()
+	}
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("exited with error")
+	}
+
+	fmt.Println("exited")
 }
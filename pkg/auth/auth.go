@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const CookieName = "mkvm_session"
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidToken       = errors.New("invalid session token")
+	ErrTokenExpired       = errors.New("session token expired")
+	ErrMissingToken       = errors.New("missing session token")
+	ErrTokenRevoked       = errors.New("session was logged out")
+)
+
+// dummyHash is compared against when the user does not exist, so that login
+// takes the same time for known and unknown user names.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("mini-kvm"), bcrypt.DefaultCost)
+
+type User struct {
+	Name         string
+	PasswordHash []byte
+	Admin        bool
+}
+
+type Session struct {
+	User      string    `json:"sub"`
+	ExpiresAt time.Time `json:"exp"`
+	// Generation is the logout count of the user when the token was signed.
+	Generation uint64 `json:"gen,omitempty"`
+	// Admin is looked up from the current users on every verification
+	// rather than trusted from the token.
+	Admin bool `json:"-"`
+}
+
+type Authenticator struct {
+	secret []byte
+	ttl    time.Duration
+	users  map[string]User
+
+	mutex sync.Mutex
+	// generations counts the logouts of every user. It is kept in memory, so
+	// tokens logged out before a restart become valid again until they
+	// expire when auth.secret is set.
+	generations map[string]uint64
+}
+
+// NewAuthenticator signs session tokens with secret. When secret is empty a
+// random one is generated, which invalidates all sessions on restart.
+func NewAuthenticator(secret []byte, ttl time.Duration, users ...User) (*Authenticator, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate session secret: %w", err)
+		}
+	}
+
+	a := &Authenticator{
+		secret:      secret,
+		ttl:         ttl,
+		users:       make(map[string]User, len(users)),
+		generations: make(map[string]uint64),
+	}
+
+	for _, user := range users {
+		a.users[user.Name] = user
+	}
+
+	return a, nil
+}
+
+// InitialPassword returns the password of the admin user of an install
+// without users. It is generated once and kept in a file only its owner can
+// read, so that it never reaches the log.
+func InitialPassword(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		password := strings.TrimSpace(string(data))
+		if password == "" {
+			return "", fmt.Errorf("initial password file %s is empty", path)
+		}
+
+		return password, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read initial password: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write initial password: %w", err)
+	}
+
+	password := rand.Text()
+	if _, err := fmt.Fprintln(file, password); err != nil {
+		file.Close()
+		return "", fmt.Errorf("failed to write initial password: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write initial password: %w", err)
+	}
+
+	return password, nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return string(hash), nil
+}
+
+// Login checks the credentials and returns a signed token for a new session.
+func (a *Authenticator) Login(name, password string) (string, *Session, error) {
+	user, exists := a.users[name]
+	hash := user.PasswordHash
+	if !exists {
+		hash = dummyHash
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !exists {
+		return "", nil, ErrInvalidCredentials
+	}
+
+	session := &Session{
+		User:       name,
+		ExpiresAt:  time.Now().Add(a.ttl).Truncate(time.Second),
+		Generation: a.generation(name),
+		Admin:      user.Admin,
+	}
+
+	token, err := a.sign(session)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, session, nil
+}
+
+/*
+Token format
+
+	base64url(json(session)) "." base64url(hmac-sha256(secret, payload))
+*/
+func (a *Authenticator) sign(session *Session) (string, error) {
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.mac(encoded)), nil
+}
+
+func (a *Authenticator) mac(payload string) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+func (a *Authenticator) Verify(token string) (*Session, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, ErrInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, a.mac(payload)) {
+		return nil, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	// a user removed from the config loses access with the next request
+	user, exists := a.users[session.User]
+	if !exists {
+		return nil, ErrInvalidToken
+	}
+
+	if session.Generation != a.generation(session.User) {
+		return nil, ErrTokenRevoked
+	}
+
+	session.Admin = user.Admin
+	return &session, nil
+}
+
+// Logout revokes every token of the user, on all devices.
+func (a *Authenticator) Logout(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.generations[name]++
+}
+
+func (a *Authenticator) generation(name string) uint64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.generations[name]
+}
+
+// Authenticate verifies the bearer token of req, falling back to the session
+// cookie set by the login endpoint.
+func (a *Authenticator) Authenticate(req *http.Request) (*Session, error) {
+	if header := req.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return nil, ErrInvalidToken
+		}
+
+		return a.Verify(strings.TrimSpace(token))
+	}
+
+	if cookie, err := req.Cookie(CookieName); err == nil {
+		return a.Verify(cookie.Value)
+	}
+
+	return nil, ErrMissingToken
+}
+
+type sessionKey struct{}
+
+func WithSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(*Session)
+	return session, ok
+}
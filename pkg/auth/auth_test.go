@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func testUser(t *testing.T, name, password string, admin bool) User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return User{Name: name, PasswordHash: hash, Admin: admin}
+}
+
+func newTestAuthenticator(t *testing.T, ttl time.Duration, users ...User) *Authenticator {
+	t.Helper()
+	a, err := NewAuthenticator(testSecret, ttl, users...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func TestLoginAndVerify(t *testing.T) {
+	a := newTestAuthenticator(t, time.Hour, testUser(t, "alice", "secret", true))
+	token, session, err := a.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.User != "alice" || !session.Admin {
+		t.Errorf("session = %+v, want admin alice", session)
+	}
+
+	verified, err := a.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.User != "alice" || !verified.Admin || !verified.ExpiresAt.Equal(session.ExpiresAt) {
+		t.Errorf("Verify = %+v, want %+v", verified, session)
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	a := newTestAuthenticator(t, time.Hour, testUser(t, "alice", "secret", false))
+	for _, credentials := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"bob", "secret"}, {"", ""}} {
+		if _, _, err := a.Login(credentials[0], credentials[1]); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Login(%q, %q) = %v, want %v", credentials[0], credentials[1], err, ErrInvalidCredentials)
+		}
+	}
+}
+
+func TestLoginOfUnknownUserComparesDummyHash(t *testing.T) {
+	// unknown users still cost a bcrypt comparison, so login time does not
+	// tell which names exist
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("dummy hash cost = %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+
+	// the password of the dummy hash does not log in as a missing user
+	a := newTestAuthenticator(t, time.Hour)
+	if _, _, err := a.Login("nobody", "mini-kvm"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Login = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	alice := testUser(t, "alice", "secret", false)
+	a := newTestAuthenticator(t, time.Hour, alice)
+	token, _, err := a.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"bob","exp":"2999-01-01T00:00:00Z"}`))
+	expired, err := newTestAuthenticator(t, -time.Minute, alice).sign(&Session{User: "alice", ExpiresAt: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherSecret, err := NewAuthenticator([]byte("another secret"), time.Hour, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherToken, _, err := otherSecret.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{name: "expired", token: expired, want: ErrTokenExpired},
+		{name: "tampered payload", token: forged + "." + signature, want: ErrInvalidToken},
+		{name: "tampered signature", token: payload + "." + base64.RawURLEncoding.EncodeToString([]byte("not the signature")), want: ErrInvalidToken},
+		{name: "wrong secret", token: otherToken, want: ErrInvalidToken},
+		{name: "no signature", token: payload, want: ErrInvalidToken},
+		{name: "garbage", token: "a.b", want: ErrInvalidToken},
+	}
+
+	for _, test := range tests {
+		if _, err := a.Verify(test.token); !errors.Is(err, test.want) {
+			t.Errorf("%s: Verify = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestVerifyLooksUpCurrentUsers(t *testing.T) {
+	before := newTestAuthenticator(t, time.Hour, testUser(t, "alice", "secret", true), testUser(t, "bob", "secret", false))
+	token, _, err := before.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same secret after a restart with alice demoted
+	demoted := newTestAuthenticator(t, time.Hour, testUser(t, "alice", "secret", false))
+	session, err := demoted.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Admin {
+		t.Error("demoted user is still admin")
+	}
+
+	bobToken, _, err := before.Login("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := demoted.Verify(bobToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify of removed user = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	a := newTestAuthenticator(t, time.Hour, testUser(t, "alice", "secret", false), testUser(t, "bob", "secret", false))
+	first, _, err := a.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, _, err := a.Login("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Logout("alice")
+	if _, err := a.Verify(first); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Verify after logout = %v, want %v", err, ErrTokenRevoked)
+	}
+
+	if _, err := a.Verify(bob); err != nil {
+		t.Errorf("logout of alice revoked bob: %v", err)
+	}
+
+	second, _, err := a.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Verify(second); err != nil {
+		t.Errorf("Verify of new login = %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuthenticator(t, time.Hour, testUser(t, "alice", "secret", false))
+	token, _, err := a.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := httptest.NewRequest("GET", "/", nil)
+	bearer.Header.Set("Authorization", "Bearer "+token)
+	if _, err := a.Authenticate(bearer); err != nil {
+		t.Errorf("bearer token: %v", err)
+	}
+
+	basic := httptest.NewRequest("GET", "/", nil)
+	basic.Header.Set("Authorization", "Basic "+token)
+	if _, err := a.Authenticate(basic); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("basic scheme = %v, want %v", err, ErrInvalidToken)
+	}
+
+	cookie := httptest.NewRequest("GET", "/", nil)
+	cookie.Header.Set("Cookie", CookieName+"="+token)
+	if _, err := a.Authenticate(cookie); err != nil {
+		t.Errorf("cookie: %v", err)
+	}
+
+	if _, err := a.Authenticate(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrMissingToken) {
+		t.Errorf("no token = %v, want %v", err, ErrMissingToken)
+	}
+}
+
+func TestInitialPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mkvm/initial-password")
+	password, err := InitialPassword(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("password file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	again, err := InitialPassword(path)
+	if err != nil || again != password {
+		t.Errorf("InitialPassword = %q, %v, want the first password %q", again, err, password)
+	}
+}
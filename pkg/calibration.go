@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/config"
+	"mini-kvm/pkg/gstreamer"
+	"mini-kvm/pkg/protocol"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrNoFrame   = errors.New("no frame captured")
+	ErrNoPicture = errors.New("frame is black, no picture to detect")
+)
+
+const (
+	// frameGrabTimeout bounds the wait for a raw frame of the capture.
+	frameGrabTimeout = 2 * time.Second
+	// blackLevel is the highest luma still counted as border. Limited range
+	// video puts black at 16.
+	blackLevel = 32
+	// activeLineRatio is the share of bright pixels a row or column needs to
+	// belong to the picture, so that noise in the border is ignored.
+	activeLineRatio = 0.01
+)
+
+// frameGrabber is fed by the capture like an encoder and keeps the first
+// frame it gets.
+type frameGrabber struct {
+	frames  chan *gst.Buffer
+	running atomic.Bool
+}
+
+func newFrameGrabber() *frameGrabber {
+	g := &frameGrabber{frames: make(chan *gst.Buffer, 1)}
+	g.running.Store(true)
+	return g
+}
+
+func (g *frameGrabber) IsRunning() bool {
+	return g.running.Load()
+}
+
+func (g *frameGrabber) InputChan() chan *gst.Buffer {
+	return g.frames
+}
+
+// SetVideoCapture is called whenever the capture (re)starts. The pointer
+// follows its resolution and calibration detects the picture in its frames.
+func (s *Server) SetVideoCapture(capture *gstreamer.V4L2Capturer) {
+	settings := capture.CaptureSettings()
+	s.pointerMapper.SetFrameSize(settings.Width, settings.Height)
+	s.videoCapture.Store(capture)
+}
+
+// grabFrame returns the luma plane of the next raw NV12 frame.
+func (s *Server) grabFrame(ctx context.Context) ([]byte, int, int, error) {
+	capture := s.videoCapture.Load()
+	if capture == nil || !s.mediaAvailable.Load() {
+		return nil, 0, 0, ErrNoMedia
+	}
+
+	grabber := newFrameGrabber()
+	capture.AddEncoder(grabber)
+	defer capture.RemoveOutput(grabber)
+	defer grabber.running.Store(false)
+
+	ctx, cancel := context.WithTimeout(ctx, frameGrabTimeout)
+	defer cancel()
+	select {
+	case buffer := <-grabber.frames:
+		defer buffer.Unref()
+		width, height := capture.CaptureSettings().Width, capture.CaptureSettings().Height
+		data := buffer.Bytes()
+		if len(data) < width*height {
+			return nil, 0, 0, fmt.Errorf("frame of %d bytes is too short for %dx%d", len(data), width, height)
+		}
+
+		return data[:width*height], width, height, nil
+	case <-ctx.Done():
+		return nil, 0, 0, ErrNoFrame
+	}
+}
+
+// detectActiveArea finds the picture within black borders in the luma plane
+// of a frame.
+func detectActiveArea(luma []byte, width, height int) (config.Area, error) {
+	rows := make([]int, height)
+	columns := make([]int, width)
+	for y := 0; y < height; y++ {
+		line := luma[y*width : (y+1)*width]
+		for x, value := range line {
+			if value > blackLevel {
+				rows[y]++
+				columns[x]++
+			}
+		}
+	}
+
+	first, last := activeRange(rows, float64(width)*activeLineRatio)
+	if first < 0 {
+		return config.Area{}, ErrNoPicture
+	}
+
+	left, right := activeRange(columns, float64(height)*activeLineRatio)
+	return config.Area{
+		Left:   float64(left) / float64(width),
+		Top:    float64(first) / float64(height),
+		Right:  float64(right+1) / float64(width),
+		Bottom: float64(last+1) / float64(height),
+	}, nil
+}
+
+// activeRange returns the first and last index counting more than threshold
+// bright pixels, or -1 when there is none.
+func activeRange(counts []int, threshold float64) (int, int) {
+	first, last := -1, -1
+	for i, count := range counts {
+		if float64(count) > threshold {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+
+	return first, last
+}
+
+// DetectCalibration sets the active area to the picture in the current frame,
+// keeping the manual offsets and scales.
+func (s *Server) DetectCalibration(ctx context.Context) error {
+	luma, width, height, err := s.grabFrame(ctx)
+	if err != nil {
+		return err
+	}
+
+	area, err := detectActiveArea(luma, width, height)
+	if err != nil {
+		return err
+	}
+
+	calibration := s.pointerMapper.Calibration()
+	calibration.ActiveArea = area
+	log.Info().Interface("area", area).Msg("detected active area")
+	return s.SetCalibration(calibration)
+}
+
+// SetCalibration applies calibration to the pointer, saves it to the config
+// file and tells every client about it.
+func (s *Server) SetCalibration(calibration config.Calibration) error {
+	if err := calibration.Validate(); err != nil {
+		return fmt.Errorf("invalid calibration: %w", err)
+	}
+
+	s.pointerMapper.SetCalibration(calibration)
+	s.Broadcast(toProtocolCalibration(calibration))
+	if s.configPath == "" {
+		log.Warn().Msg("running without a config file, calibration is lost on restart")
+		return nil
+	}
+
+	if err := config.SaveCalibration(s.configPath, calibration); err != nil {
+		return fmt.Errorf("failed to save calibration: %w", err)
+	}
+
+	return nil
+}
+
+func toProtocolCalibration(calibration config.Calibration) *protocol.Calibration {
+	return &protocol.Calibration{
+		ActiveArea: protocol.Area(calibration.ActiveArea),
+		OffsetX:    calibration.OffsetX,
+		OffsetY:    calibration.OffsetY,
+		ScaleX:     calibration.ScaleX,
+		ScaleY:     calibration.ScaleY,
+	}
+}
+
+func fromProtocolCalibration(calibration *protocol.Calibration) config.Calibration {
+	return config.Calibration{
+		ActiveArea: config.Area(calibration.ActiveArea),
+		OffsetX:    calibration.OffsetX,
+		OffsetY:    calibration.OffsetY,
+		ScaleX:     calibration.ScaleX,
+		ScaleY:     calibration.ScaleY,
+	}
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"errors"
+	"mini-kvm/pkg/config"
+	"testing"
+)
+
+// syntheticFrame returns the luma plane of a width x height frame showing a
+// grey picture in the rectangle from left, top to right, bottom on black.
+func syntheticFrame(width, height, left, top, right, bottom int) []byte {
+	luma := make([]byte, width*height)
+	for y := range height {
+		for x := range width {
+			// limited range black with some noise
+			luma[y*width+x] = byte(16 + (x+y)%8)
+			if x >= left && x < right && y >= top && y < bottom {
+				luma[y*width+x] = 128
+			}
+		}
+	}
+
+	return luma
+}
+
+func TestDetectActiveArea(t *testing.T) {
+	tests := []struct {
+		name                     string
+		left, top, right, bottom int
+		want                     config.Area
+	}{
+		{name: "full frame", left: 0, top: 0, right: 200, bottom: 100, want: config.Area{Right: 1, Bottom: 1}},
+		{name: "letterboxed", left: 0, top: 10, right: 200, bottom: 90, want: config.Area{Top: 0.1, Right: 1, Bottom: 0.9}},
+		{name: "pillarboxed", left: 25, top: 0, right: 175, bottom: 100, want: config.Area{Left: 0.125, Right: 0.875, Bottom: 1}},
+		{name: "both", left: 20, top: 5, right: 180, bottom: 95, want: config.Area{Left: 0.1, Top: 0.05, Right: 0.9, Bottom: 0.95}},
+	}
+
+	for _, test := range tests {
+		area, err := detectActiveArea(syntheticFrame(200, 100, test.left, test.top, test.right, test.bottom), 200, 100)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if area != test.want {
+			t.Errorf("%s: area = %+v, want %+v", test.name, area, test.want)
+		}
+	}
+}
+
+func TestDetectActiveAreaIgnoresSpecks(t *testing.T) {
+	// a single bright pixel in the border, such as a cursor, is not picture
+	luma := syntheticFrame(200, 100, 20, 10, 180, 90)
+	luma[2*200+2] = 255
+	area, err := detectActiveArea(luma, 200, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (config.Area{Left: 0.1, Top: 0.1, Right: 0.9, Bottom: 0.9}); area != want {
+		t.Errorf("area = %+v, want %+v", area, want)
+	}
+}
+
+func TestDetectActiveAreaBlackFrame(t *testing.T) {
+	if _, err := detectActiveArea(syntheticFrame(200, 100, 0, 0, 0, 0), 200, 100); !errors.Is(err, ErrNoPicture) {
+		t.Errorf("detectActiveArea = %v, want %v", err, ErrNoPicture)
+	}
+}
@@ -2,38 +2,84 @@ package pkg
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mini-kvm/pkg/layout"
+	"mini-kvm/pkg/protocol"
 	"sync/atomic"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 	"github.com/rs/zerolog"
 )
 
+var ErrChannelNotOpen = errors.New("data channel is not open")
+
 type Client struct {
 	logger zerolog.Logger
+	server *Server
 
 	id         string
+	user       string
+	isAdmin    bool
 	connection *webrtc.PeerConnection
+	// layout is the target keyboard layout selected for this session, only
+	// touched by the control channel handler
+	layout *layout.Layout
 
 	mouseChannel    *webrtc.DataChannel
 	keyboardChannel *webrtc.DataChannel
-	controlChannel  *webrtc.DataChannel
+	controlChannel  atomic.Pointer[webrtc.DataChannel]
 
 	mouseChan chan MouseEvent
 	keyChan   chan KeyPressEvent
+	// relativeMouseChan is nil when relative events are dropped
+	relativeMouseChan chan MouseEvent
+	// consumerChan is nil when media keys go to the keyboard
+	consumerChan chan KeyPressEvent
+	// touchChan is nil when touch events are dropped
+	touchChan chan TouchEvent
+	// idleTimer releases the input of the client when it stops sending
+	// events while holding keys or buttons, nil when disabled
+	idleTimer *time.Timer
+	// recorder is set while the key events of the client are recorded into a
+	// macro
+	recorder atomic.Pointer[macroRecorder]
 
 	isClosed atomic.Bool
 }
 
-func NewClient(id string, connection *webrtc.PeerConnection, logger zerolog.Logger, mouseChan chan MouseEvent, keyChan chan KeyPressEvent) *Client {
+func NewClient(server *Server, id, user string, isAdmin bool, connection *webrtc.PeerConnection, logger zerolog.Logger) *Client {
 	c := &Client{
 		id:         id,
+		user:       user,
+		isAdmin:    isAdmin,
+		server:     server,
 		connection: connection,
-		mouseChan:  mouseChan,
-		keyChan:    keyChan,
+		layout:     server.defaultLayout,
+		mouseChan:  server.mouseController.EventChan(),
+		keyChan:    server.keyboardController.EventChan(),
 		logger:     logger,
 	}
 
+	if server.relativeMouseController != nil {
+		c.relativeMouseChan = server.relativeMouseController.EventChan()
+	}
+	if server.consumerController != nil {
+		c.consumerChan = server.consumerController.EventChan()
+	}
+	if server.touchController != nil {
+		c.touchChan = server.touchController.EventChan()
+	}
+
+	if server.inputIdleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(server.inputIdleTimeout, func() {
+			c.logger.Info().Msg("releasing input of idle client")
+			server.releaseClientInput(c.id)
+		})
+		c.idleTimer.Stop()
+	}
+
 	c.connection.OnDataChannel(func(dc *webrtc.DataChannel) {
 		logger.Println("on data channel", dc.Label())
 		switch dc.Label() {
@@ -42,10 +88,18 @@ func NewClient(id string, connection *webrtc.PeerConnection, logger zerolog.Logg
 		case "keyboard":
 			c.keyboardChannel = dc
 		case "control":
-			c.controlChannel = dc
+			c.controlChannel.Store(dc)
 		}
 		dc.OnOpen(func() {
 			logger.Println("on open data channel", dc.Label())
+			if dc.Label() == "control" {
+				server.onControlChannelOpen(c)
+			}
+		})
+		dc.OnClose(func() {
+			if dc.Label() != "control" {
+				server.releaseClientInput(c.id)
+			}
 		})
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 			c.onDataChannelMessage(dc, msg)
@@ -59,27 +113,151 @@ func (c *Client) Id() string {
 	return c.id
 }
 
+// User is the name of the user who opened the session, empty while
+// authentication is disabled.
+func (c *Client) User() string {
+	return c.user
+}
+
 func (c *Client) onDataChannelMessage(dc *webrtc.DataChannel, message webrtc.DataChannelMessage) {
 	switch dc.Label() {
 	case "mouse":
+		// input is dropped while the target sleeps
+		if !c.server.controlArbiter.IsController(c.id) || c.server.inputPaused() {
+			break
+		}
+
 		var m MouseEvent
 		if err := json.Unmarshal(message.Data, &m); err != nil {
 			c.logger.Error().Err(err).Msg("failed to unmarshal mouse location")
 			break
 		}
 
+		m.client = c.id
+		c.onInput()
+
+		if m.Mode == MouseModeRelative {
+			if c.relativeMouseChan != nil {
+				c.relativeMouseChan <- m
+			}
+			break
+		}
+
 		c.mouseChan <- m
 		break
 	case "keyboard":
+		if !c.server.controlArbiter.IsController(c.id) {
+			break
+		}
+
 		var k KeyPressEvent
 		if err := json.Unmarshal(message.Data, &k); err != nil {
 			c.logger.Error().Err(err).Msg("failed to unmarshal key press")
+			break
+		}
+
+		// system keys still reach a sleeping target, the wake key is how
+		// it is resumed
+		if _, system := JSCodeToSystem[k.KeyCode]; c.server.inputPaused() && (!system || c.consumerChan == nil) {
+			break
+		}
+
+		k.client = c.id
+		c.onInput()
+		if recorder := c.recorder.Load(); recorder != nil {
+			recorder.record(k)
+		}
+
+		if c.consumerChan != nil && IsConsumerKey(k.KeyCode) {
+			c.consumerChan <- k
+			break
 		}
 
 		c.keyChan <- k
 		break
+	case "touch":
+		if !c.server.controlArbiter.IsController(c.id) || c.touchChan == nil || c.server.inputPaused() {
+			break
+		}
+
+		var t TouchEvent
+		if err := json.Unmarshal(message.Data, &t); err != nil {
+			c.logger.Error().Err(err).Msg("failed to unmarshal touch")
+			break
+		}
+
+		t.client = c.id
+		c.onInput()
+
+		c.touchChan <- t
+		break
+	case "control":
+		envelope, msg, err := protocol.Decode(message.Data)
+		if err != nil {
+			c.logger.Error().Err(err).Msg("failed to decode control message")
+			id := ""
+			if envelope != nil {
+				id = envelope.Id
+			}
+
+			c.sendError(id, err)
+			break
+		}
+
+		c.server.handleControlMessage(c, envelope.Id, msg)
+	}
+}
+
+// onInput restarts the idle timeout of the client.
+func (c *Client) onInput() {
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.server.inputIdleTimeout)
+	}
+}
+
+// Send pushes msg to the client's control data channel.
+func (c *Client) Send(msg protocol.Message) error {
+	return c.Reply("", msg)
+}
+
+// Reply sends msg in answer to the request with the given id.
+func (c *Client) Reply(id string, msg protocol.Message) error {
+	dc := c.controlChannel.Load()
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrChannelNotOpen
+	}
+
+	data, err := protocol.Encode(id, msg)
+	if err != nil {
+		return err
+	}
+
+	return dc.SendText(string(data))
+}
+
+func (c *Client) sendControlState(controller string) {
+	msg := &protocol.ControlState{
+		Role:       protocol.ControlRoleViewer,
+		Controller: controller,
+	}
+
+	if controller == c.id {
+		msg.Role = protocol.ControlRoleController
+	}
+
+	if client, exists := c.server.clients.Load(controller); exists {
+		msg.ControllerUser = client.user
+	}
+
+	if err := c.Send(msg); err != nil && !errors.Is(err, ErrChannelNotOpen) {
+		c.logger.Error().Err(err).Msg("failed to send control state")
+	}
+}
+
+func (c *Client) sendError(id string, err error) {
+	if err := c.Reply(id, &protocol.Error{Error: err.Error()}); err != nil && !errors.Is(err, ErrChannelNotOpen) {
+		c.logger.Error().Err(err).Msg("failed to send error")
 	}
-	c.logger.Println("onDataChannelMessage", dc.Label())
 }
 
 func (c *Client) Close() error {
@@ -87,6 +265,11 @@ func (c *Client) Close() error {
 		return nil
 	}
 
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.server.releaseClientInput(c.id)
+
 	if err := c.connection.Close(); err != nil {
 		return fmt.Errorf("failed to close connection: %w", err)
 	}
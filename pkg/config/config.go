@@ -0,0 +1,576 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mini-kvm/pkg/gstreamer"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Listen string `yaml:"listen"`
+	// ShutdownTimeout bounds the whole shutdown sequence.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Video           Video         `yaml:"video"`
+	HID             HID           `yaml:"hid"`
+	Gadget          Gadget        `yaml:"gadget"`
+	MassStorage     MassStorage   `yaml:"mass_storage"`
+	ICEServers      []ICEServer   `yaml:"ice_servers"`
+	Web             Web           `yaml:"web"`
+	Auth            Auth          `yaml:"auth"`
+	TLS             TLS           `yaml:"tls"`
+	// CORSOrigins lists the origins allowed to call the API from another
+	// site. Empty means same-origin only, "*" allows any origin.
+	CORSOrigins []string `yaml:"cors_origins"`
+
+	// Path is the file the config was loaded from, empty when running on
+	// defaults.
+	Path string `yaml:"-"`
+}
+
+type Video struct {
+	Device         string                     `yaml:"device"`
+	Mode           gstreamer.VideoCaptureMode `yaml:"mode"`
+	Width          int                        `yaml:"width"`
+	Height         int                        `yaml:"height"`
+	Framerate      int                        `yaml:"framerate"`
+	Encoder        gstreamer.EncoderType      `yaml:"encoder"`
+	Bitrate        int64                      `yaml:"bitrate"`
+	EncoderOptions map[string]string          `yaml:"encoder_options"`
+}
+
+type HID struct {
+	Keyboard string `yaml:"keyboard"`
+	Mouse    string `yaml:"mouse"`
+	// RelativeMouse is the boot protocol mouse used while a client locks the
+	// pointer, disabled when empty or missing.
+	RelativeMouse string `yaml:"relative_mouse"`
+	// Consumer is the media and power key device, disabled when empty or
+	// missing.
+	Consumer string `yaml:"consumer"`
+	// Touch is the multi-touch digitizer for touch screen targets, disabled
+	// when empty or missing.
+	Touch string `yaml:"touch"`
+	// KeyboardReport is "6kro", "nkro" or "auto" to pick the format from the
+	// report length of the gadget function.
+	KeyboardReport string `yaml:"keyboard_report"`
+	// InputIdleTimeout releases the keys and buttons of a client which sent
+	// no input for this long, 0 disables it.
+	InputIdleTimeout time.Duration `yaml:"input_idle_timeout"`
+	// TypeDelay is the default pause between keystrokes of typed text.
+	TypeDelay time.Duration `yaml:"type_delay"`
+	// Layout is the keyboard layout of the target used to type text, unless a
+	// client selects another one.
+	Layout string `yaml:"layout"`
+	// LayoutsDir holds additional *.yaml layout tables.
+	LayoutsDir string `yaml:"layouts_dir"`
+	// WheelStep is the browser scroll distance in pixels of one wheel detent.
+	WheelStep float64 `yaml:"wheel_step"`
+	// WheelMultiplier is the resolution multiplier of the pointer wheel and
+	// must match WHEEL_MULTIPLIER of usb_init.sh unless the gadget is built
+	// from this config. 1 disables high-resolution scrolling.
+	WheelMultiplier int `yaml:"wheel_multiplier"`
+	// Calibration maps the captured picture onto the target screen for the
+	// absolute pointer and touch.
+	Calibration Calibration `yaml:"calibration"`
+	// Macros are key sequences run on the target next to the built-in ones.
+	Macros []Macro `yaml:"macros"`
+}
+
+// Macro is a named key sequence. Keys are browser key codes such as
+// "ControlLeft" or "KeyA".
+type Macro struct {
+	Name  string      `yaml:"name"`
+	Steps []MacroStep `yaml:"steps"`
+}
+
+// MacroStep presses keys, releases keys, taps keys (presses them in order and
+// releases them in reverse order) or waits. Exactly one of them is set.
+type MacroStep struct {
+	Down []string      `yaml:"down,omitempty,flow"`
+	Up   []string      `yaml:"up,omitempty,flow"`
+	Tap  []string      `yaml:"tap,omitempty,flow"`
+	Wait time.Duration `yaml:"wait,omitempty"`
+}
+
+const (
+	MaxMacroNameLength = 64
+	MaxMacroSteps      = 1000
+	MaxMacroDuration   = 5 * time.Minute
+)
+
+// Validate checks the shape of the macro, the key codes are checked by the
+// keyboard.
+func (m Macro) Validate() error {
+	if m.Name == "" || len(m.Name) > MaxMacroNameLength || strings.IndexFunc(m.Name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+	}) >= 0 {
+		return fmt.Errorf("name %q must be 1 to %d characters of a-z, 0-9, '-', '_' and '.'", m.Name, MaxMacroNameLength)
+	}
+
+	if len(m.Steps) == 0 || len(m.Steps) > MaxMacroSteps {
+		return fmt.Errorf("macro %s must have 1 to %d steps", m.Name, MaxMacroSteps)
+	}
+
+	var duration time.Duration
+	for i, step := range m.Steps {
+		actions := 0
+		for _, keys := range [][]string{step.Down, step.Up, step.Tap} {
+			if len(keys) > 0 {
+				actions++
+			}
+		}
+		if step.Wait != 0 {
+			actions++
+		}
+
+		if actions != 1 {
+			return fmt.Errorf("step %d of macro %s must set exactly one of down, up, tap and wait", i, m.Name)
+		}
+
+		if step.Wait < 0 {
+			return fmt.Errorf("step %d of macro %s waits a negative time", i, m.Name)
+		}
+
+		duration += step.Wait
+	}
+
+	if duration > MaxMacroDuration {
+		return fmt.Errorf("macro %s waits longer than %s", m.Name, MaxMacroDuration)
+	}
+
+	return nil
+}
+
+// Calibration corrects absolute pointer positions for capture cards which
+// letterbox or crop the target screen.
+type Calibration struct {
+	// ActiveArea is the part of the frame showing the target screen, as
+	// fractions of the frame size. The whole frame is used while it is empty.
+	ActiveArea Area `yaml:"active_area"`
+	// OffsetX and OffsetY shift the pointer by a fraction of the target
+	// screen after ScaleX and ScaleY were applied.
+	OffsetX float64 `yaml:"offset_x"`
+	OffsetY float64 `yaml:"offset_y"`
+	ScaleX  float64 `yaml:"scale_x"`
+	ScaleY  float64 `yaml:"scale_y"`
+}
+
+type Area struct {
+	Left   float64 `yaml:"left"`
+	Top    float64 `yaml:"top"`
+	Right  float64 `yaml:"right"`
+	Bottom float64 `yaml:"bottom"`
+}
+
+func (a Area) IsEmpty() bool {
+	return a == Area{}
+}
+
+// Validate reports the first invalid field of the calibration.
+func (c Calibration) Validate() error {
+	area := c.ActiveArea
+	if !area.IsEmpty() && (area.Left < 0 || area.Top < 0 || area.Right > 1 || area.Bottom > 1 || area.Left >= area.Right || area.Top >= area.Bottom) {
+		return fmt.Errorf("active_area %+v must lie within 0 and 1 with left < right and top < bottom", area)
+	}
+
+	if c.ScaleX <= 0 || c.ScaleY <= 0 {
+		return fmt.Errorf("scale %gx%g must be positive", c.ScaleX, c.ScaleY)
+	}
+
+	if c.OffsetX < -1 || c.OffsetX > 1 || c.OffsetY < -1 || c.OffsetY > 1 {
+		return fmt.Errorf("offset %g,%g must be between -1 and 1", c.OffsetX, c.OffsetY)
+	}
+
+	return nil
+}
+
+type Web struct {
+	// Dir serves the UI from disk instead of the embedded copy.
+	Dir string `yaml:"dir"`
+}
+
+type TLS struct {
+	Enabled bool   `yaml:"enabled"`
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+	// SelfSigned generates and stores a certificate at Cert/Key when they
+	// don't exist yet.
+	SelfSigned bool `yaml:"self_signed"`
+	// Hosts are extra names and addresses added to a generated certificate.
+	Hosts []string `yaml:"hosts"`
+	// RedirectHTTP is an address which redirects plain HTTP to HTTPS.
+	RedirectHTTP string `yaml:"redirect_http"`
+}
+
+type Auth struct {
+	Disabled bool `yaml:"disabled"`
+	// Secret signs session tokens. A random secret is used when empty,
+	// which logs everyone out on restart.
+	Secret     string        `yaml:"secret"`
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	Users      []User        `yaml:"users"`
+	// InitialPasswordFile holds the generated password of the admin user
+	// while Users is empty.
+	InitialPasswordFile string `yaml:"initial_password_file"`
+}
+
+type User struct {
+	Name         string `yaml:"name"`
+	PasswordHash string `yaml:"password_hash"`
+	// Admin allows taking control away from another user.
+	Admin bool `yaml:"admin"`
+}
+
+// GadgetFunctions are the functions the gadget can be built with.
+var GadgetFunctions = []string{"keyboard", "mouse", "consumer", "relative_mouse", "touch", "mass_storage"}
+
+// Gadget builds the USB gadget in configfs on start instead of relying on
+// usb_init.sh. The device paths of hid are then replaced by the nodes of the
+// created functions.
+type Gadget struct {
+	Enabled bool `yaml:"enabled"`
+	// Name is the directory of the gadget in configfs.
+	Name string `yaml:"name"`
+	// UDC is the USB device controller to bind to, the first one when empty.
+	UDC          string `yaml:"udc"`
+	VendorID     uint16 `yaml:"vendor_id"`
+	ProductID    uint16 `yaml:"product_id"`
+	Manufacturer string `yaml:"manufacturer"`
+	Product      string `yaml:"product"`
+	// SerialNumber is derived from the machine id when empty.
+	SerialNumber string `yaml:"serial_number"`
+	// Functions lists the functions to create out of GadgetFunctions. The
+	// keyboard and mouse are required.
+	Functions []string `yaml:"functions"`
+	// RemoveOnExit deletes the gadget on shutdown, so the target sees the
+	// devices unplugged.
+	RemoveOnExit bool `yaml:"remove_on_exit"`
+}
+
+// MassStorage attaches disk images to the target as a USB drive. It needs the
+// gadget with the mass_storage function.
+type MassStorage struct {
+	// ImagesDir holds the images which can be attached.
+	ImagesDir string `yaml:"images_dir"`
+	// Medium is attached on start and saved back whenever it changes.
+	Medium Medium `yaml:"medium"`
+}
+
+// Medium is an image attached to the mass storage drive.
+type Medium struct {
+	// Image is a file name in the images directory, empty while nothing is
+	// attached.
+	Image string `yaml:"image"`
+	// CDROM presents the image as an optical disc, which is always
+	// read-only.
+	CDROM    bool `yaml:"cdrom"`
+	ReadOnly bool `yaml:"read_only"`
+}
+
+// ValidImageName reports whether name is a plain file name in the images
+// directory. Names starting with a dot are reserved for files being written.
+func ValidImageName(name string) bool {
+	return name != "" && len(name) <= 255 && name[0] != '.' && !strings.ContainsAny(name, "/\\\x00")
+}
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listen:          ":8080",
+		ShutdownTimeout: 20 * time.Second,
+		Video: Video{
+			Device:    "/dev/video0",
+			Mode:      gstreamer.VideoCaptureModeMJPEG,
+			Width:     1920,
+			Height:    1080,
+			Framerate: 30,
+			Encoder:   gstreamer.EncoderTypeHEVC_MPP,
+			Bitrate:   2_000_000,
+			EncoderOptions: map[string]string{
+				"rc-mode":     "vbr",
+				"max-pending": "4",
+				"header-mode": "each-idr",
+				"gop":         "60",
+			},
+		},
+		HID: HID{
+			Keyboard:         "/dev/hidg0",
+			Mouse:            "/dev/hidg1",
+			RelativeMouse:    "/dev/hidg3",
+			Consumer:         "/dev/hidg2",
+			Touch:            "/dev/hidg4",
+			KeyboardReport:   "auto",
+			TypeDelay:        20 * time.Millisecond,
+			InputIdleTimeout: 30 * time.Second,
+			Layout:           "us",
+			WheelStep:        100,
+			WheelMultiplier:  1,
+			Calibration:      Calibration{ScaleX: 1, ScaleY: 1},
+		},
+		Gadget: Gadget{
+			Name:         "hid_devices",
+			VendorID:     0x1d6b,
+			ProductID:    0x0104,
+			Manufacturer: "mini-kvm",
+			Product:      "Virtual HID",
+			Functions:    []string{"keyboard", "mouse", "consumer", "relative_mouse", "touch"},
+		},
+		MassStorage: MassStorage{
+			ImagesDir: "/var/lib/mkvm/images",
+		},
+		ICEServers: []ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		},
+		Auth: Auth{
+			SessionTTL:          12 * time.Hour,
+			InitialPasswordFile: "/var/lib/mkvm/initial-password",
+		},
+		TLS: TLS{
+			Cert:       "/var/lib/mkvm/tls/cert.pem",
+			Key:        "/var/lib/mkvm/tls/key.pem",
+			SelfSigned: true,
+		},
+	}
+}
+
+// Load returns the default configuration overlaid with the YAML file at path
+// (if any) and then with MKVM_* environment variables.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+
+		c.Path = path
+	}
+
+	if err := applyEnv(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Listen == "" {
+		errs = append(errs, errors.New("listen must not be empty"))
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must be positive, got %s", c.ShutdownTimeout))
+	}
+
+	if c.Video.Device == "" {
+		errs = append(errs, errors.New("video.device must not be empty"))
+	}
+
+	if c.Video.Mode != gstreamer.VideoCaptureModeMJPEG {
+		errs = append(errs, fmt.Errorf("video.mode %q is not supported", c.Video.Mode))
+	}
+
+	if c.Video.Width <= 0 || c.Video.Height <= 0 {
+		errs = append(errs, fmt.Errorf("video resolution %dx%d is invalid", c.Video.Width, c.Video.Height))
+	}
+
+	if c.Video.Framerate <= 0 {
+		errs = append(errs, fmt.Errorf("video.framerate must be positive, got %d", c.Video.Framerate))
+	}
+
+	if c.Video.Encoder != gstreamer.EncoderTypeHEVC_MPP {
+		errs = append(errs, errors.New("video.encoder must be hevc_mpp"))
+	}
+
+	if c.Video.Bitrate <= 0 {
+		errs = append(errs, fmt.Errorf("video.bitrate must be positive, got %d", c.Video.Bitrate))
+	}
+
+	if c.HID.Keyboard == "" {
+		errs = append(errs, errors.New("hid.keyboard must not be empty"))
+	}
+
+	if c.HID.Mouse == "" {
+		errs = append(errs, errors.New("hid.mouse must not be empty"))
+	}
+
+	switch c.HID.KeyboardReport {
+	case "auto", "6kro", "nkro":
+	default:
+		errs = append(errs, fmt.Errorf("hid.keyboard_report must be auto, 6kro or nkro, got %q", c.HID.KeyboardReport))
+	}
+
+	if c.HID.InputIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("hid.input_idle_timeout must not be negative, got %s", c.HID.InputIdleTimeout))
+	}
+
+	if c.HID.TypeDelay < 0 {
+		errs = append(errs, fmt.Errorf("hid.type_delay must not be negative, got %s", c.HID.TypeDelay))
+	}
+
+	if c.HID.Layout == "" {
+		errs = append(errs, errors.New("hid.layout must not be empty"))
+	}
+
+	if c.HID.WheelStep <= 0 {
+		errs = append(errs, fmt.Errorf("hid.wheel_step must be positive, got %g", c.HID.WheelStep))
+	}
+
+	if c.HID.WheelMultiplier < 1 || c.HID.WheelMultiplier > 127 {
+		errs = append(errs, fmt.Errorf("hid.wheel_multiplier must be between 1 and 127, got %d", c.HID.WheelMultiplier))
+	}
+
+	if err := c.HID.Calibration.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("hid.calibration: %w", err))
+	}
+
+	macroNames := make(map[string]bool, len(c.HID.Macros))
+	for i, macro := range c.HID.Macros {
+		if err := macro.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("hid.macros[%d]: %w", i, err))
+		} else if macroNames[macro.Name] {
+			errs = append(errs, fmt.Errorf("hid.macros[%d]: duplicate macro %q", i, macro.Name))
+		}
+		macroNames[macro.Name] = true
+	}
+
+	if c.Gadget.Enabled {
+		if c.Gadget.Name == "" || strings.ContainsAny(c.Gadget.Name, "/.") {
+			errs = append(errs, fmt.Errorf("gadget.name must be a plain directory name, got %q", c.Gadget.Name))
+		}
+
+		for _, function := range c.Gadget.Functions {
+			if !slices.Contains(GadgetFunctions, function) {
+				errs = append(errs, fmt.Errorf("gadget.functions: unknown function %q, expected one of %s", function, strings.Join(GadgetFunctions, ", ")))
+			}
+		}
+
+		for _, required := range []string{"keyboard", "mouse"} {
+			if !slices.Contains(c.Gadget.Functions, required) {
+				errs = append(errs, fmt.Errorf("gadget.functions must contain %s", required))
+			}
+		}
+	}
+
+	if c.Gadget.Enabled && slices.Contains(c.Gadget.Functions, "mass_storage") {
+		if c.MassStorage.ImagesDir == "" {
+			errs = append(errs, errors.New("mass_storage.images_dir must not be empty"))
+		}
+
+		if image := c.MassStorage.Medium.Image; image != "" && !ValidImageName(image) {
+			errs = append(errs, fmt.Errorf("mass_storage.medium.image must be a file name in images_dir, got %q", image))
+		}
+	}
+
+	for i, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("ice_servers[%d].urls must not be empty", i))
+		}
+
+		for _, iceURL := range server.URLs {
+			if !strings.HasPrefix(iceURL, "stun:") && !strings.HasPrefix(iceURL, "turn:") && !strings.HasPrefix(iceURL, "turns:") {
+				errs = append(errs, fmt.Errorf("ice_servers[%d]: unsupported url %q", i, iceURL))
+			}
+		}
+	}
+
+	if c.Web.Dir != "" {
+		if info, err := os.Stat(c.Web.Dir); err != nil {
+			errs = append(errs, fmt.Errorf("web.dir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("web.dir %s is not a directory", c.Web.Dir))
+		}
+	}
+
+	errs = append(errs, c.Auth.validate()...)
+	errs = append(errs, c.TLS.validate()...)
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("cors_origins: %q is not an origin", origin))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func (a *Auth) validate() (errs []error) {
+	if a.Disabled {
+		return nil
+	}
+
+	if a.SessionTTL <= 0 {
+		errs = append(errs, fmt.Errorf("auth.session_ttl must be positive, got %s", a.SessionTTL))
+	}
+
+	if len(a.Users) == 0 && a.InitialPasswordFile == "" {
+		errs = append(errs, errors.New("auth.initial_password_file must not be empty while auth.users is empty"))
+	}
+
+	names := make(map[string]bool, len(a.Users))
+	for i, user := range a.Users {
+		if user.Name == "" {
+			errs = append(errs, fmt.Errorf("auth.users[%d].name must not be empty", i))
+		} else if names[user.Name] {
+			errs = append(errs, fmt.Errorf("auth.users[%d]: duplicate user %q", i, user.Name))
+		}
+		names[user.Name] = true
+
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			errs = append(errs, fmt.Errorf("auth.users[%d].password_hash is not a bcrypt hash: %w", i, err))
+		}
+	}
+
+	return errs
+}
+
+func (t *TLS) validate() (errs []error) {
+	if !t.Enabled {
+		if t.RedirectHTTP != "" {
+			errs = append(errs, errors.New("tls.redirect_http requires tls.enabled"))
+		}
+
+		return errs
+	}
+
+	if t.Cert == "" || t.Key == "" {
+		errs = append(errs, errors.New("tls.cert and tls.key must not be empty"))
+	} else if !t.SelfSigned {
+		for _, path := range []string{t.Cert, t.Key} {
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, fmt.Errorf("tls: %w", err))
+			}
+		}
+	}
+
+	return errs
+}
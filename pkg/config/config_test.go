@@ -0,0 +1,119 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := "listen: file:1\nvideo:\n  width: 1280\n  height: 720\n  framerate: 25\n"
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("MKVM_LISTEN", "env:2")
+	t.Setenv("MKVM_VIDEO_WIDTH", "1024")
+	t.Setenv("MKVM_TLS", "true")
+
+	fs := flag.NewFlagSet("mkvm", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-listen", "flag:3", "-tls=false", "-gadget", "-auth-disabled"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flags.Apply(c); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{name: "default", got: c.Video.Device, want: Default().Video.Device},
+		{name: "file", got: c.Video.Framerate, want: 25},
+		{name: "env over file", got: c.Video.Width, want: 1024},
+		{name: "flag over env and file", got: c.Listen, want: "flag:3"},
+		{name: "false flag over env", got: c.TLS.Enabled, want: false},
+		{name: "bare bool flag", got: c.Gadget.Enabled, want: true},
+		{name: "another bare bool flag", got: c.Auth.Disabled, want: true},
+	}
+
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestInvalidOverrides(t *testing.T) {
+	t.Setenv("MKVM_VIDEO_WIDTH", "wide")
+	if _, err := Load(""); err == nil || !strings.Contains(err.Error(), "MKVM_VIDEO_WIDTH") {
+		t.Errorf("Load = %v, want an error naming MKVM_VIDEO_WIDTH", err)
+	}
+
+	fs := flag.NewFlagSet("mkvm", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-video-height=high"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flags.Apply(Default()); err == nil || !strings.Contains(err.Error(), "--video-height") {
+		t.Errorf("Apply = %v, want an error naming --video-height", err)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{name: "listen", modify: func(c *Config) { c.Listen = "" }, want: "listen must not be empty"},
+		{name: "resolution", modify: func(c *Config) { c.Video.Width = 0 }, want: "video resolution 0x"},
+		{name: "keyboard report", modify: func(c *Config) { c.HID.KeyboardReport = "12kro" }, want: "hid.keyboard_report"},
+		{name: "wheel multiplier", modify: func(c *Config) { c.HID.WheelMultiplier = 128 }, want: "hid.wheel_multiplier"},
+		{name: "gadget name", modify: func(c *Config) { c.Gadget.Enabled, c.Gadget.Name = true, "../g" }, want: "gadget.name"},
+		{name: "unknown gadget function", modify: func(c *Config) { c.Gadget.Enabled, c.Gadget.Functions = true, []string{"keyboard", "mouse", "printer"} }, want: `unknown function "printer"`},
+		{name: "ice server", modify: func(c *Config) { c.ICEServers = []ICEServer{{URLs: []string{"http://example.com"}}} }, want: "ice_servers[0]: unsupported url"},
+		{name: "cors origin", modify: func(c *Config) { c.CORSOrigins = []string{"example.com/path"} }, want: "cors_origins"},
+		{name: "no users and no password file", modify: func(c *Config) { c.Auth.InitialPasswordFile = "" }, want: "auth.initial_password_file"},
+		{name: "user password hash", modify: func(c *Config) { c.Auth.Users = []User{{Name: "admin", PasswordHash: "plain"}} }, want: "auth.users[0].password_hash"},
+		{name: "redirect without tls", modify: func(c *Config) { c.TLS.RedirectHTTP = ":80" }, want: "tls.redirect_http requires tls.enabled"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := Default()
+			test.modify(c)
+			err := c.Validate()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Validate = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+
+	// every problem is reported at once
+	c := Default()
+	c.Listen = ""
+	c.Video.Framerate = 0
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "listen") || !strings.Contains(err.Error(), "video.framerate") {
+		t.Errorf("Validate = %v, want both errors", err)
+	}
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type override struct {
+	name  string
+	usage string
+	// isBool lets the flag be given without a value, as -name alone
+	isBool bool
+	apply  func(c *Config, value string) error
+}
+
+// overrides lists the settings which can be changed from the command line
+// (--name) and the environment (MKVM_NAME, dashes replaced by underscores).
+var overrides = []override{
+	{"listen", "address the HTTP server listens on", false, func(c *Config, v string) error {
+		c.Listen = v
+		return nil
+	}},
+	{"video-device", "V4L2 capture device", false, func(c *Config, v string) error {
+		c.Video.Device = v
+		return nil
+	}},
+	{"video-mode", "capture mode (mjpeg)", false, func(c *Config, v string) error {
+		return c.Video.Mode.UnmarshalText([]byte(v))
+	}},
+	{"video-width", "capture width", false, intSetter(func(c *Config) *int { return &c.Video.Width })},
+	{"video-height", "capture height", false, intSetter(func(c *Config) *int { return &c.Video.Height })},
+	{"video-framerate", "capture framerate", false, intSetter(func(c *Config) *int { return &c.Video.Framerate })},
+	{"video-bitrate", "encoder bitrate in bits per second", false, func(c *Config, v string) error {
+		bitrate, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		c.Video.Bitrate = bitrate
+		return nil
+	}},
+	{"hid-keyboard", "keyboard HID gadget device", false, func(c *Config, v string) error {
+		c.HID.Keyboard = v
+		return nil
+	}},
+	{"hid-mouse", "mouse HID gadget device", false, func(c *Config, v string) error {
+		c.HID.Mouse = v
+		return nil
+	}},
+	{"hid-relative-mouse", "relative mouse HID gadget device, empty to disable", false, func(c *Config, v string) error {
+		c.HID.RelativeMouse = v
+		return nil
+	}},
+	{"hid-consumer", "media and power key HID gadget device, empty to disable", false, func(c *Config, v string) error {
+		c.HID.Consumer = v
+		return nil
+	}},
+	{"hid-touch", "multi-touch HID gadget device, empty to disable", false, func(c *Config, v string) error {
+		c.HID.Touch = v
+		return nil
+	}},
+	{"hid-keyboard-report", "keyboard report format (auto, 6kro, nkro)", false, func(c *Config, v string) error {
+		c.HID.KeyboardReport = v
+		return nil
+	}},
+	{"hid-layout", "keyboard layout of the target (us, uk, de, fr, pl)", false, func(c *Config, v string) error {
+		c.HID.Layout = v
+		return nil
+	}},
+	{"hid-wheel-multiplier", "resolution multiplier of the pointer wheel, as set up by usb_init.sh or the gadget", false, func(c *Config, v string) error {
+		multiplier, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+
+		c.HID.WheelMultiplier = multiplier
+		return nil
+	}},
+	{"gadget", "create the USB gadget on start instead of using usb_init.sh", true, boolSetter(func(c *Config) *bool { return &c.Gadget.Enabled })},
+	{"gadget-udc", "USB device controller to bind the gadget to", false, func(c *Config, v string) error {
+		c.Gadget.UDC = v
+		return nil
+	}},
+	{"web-dir", "serve the web UI from this directory instead of the embedded copy", false, func(c *Config, v string) error {
+		c.Web.Dir = v
+		return nil
+	}},
+	{"auth-disabled", "disable authentication (development only)", true, boolSetter(func(c *Config) *bool { return &c.Auth.Disabled })},
+	{"auth-secret", "secret used to sign session tokens", false, func(c *Config, v string) error {
+		c.Auth.Secret = v
+		return nil
+	}},
+	{"tls", "serve HTTPS", true, boolSetter(func(c *Config) *bool { return &c.TLS.Enabled })},
+	{"tls-cert", "TLS certificate file", false, func(c *Config, v string) error {
+		c.TLS.Cert = v
+		return nil
+	}},
+	{"tls-key", "TLS private key file", false, func(c *Config, v string) error {
+		c.TLS.Key = v
+		return nil
+	}},
+	{"tls-redirect-http", "address redirecting plain HTTP to HTTPS", false, func(c *Config, v string) error {
+		c.TLS.RedirectHTTP = v
+		return nil
+	}},
+	{"cors-origins", "comma separated list of allowed CORS origins", false, func(c *Config, v string) error {
+		c.CORSOrigins = splitList(v)
+		return nil
+	}},
+	{"ice-servers", "comma separated list of STUN/TURN urls", false, func(c *Config, v string) error {
+		c.ICEServers = nil
+		for _, url := range splitList(v) {
+			c.ICEServers = append(c.ICEServers, ICEServer{URLs: []string{url}})
+		}
+
+		return nil
+	}},
+}
+
+func intSetter(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+
+		*field(c) = i
+		return nil
+	}
+}
+
+func boolSetter(field func(c *Config) *bool) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+
+		*field(c) = b
+		return nil
+	}
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func envName(name string) string {
+	return "MKVM_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func applyEnv(c *Config) error {
+	for _, o := range overrides {
+		value, ok := os.LookupEnv(envName(o.name))
+		if !ok {
+			continue
+		}
+
+		if err := o.apply(c, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", envName(o.name), err)
+		}
+	}
+
+	return nil
+}
+
+// Flags holds command line overrides until the config file has been loaded.
+type Flags struct {
+	values map[string]string
+}
+
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{values: make(map[string]string)}
+	for _, o := range overrides {
+		usage := fmt.Sprintf("%s (env %s)", o.usage, envName(o.name))
+		set := func(v string) error {
+			f.values[o.name] = v
+			return nil
+		}
+
+		if o.isBool {
+			// BoolFunc passes "true" for a bare -name
+			fs.BoolFunc(o.name, usage, set)
+		} else {
+			fs.Func(o.name, usage, set)
+		}
+	}
+
+	return f
+}
+
+func (f *Flags) Apply(c *Config) error {
+	for _, o := range overrides {
+		value, ok := f.values[o.name]
+		if !ok {
+			continue
+		}
+
+		if err := o.apply(c, value); err != nil {
+			return fmt.Errorf("invalid --%s: %w", o.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SaveCalibration replaces hid.calibration of the config file at path,
+// keeping the rest of the file and its comments as they are.
+func SaveCalibration(path string, calibration Calibration) error {
+	return saveValue(path, "hid", "calibration", calibration)
+}
+
+// SaveMacros replaces hid.macros of the config file at path.
+func SaveMacros(path string, macros []Macro) error {
+	return saveValue(path, "hid", "macros", macros)
+}
+
+// SaveMedium replaces mass_storage.medium of the config file at path.
+func SaveMedium(path string, medium Medium) error {
+	return saveValue(path, "mass_storage", "medium", medium)
+}
+
+// saveMutex keeps concurrent saves from writing back a file without the
+// value another one just saved.
+var saveMutex sync.Mutex
+
+// saveValue replaces key in the section mapping of the config file at path.
+func saveValue(path, section, key string, v any) error {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	if len(document.Content) == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s is not a mapping", path)
+	}
+
+	sectionNode := mappingValue(root, section)
+	if sectionNode.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s of config %s is not a mapping", section, path)
+	}
+
+	value := mappingValue(sectionNode, key)
+	headComment, lineComment := value.HeadComment, value.LineComment
+	if err := value.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode %s.%s: %w", section, key, err)
+	}
+	value.HeadComment, value.LineComment = headComment, lineComment
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// mappingValue returns the value of key in mapping, adding an empty mapping
+// when the key is missing.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+
+	value := &yaml.Node{Kind: yaml.MappingNode}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	return value
+}
+
+// writeFileAtomic replaces path with data so that a crash never leaves a
+// truncated config behind.
+func writeFileAtomic(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat config: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	if err := file.Chmod(info.Mode().Perm()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestConcurrentSavesKeepEachOther(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	for range 100 {
+		if err := os.WriteFile(path, []byte("# kept\nhid:\n  keyboard: /dev/hidg0\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var calibrationErr, mediumErr error
+		wg.Go(func() { calibrationErr = SaveCalibration(path, Calibration{OffsetX: 0.5}) })
+		wg.Go(func() { mediumErr = SaveMedium(path, Medium{Image: "disk.iso"}) })
+		wg.Wait()
+		if err := errors.Join(calibrationErr, mediumErr); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var cfg Config
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.HID.Keyboard != "/dev/hidg0" || cfg.HID.Calibration.OffsetX != 0.5 || cfg.MassStorage.Medium.Image != "disk.iso" {
+			t.Fatalf("a save was lost:\n%s", data)
+		}
+
+		if string(data[:7]) != "# kept\n" {
+			t.Fatalf("config lost its comment:\n%s", data)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/hid"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	consumerReportId = 0x01
+	systemReportId   = 0x02
+)
+
+// ConsumerController sends media keys and system power keys, which hosts
+// accept even while asleep when remote wakeup is enabled.
+type ConsumerController struct {
+	device            *os.File
+	eventChan         chan KeyPressEvent
+	releaseChan       chan struct{}
+	releaseClientChan chan string
+
+	// writeErrors is only touched by the dispatcher
+	writeErrors writeErrorLog
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closeErr error
+}
+
+func NewConsumerController(ctx context.Context, devicePath string) *ConsumerController {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &ConsumerController{
+		eventChan:         make(chan KeyPressEvent, 100),
+		releaseChan:       make(chan struct{}, 1),
+		releaseClientChan: make(chan string, 8),
+		writeErrors:       writeErrorLog{device: "consumer control"},
+		cancel:            cancel,
+		done:              make(chan struct{}),
+	}
+
+	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0666)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", devicePath).Msg("failed to open device")
+	}
+
+	c.device = device
+	go c.usbActionDispatcher(ctx)
+	return c
+}
+
+func (m *ConsumerController) usbActionDispatcher(ctx context.Context) {
+	defer close(m.done)
+	// both reports hold a single usage, the last key pressed wins
+	var consumer ConsumerUsage
+	var system SystemUsage
+	// the clients pressing the current usages
+	var consumerClient, systemClient string
+	for {
+		select {
+		case <-ctx.Done():
+			m.closeErr = errors.Join(m.release(), m.device.Close())
+			return
+		case <-m.releaseChan:
+			consumer, system = 0, 0
+			m.writeErrors.check(m.release(), "failed to release consumer keys")
+		case client := <-m.releaseClientChan:
+			if consumer != 0 && consumerClient == client {
+				consumer = 0
+				m.writeErrors.check(m.sendConsumerReport(consumer), "failed to release consumer key")
+			}
+
+			if system != 0 && systemClient == client {
+				system = 0
+				m.writeErrors.check(m.sendSystemReport(system), "failed to release system key")
+			}
+		case keyPress := <-m.eventChan:
+			if usage, exists := JSCodeToConsumer[keyPress.KeyCode]; exists {
+				if keyPress.IsDown {
+					consumer, consumerClient = usage, keyPress.client
+				} else if consumer == usage {
+					consumer = 0
+				}
+
+				m.writeErrors.check(m.sendConsumerReport(consumer), "failed to send consumer key")
+			} else if usage, exists := JSCodeToSystem[keyPress.KeyCode]; exists {
+				if keyPress.IsDown {
+					system, systemClient = usage, keyPress.client
+				} else if system == usage {
+					system = 0
+				}
+
+				m.writeErrors.check(m.sendSystemReport(system), "failed to send system key")
+			}
+		}
+	}
+}
+
+// ReleaseClient lifts the keys pressed by the client with the given id.
+func (m *ConsumerController) ReleaseClient(id string) {
+	select {
+	case m.releaseClientChan <- id:
+	case <-m.done:
+	}
+}
+
+func (m *ConsumerController) release() error {
+	return errors.Join(m.sendConsumerReport(0), m.sendSystemReport(0))
+}
+
+// consumerReportLayout locates the usage arrays of the consumer and system
+// control reports.
+type consumerReportLayout struct {
+	consumer, system           *hid.Report
+	consumerUsage, systemUsage hid.Field
+}
+
+var consumerLayout = func() consumerReportLayout {
+	consumer := mustReport(consumerDescriptor, hid.KindInput, consumerReportId)
+	system := mustReport(consumerDescriptor, hid.KindInput, systemReportId)
+	return consumerReportLayout{
+		consumer:      consumer,
+		system:        system,
+		consumerUsage: mustArray(consumer, hid.PageConsumer),
+		systemUsage:   mustArray(system, hid.PageGenericDesktop),
+	}
+}()
+
+/*
+Report Structure for HID Consumer Control
+
+Byte 0: Report ID (always 0x01)
+Byte 1: Usage (low byte)
+Byte 2: Usage (high byte)
+*/
+func (m *ConsumerController) sendConsumerReport(usage ConsumerUsage) error {
+	report := consumerLayout.consumer.New()
+	putUsage(report, consumerLayout.consumerUsage, hid.PageConsumer, uint16(usage))
+
+	_, err := m.device.Write(report)
+	return err
+}
+
+/*
+Report Structure for HID System Control
+
+Byte 0: Report ID (always 0x02)
+Byte 1: Bits 0-1: 1 Power Down, 2 Sleep, 3 Wake Up, 0 none
+*/
+func (m *ConsumerController) sendSystemReport(usage SystemUsage) error {
+	report := consumerLayout.system.New()
+	putUsage(report, consumerLayout.systemUsage, hid.PageGenericDesktop, uint16(usage))
+
+	_, err := m.device.Write(report)
+	return err
+}
+
+func (m *ConsumerController) EventChan() chan KeyPressEvent {
+	return m.eventChan
+}
+
+// Close releases all keys and closes the device.
+func (m *ConsumerController) Close(ctx context.Context) error {
+	m.cancel()
+	select {
+	case <-m.done:
+		return m.closeErr
+	case <-ctx.Done():
+		return fmt.Errorf("failed to close consumer control: %w", ctx.Err())
+	}
+}
+
+// ReleaseAll lifts every pressed key on the host.
+func (m *ConsumerController) ReleaseAll() {
+	select {
+	case m.releaseChan <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,73 @@
+package pkg
+
+// USB HID Consumer page (0x0C) and Generic Desktop system control usages.
+// Hosts handle these on their own device rather than on the boot keyboard.
+
+type ConsumerUsage uint16
+
+const (
+	ConsumerBrightnessUp   ConsumerUsage = 0x006F
+	ConsumerBrightnessDown ConsumerUsage = 0x0070
+	ConsumerNextTrack      ConsumerUsage = 0x00B5
+	ConsumerPreviousTrack  ConsumerUsage = 0x00B6
+	ConsumerStop           ConsumerUsage = 0x00B7
+	ConsumerEject          ConsumerUsage = 0x00B8
+	ConsumerPlayPause      ConsumerUsage = 0x00CD
+	ConsumerMute           ConsumerUsage = 0x00E2
+	ConsumerVolumeUp       ConsumerUsage = 0x00E9
+	ConsumerVolumeDown     ConsumerUsage = 0x00EA
+	ConsumerMediaSelect    ConsumerUsage = 0x0183
+	ConsumerMail           ConsumerUsage = 0x018A
+	ConsumerCalculator     ConsumerUsage = 0x0192
+	ConsumerMyComputer     ConsumerUsage = 0x0194
+	ConsumerSearch         ConsumerUsage = 0x0221
+	ConsumerHome           ConsumerUsage = 0x0223
+	ConsumerBack           ConsumerUsage = 0x0224
+	ConsumerForward        ConsumerUsage = 0x0225
+	ConsumerRefresh        ConsumerUsage = 0x0227
+	ConsumerBookmarks      ConsumerUsage = 0x022A
+)
+
+type SystemUsage uint8
+
+const (
+	SystemPowerDown SystemUsage = 0x81
+	SystemSleep     SystemUsage = 0x82
+	SystemWakeUp    SystemUsage = 0x83
+)
+
+var JSCodeToConsumer = map[JSKeyCode]ConsumerUsage{
+	"AudioVolumeMute":    ConsumerMute,
+	"AudioVolumeUp":      ConsumerVolumeUp,
+	"AudioVolumeDown":    ConsumerVolumeDown,
+	"MediaPlayPause":     ConsumerPlayPause,
+	"MediaStop":          ConsumerStop,
+	"MediaTrackNext":     ConsumerNextTrack,
+	"MediaTrackPrevious": ConsumerPreviousTrack,
+	"MediaSelect":        ConsumerMediaSelect,
+	"Eject":              ConsumerEject,
+	"LaunchMail":         ConsumerMail,
+	"LaunchApp1":         ConsumerMyComputer,
+	"LaunchApp2":         ConsumerCalculator,
+	"BrowserSearch":      ConsumerSearch,
+	"BrowserHome":        ConsumerHome,
+	"BrowserBack":        ConsumerBack,
+	"BrowserForward":     ConsumerForward,
+	"BrowserRefresh":     ConsumerRefresh,
+	"BrowserFavorites":   ConsumerBookmarks,
+	"BrightnessUp":       ConsumerBrightnessUp,
+	"BrightnessDown":     ConsumerBrightnessDown,
+}
+
+var JSCodeToSystem = map[JSKeyCode]SystemUsage{
+	"Power":  SystemPowerDown,
+	"Sleep":  SystemSleep,
+	"WakeUp": SystemWakeUp,
+}
+
+// IsConsumerKey reports whether code is sent on the consumer control device.
+func IsConsumerKey(code JSKeyCode) bool {
+	_, consumer := JSCodeToConsumer[code]
+	_, system := JSCodeToSystem[code]
+	return consumer || system
+}
@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrNotController = errors.New("client does not hold control")
+
+// ControlArbiter decides which single client may send keyboard and mouse
+// input. Every other client only views the stream.
+type ControlArbiter struct {
+	mutex      sync.Mutex
+	controller string
+	onChange   func(previous, controller string)
+}
+
+// NewControlArbiter calls onChange, outside the lock, whenever the controller
+// changes. An empty id means nobody is in control.
+func NewControlArbiter(onChange func(previous, controller string)) *ControlArbiter {
+	return &ControlArbiter{
+		onChange: onChange,
+	}
+}
+
+func (a *ControlArbiter) Controller() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.controller
+}
+
+func (a *ControlArbiter) IsController(id string) bool {
+	return id != "" && a.Controller() == id
+}
+
+func (a *ControlArbiter) set(id string, allowed func(current string) bool) bool {
+	a.mutex.Lock()
+	previous := a.controller
+	if !allowed(previous) {
+		a.mutex.Unlock()
+		return false
+	}
+
+	a.controller = id
+	a.mutex.Unlock()
+
+	if previous != id && a.onChange != nil {
+		a.onChange(previous, id)
+	}
+
+	return true
+}
+
+// Request grants control to id when nobody holds it and reports whether id
+// is now the controller.
+func (a *ControlArbiter) Request(id string) bool {
+	return a.set(id, func(current string) bool {
+		return current == "" || current == id
+	})
+}
+
+// Grant hands control from the current controller to another client.
+func (a *ControlArbiter) Grant(from, to string) error {
+	if !a.set(to, func(current string) bool { return current == from }) {
+		return ErrNotController
+	}
+
+	return nil
+}
+
+// Take moves control to id regardless of who holds it. Callers check that id
+// is allowed to take over.
+func (a *ControlArbiter) Take(id string) {
+	a.set(id, func(string) bool { return true })
+}
+
+// Release gives up control if id holds it and reports whether it did.
+func (a *ControlArbiter) Release(id string) bool {
+	return a.set("", func(current string) bool { return current == id })
+}
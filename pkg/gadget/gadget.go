@@ -0,0 +1,425 @@
+package gadget
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoUDC = errors.New("no USB device controller found")
+
+const (
+	// stringsLanguage is US English, the only language hosts ask for.
+	stringsLanguage = "0x409"
+	config          = "c.1"
+	// devicePollInterval and deviceTimeout bound the wait for udev to create
+	// the device node of a function.
+	devicePollInterval = 50 * time.Millisecond
+	deviceTimeout      = 5 * time.Second
+)
+
+// Gadget is a USB composite device made of functions.
+type Gadget struct {
+	// Name is the directory of the gadget in configfs.
+	Name         string
+	VendorID     uint16
+	ProductID    uint16
+	DeviceBCD    uint16
+	Manufacturer string
+	Product      string
+	SerialNumber string
+	// MaxPower is the current drawn from the host in mA.
+	MaxPower int
+	// RemoteWakeup lets the gadget resume a suspended host.
+	RemoteWakeup bool
+	Functions    []Function
+}
+
+// Function is a gadget function configured through its configfs directory.
+type Function interface {
+	// Instance is the directory of the function, such as hid.keyboard.
+	Instance() string
+	configure(dir string) error
+}
+
+// HIDFunction is a HID device appearing as /dev/hidgN on the gadget side.
+type HIDFunction struct {
+	// Name makes the instance hid.<Name>.
+	Name         string
+	Protocol     uint8
+	Subclass     uint8
+	ReportLength int
+	Descriptor   []byte
+	// NoOutEndpoint makes the host send output and feature reports on the
+	// control endpoint, ignored by kernels without the attribute.
+	NoOutEndpoint bool
+}
+
+func (f HIDFunction) Instance() string {
+	return "hid." + f.Name
+}
+
+func (f HIDFunction) configure(dir string) error {
+	if err := writeAttributes(dir,
+		"protocol", strconv.Itoa(int(f.Protocol)),
+		"subclass", strconv.Itoa(int(f.Subclass)),
+		"report_length", strconv.Itoa(f.ReportLength),
+	); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "report_desc"), f.Descriptor, 0644); err != nil {
+		return fmt.Errorf("failed to write report descriptor: %w", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "no_out_endpoint")); err == nil {
+		return writeAttributes(dir, "no_out_endpoint", boolAttribute(f.NoOutEndpoint))
+	} else if f.NoOutEndpoint {
+		log.Warn().Str("function", f.Instance()).Msg("kernel has no no_out_endpoint, feature reports may not reach the gadget")
+	}
+
+	return nil
+}
+
+// Manager builds gadgets in configfs. Its paths are relative to a root
+// directory, which is / on a device and a temporary directory in tests.
+type Manager struct {
+	// gadgets is the usb_gadget directory of configfs
+	gadgets string
+	// udcs lists the USB device controllers
+	udcs string
+	// charDevices resolves the device numbers of functions
+	charDevices string
+	devices     string
+	machineID   string
+}
+
+func NewManager(root string) *Manager {
+	return &Manager{
+		gadgets:     filepath.Join(root, "sys/kernel/config/usb_gadget"),
+		udcs:        filepath.Join(root, "sys/class/udc"),
+		charDevices: filepath.Join(root, "sys/dev/char"),
+		devices:     filepath.Join(root, "dev"),
+		machineID:   filepath.Join(root, "etc/machine-id"),
+	}
+}
+
+// Apply creates the gadget or updates an existing one to match g, then binds
+// it to udc, or to the first controller when udc is empty. The host sees the
+// device re-enumerate.
+func (m *Manager) Apply(g Gadget, udc string) error {
+	dir := filepath.Join(m.gadgets, g.Name)
+	if _, err := os.Stat(dir); err == nil {
+		// functions can only change while the gadget is unbound and
+		// unlinked from its configuration
+		if err := m.unbind(dir); err != nil {
+			return err
+		}
+
+		if err := m.unlinkFunctions(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "strings", stringsLanguage), 0755); err != nil {
+		return fmt.Errorf("failed to create gadget %s: %w", g.Name, err)
+	}
+
+	if err := writeAttributes(dir,
+		"idVendor", fmt.Sprintf("0x%04x", g.VendorID),
+		"idProduct", fmt.Sprintf("0x%04x", g.ProductID),
+		"bcdDevice", fmt.Sprintf("0x%04x", g.DeviceBCD),
+		"bcdUSB", "0x0200",
+		"strings/"+stringsLanguage+"/manufacturer", g.Manufacturer,
+		"strings/"+stringsLanguage+"/product", g.Product,
+		"strings/"+stringsLanguage+"/serialnumber", g.SerialNumber,
+	); err != nil {
+		return fmt.Errorf("failed to configure gadget %s: %w", g.Name, err)
+	}
+
+	configDir := filepath.Join(dir, "configs", config)
+	if err := os.MkdirAll(filepath.Join(configDir, "strings", stringsLanguage), 0755); err != nil {
+		return fmt.Errorf("failed to create configuration: %w", err)
+	}
+
+	// bus powered, with remote wakeup when asked for
+	attributes := 0x80
+	if g.RemoteWakeup {
+		attributes |= 0x20
+	}
+
+	if err := writeAttributes(configDir,
+		"strings/"+stringsLanguage+"/configuration", "Config 1",
+		"MaxPower", strconv.Itoa(g.MaxPower),
+		"bmAttributes", fmt.Sprintf("0x%02x", attributes),
+	); err != nil {
+		return fmt.Errorf("failed to configure configuration: %w", err)
+	}
+
+	if err := m.removeStaleFunctions(dir, g.Functions); err != nil {
+		return err
+	}
+
+	for _, function := range g.Functions {
+		functionDir := filepath.Join(dir, "functions", function.Instance())
+		if err := os.MkdirAll(functionDir, 0755); err != nil {
+			return fmt.Errorf("failed to create function %s: %w", function.Instance(), err)
+		}
+
+		if err := function.configure(functionDir); err != nil {
+			return fmt.Errorf("failed to configure function %s: %w", function.Instance(), err)
+		}
+
+		if err := os.Symlink(functionDir, filepath.Join(configDir, function.Instance())); err != nil {
+			return fmt.Errorf("failed to link function %s: %w", function.Instance(), err)
+		}
+	}
+
+	return m.bind(dir, udc)
+}
+
+// Remove unbinds the gadget and deletes it from configfs.
+func (m *Manager) Remove(name string) error {
+	dir := filepath.Join(m.gadgets, name)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err := m.unbind(dir); err != nil {
+		return err
+	}
+
+	if err := m.unlinkFunctions(dir); err != nil {
+		return err
+	}
+
+	if err := m.removeStaleFunctions(dir, nil); err != nil {
+		return err
+	}
+
+	// configfs only removes directories from the leaves up
+	for _, path := range []string{
+		filepath.Join(dir, "configs", config, "strings", stringsLanguage),
+		filepath.Join(dir, "configs", config),
+		filepath.Join(dir, "strings", stringsLanguage),
+		dir,
+	} {
+		if err := removeDir(path); err != nil {
+			return fmt.Errorf("failed to remove gadget %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Rebind unbinds the gadget and binds it again, which the host sees as the
+// device being unplugged and plugged back in.
+func (m *Manager) Rebind(name, udc string) error {
+	dir := filepath.Join(m.gadgets, name)
+	if err := m.unbind(dir); err != nil {
+		return err
+	}
+
+	return m.bind(dir, udc)
+}
+
+// UDCs lists the USB device controllers gadgets can be bound to.
+func (m *Manager) UDCs() ([]string, error) {
+	entries, err := os.ReadDir(m.udcs)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list device controllers: %w", err)
+	}
+
+	udcs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		udcs = append(udcs, entry.Name())
+	}
+
+	return udcs, nil
+}
+
+// BoundUDC returns the controller the gadget is bound to, empty when unbound.
+func (m *Manager) BoundUDC(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(m.gadgets, name, "UDC"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read controller of gadget %s: %w", name, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// DevicePath returns the device node of a function, such as /dev/hidg0,
+// waiting for udev to create it.
+func (m *Manager) DevicePath(name string, function Function) (string, error) {
+	data, err := os.ReadFile(filepath.Join(m.gadgets, name, "functions", function.Instance(), "dev"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read device number of %s: %w", function.Instance(), err)
+	}
+
+	dev := strings.TrimSpace(string(data))
+	uevent, err := os.ReadFile(filepath.Join(m.charDevices, dev, "uevent"))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve device %s of %s: %w", dev, function.Instance(), err)
+	}
+
+	var devName string
+	for line := range strings.Lines(string(uevent)) {
+		if value, found := strings.CutPrefix(strings.TrimSpace(line), "DEVNAME="); found {
+			devName = value
+		}
+	}
+
+	if devName == "" {
+		return "", fmt.Errorf("device %s of %s has no name", dev, function.Instance())
+	}
+
+	path := filepath.Join(m.devices, devName)
+	deadline := time.Now().Add(deviceTimeout)
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+
+		if !errors.Is(err, os.ErrNotExist) || time.Now().After(deadline) {
+			return "", fmt.Errorf("device node of %s is missing: %w", function.Instance(), err)
+		}
+
+		time.Sleep(devicePollInterval)
+	}
+}
+
+// MachineSerial derives a serial number which is stable for this machine
+// without revealing its machine id.
+func (m *Manager) MachineSerial() (string, error) {
+	id, err := os.ReadFile(m.machineID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read machine id: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(strings.TrimSpace(string(id))))
+	mac.Write([]byte("mini-kvm usb gadget"))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil))[:16]), nil
+}
+
+func (m *Manager) bind(dir, udc string) error {
+	if udc == "" {
+		udcs, err := m.UDCs()
+		if err != nil {
+			return err
+		}
+
+		if len(udcs) == 0 {
+			return ErrNoUDC
+		}
+
+		udc = udcs[0]
+	}
+
+	if err := writeAttributes(dir, "UDC", udc); err != nil {
+		return fmt.Errorf("failed to bind to %s: %w", udc, err)
+	}
+
+	log.Info().Str("gadget", filepath.Base(dir)).Str("udc", udc).Msg("usb gadget bound")
+	return nil
+}
+
+func (m *Manager) unbind(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "UDC"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read controller: %w", err)
+	}
+
+	if strings.TrimSpace(string(data)) == "" {
+		return nil
+	}
+
+	if err := writeAttributes(dir, "UDC", ""); err != nil {
+		return fmt.Errorf("failed to unbind: %w", err)
+	}
+
+	return nil
+}
+
+// unlinkFunctions removes every function from the configurations.
+func (m *Manager) unlinkFunctions(dir string) error {
+	links, err := filepath.Glob(filepath.Join(dir, "configs", "*", "*.*"))
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if err := os.Remove(link); err != nil {
+			return fmt.Errorf("failed to unlink function %s: %w", filepath.Base(link), err)
+		}
+	}
+
+	return nil
+}
+
+// removeStaleFunctions deletes the functions not in keep. They must be
+// unlinked already.
+func (m *Manager) removeStaleFunctions(dir string, keep []Function) error {
+	entries, err := os.ReadDir(filepath.Join(dir, "functions"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to list functions: %w", err)
+	}
+
+	for _, entry := range entries {
+		if slices.ContainsFunc(keep, func(f Function) bool { return f.Instance() == entry.Name() }) {
+			continue
+		}
+
+		if err := removeDir(filepath.Join(dir, "functions", entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove function %s: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// removeDir removes a configfs directory. configfs drops the attributes of a
+// directory with it, RemoveAll also deletes the plain files standing in for
+// them in tests.
+func removeDir(path string) error {
+	if err := os.Remove(path); err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return os.RemoveAll(path)
+}
+
+// writeAttributes writes pairs of attribute paths relative to dir and values.
+func writeAttributes(dir string, pairs ...string) error {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if err := os.WriteFile(filepath.Join(dir, pairs[i]), []byte(pairs[i+1]+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func boolAttribute(b bool) string {
+	if b {
+		return "1"
+	}
+
+	return "0"
+}
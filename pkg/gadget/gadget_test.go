@@ -0,0 +1,174 @@
+package gadget
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testUDC = "dummy_udc.0"
+
+// newTestManager returns a manager below a temporary root with one device
+// controller.
+func newTestManager(t *testing.T) (*Manager, string) {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sys/class/udc", testUDC), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewManager(root), filepath.Join(root, "sys/kernel/config/usb_gadget")
+}
+
+func testGadget(functions ...Function) Gadget {
+	return Gadget{
+		Name:         "mkvm",
+		VendorID:     0x1d6b,
+		ProductID:    0x0104,
+		DeviceBCD:    0x0100,
+		Manufacturer: "mini-kvm",
+		Product:      "KVM",
+		SerialNumber: "0123",
+		MaxPower:     250,
+		RemoteWakeup: true,
+		Functions:    functions,
+	}
+}
+
+var (
+	testKeyboard = HIDFunction{Name: "keyboard", Protocol: 1, Subclass: 1, ReportLength: 8, Descriptor: []byte{0x05, 0x01, 0x09, 0x06}}
+	testMouse    = HIDFunction{Name: "mouse", ReportLength: 8, Descriptor: []byte{0x05, 0x01, 0x09, 0x02}}
+	testStorage  = MassStorageFunction{Name: "media"}
+)
+
+func assertAttribute(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimSuffix(string(data), "\n"); got != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+}
+
+func assertMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s exists: %v", path, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	manager, gadgets := newTestManager(t)
+	if err := manager.Apply(testGadget(testKeyboard, testMouse, testStorage), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(gadgets, "mkvm")
+	for attribute, want := range map[string]string{
+		"idVendor":                                     "0x1d6b",
+		"idProduct":                                    "0x0104",
+		"bcdDevice":                                    "0x0100",
+		"bcdUSB":                                       "0x0200",
+		"strings/0x409/manufacturer":                   "mini-kvm",
+		"strings/0x409/product":                        "KVM",
+		"strings/0x409/serialnumber":                   "0123",
+		"configs/c.1/MaxPower":                         "250",
+		"configs/c.1/bmAttributes":                     "0xa0",
+		"functions/hid.keyboard/protocol":              "1",
+		"functions/hid.keyboard/subclass":              "1",
+		"functions/hid.keyboard/report_length":         "8",
+		"functions/hid.mouse/protocol":                 "0",
+		"functions/mass_storage.media/lun.0/removable": "1",
+		"UDC": testUDC,
+	} {
+		assertAttribute(t, filepath.Join(dir, attribute), want)
+	}
+
+	descriptor, err := os.ReadFile(filepath.Join(dir, "functions/hid.keyboard/report_desc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(descriptor, testKeyboard.Descriptor) {
+		t.Errorf("report_desc = % x, want % x", descriptor, testKeyboard.Descriptor)
+	}
+
+	for _, function := range []Function{testKeyboard, testMouse, testStorage} {
+		target, err := os.Readlink(filepath.Join(dir, "configs/c.1", function.Instance()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := filepath.Join(dir, "functions", function.Instance()); target != want {
+			t.Errorf("%s links to %s, want %s", function.Instance(), target, want)
+		}
+	}
+
+	if udc, err := manager.BoundUDC("mkvm"); err != nil || udc != testUDC {
+		t.Errorf("BoundUDC = %q, %v, want %q", udc, err, testUDC)
+	}
+}
+
+func TestApplyRemovesStaleFunctions(t *testing.T) {
+	manager, gadgets := newTestManager(t)
+	if err := manager.Apply(testGadget(testKeyboard, testMouse), testUDC); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.Apply(testGadget(testKeyboard), testUDC); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(gadgets, "mkvm")
+	assertMissing(t, filepath.Join(dir, "configs/c.1/hid.mouse"))
+	assertMissing(t, filepath.Join(dir, "functions/hid.mouse"))
+	if _, err := os.Readlink(filepath.Join(dir, "configs/c.1/hid.keyboard")); err != nil {
+		t.Error(err)
+	}
+
+	assertAttribute(t, filepath.Join(dir, "UDC"), testUDC)
+}
+
+func TestApplyWithoutUDC(t *testing.T) {
+	manager := NewManager(t.TempDir())
+	if err := manager.Apply(testGadget(testKeyboard), ""); !errors.Is(err, ErrNoUDC) {
+		t.Fatalf("Apply = %v, want %v", err, ErrNoUDC)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	manager, gadgets := newTestManager(t)
+	if err := manager.Apply(testGadget(testKeyboard, testStorage), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.Remove("mkvm"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertMissing(t, filepath.Join(gadgets, "mkvm"))
+
+	// removing a missing gadget is not an error
+	if err := manager.Remove("mkvm"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	manager, gadgets := newTestManager(t)
+	if err := manager.Apply(testGadget(testKeyboard), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.Rebind("mkvm", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	assertAttribute(t, filepath.Join(gadgets, "mkvm/UDC"), testUDC)
+}
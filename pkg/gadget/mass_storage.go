@@ -0,0 +1,95 @@
+package gadget
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// lun is the only logical unit of a mass storage function.
+const lun = "lun.0"
+
+// MassStorageFunction is a removable USB drive. Its medium can be changed
+// while the gadget is bound, like a disc in a drive.
+type MassStorageFunction struct {
+	// Name makes the instance mass_storage.<Name>.
+	Name string
+}
+
+func (f MassStorageFunction) Instance() string {
+	return "mass_storage." + f.Name
+}
+
+func (f MassStorageFunction) configure(dir string) error {
+	// configfs creates the first logical unit along with the function
+	if err := os.MkdirAll(filepath.Join(dir, lun), 0755); err != nil {
+		return fmt.Errorf("failed to create logical unit: %w", err)
+	}
+
+	return writeAttributes(filepath.Join(dir, lun), "removable", "1")
+}
+
+// Medium is an image file presented by a mass storage function.
+type Medium struct {
+	Path string
+	// CDROM presents the image as an optical disc, which is always read-only.
+	CDROM    bool
+	ReadOnly bool
+}
+
+// Insert ejects the current medium of the function and inserts medium. The
+// host sees the medium change.
+func (m *Manager) Insert(name string, function MassStorageFunction, medium Medium) error {
+	dir := filepath.Join(m.gadgets, name, "functions", function.Instance(), lun)
+	if err := m.Eject(name, function); err != nil {
+		return err
+	}
+
+	// the kernel refuses to change ro and cdrom while a medium is inserted
+	if err := writeAttributes(dir,
+		"cdrom", boolAttribute(medium.CDROM),
+		"ro", boolAttribute(medium.ReadOnly || medium.CDROM),
+		"file", medium.Path,
+	); err != nil {
+		return fmt.Errorf("failed to insert %s into %s: %w", medium.Path, function.Instance(), err)
+	}
+
+	return nil
+}
+
+// Eject removes the medium of the function, even when the host prevents
+// medium removal.
+func (m *Manager) Eject(name string, function MassStorageFunction) error {
+	dir := filepath.Join(m.gadgets, name, "functions", function.Instance(), lun)
+	path, err := m.insertedPath(name, function)
+	if err != nil || path == "" {
+		return err
+	}
+
+	// writing an empty file fails while the host locks the medium
+	attribute, value := "file", ""
+	if _, err := os.Stat(filepath.Join(dir, "forced_eject")); err == nil {
+		attribute, value = "forced_eject", "1"
+	}
+
+	if err := writeAttributes(dir, attribute, value); err != nil {
+		return fmt.Errorf("failed to eject %s from %s: %w", path, function.Instance(), err)
+	}
+
+	return nil
+}
+
+// insertedPath returns the image file of the function, empty without a
+// medium.
+func (m *Manager) insertedPath(name string, function MassStorageFunction) (string, error) {
+	data, err := os.ReadFile(filepath.Join(m.gadgets, name, "functions", function.Instance(), lun, "file"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read medium of %s: %w", function.Instance(), err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
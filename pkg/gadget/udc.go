@@ -0,0 +1,72 @@
+package gadget
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotBound = errors.New("usb gadget is not bound to a device controller")
+
+// State is the connection of a device controller to the host, as the kernel
+// names it in /sys/class/udc/<udc>/state.
+type State string
+
+const (
+	StateNotAttached State = "not attached"
+	StateConfigured  State = "configured"
+	// StateSuspended is a host asleep or a port put to sleep, it only
+	// resumes on its own or through remote wakeup.
+	StateSuspended State = "suspended"
+)
+
+// State returns the connection of the gadget to the host,
+// StateNotAttached while it is unbound.
+func (m *Manager) State(name string) (State, error) {
+	udc, err := m.BoundUDC(name)
+	if err != nil || udc == "" {
+		return StateNotAttached, err
+	}
+
+	return m.UDCState(udc)
+}
+
+// UDCState returns the connection of a device controller to the host,
+// whichever gadget is bound to it. Controllers also report the enumeration
+// steps in between, such as "powered" or "addressed".
+func (m *Manager) UDCState(udc string) (State, error) {
+	data, err := os.ReadFile(filepath.Join(m.udcs, udc, "state"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read state of %s: %w", udc, err)
+	}
+
+	return State(strings.TrimSpace(string(data))), nil
+}
+
+// Wakeup signals remote wakeup to the suspended host of the gadget.
+func (m *Manager) Wakeup(name string) error {
+	udc, err := m.BoundUDC(name)
+	if err != nil {
+		return err
+	}
+
+	if udc == "" {
+		return ErrNotBound
+	}
+
+	return m.WakeupUDC(udc)
+}
+
+// WakeupUDC signals remote wakeup to the suspended host of a device
+// controller. The host ignores it unless it enabled remote wakeup for the
+// device, and the kernel does not tell whether it did.
+func (m *Manager) WakeupUDC(udc string) error {
+	// srp starts a session on OTG ports and wakes the host otherwise
+	if err := writeAttributes(filepath.Join(m.udcs, udc), "srp", "1"); err != nil {
+		return fmt.Errorf("failed to wake up the host of %s: %w", udc, err)
+	}
+
+	return nil
+}
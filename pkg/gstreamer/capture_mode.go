@@ -1,5 +1,7 @@
 package gstreamer
 
+import "fmt"
+
 type VideoCaptureMode uint8
 
 const (
@@ -8,6 +10,34 @@ const (
 	VideoCaptureModeXRAW
 )
 
+func (m VideoCaptureMode) String() string {
+	switch m {
+	case VideoCaptureModeMJPEG:
+		return "mjpeg"
+	case VideoCaptureModeXRAW:
+		return "x-raw"
+	default:
+		return "unknown"
+	}
+}
+
+func (m VideoCaptureMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *VideoCaptureMode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "mjpeg":
+		*m = VideoCaptureModeMJPEG
+	case "x-raw":
+		*m = VideoCaptureModeXRAW
+	default:
+		return fmt.Errorf("unknown video capture mode %q", text)
+	}
+
+	return nil
+}
+
 type AudioCaptureMode uint8
 
 const (
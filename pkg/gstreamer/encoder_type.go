@@ -1,5 +1,10 @@
 package gstreamer
 
+import (
+	"fmt"
+	"strings"
+)
+
 type EncoderType uint8
 
 const (
@@ -18,3 +23,20 @@ func (t EncoderType) String() string {
 		panic("unknown encoder type")
 	}
 }
+
+func (t EncoderType) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(t.String())), nil
+}
+
+func (t *EncoderType) UnmarshalText(text []byte) error {
+	switch strings.ToUpper(string(text)) {
+	case "HEVC_MPP":
+		*t = EncoderTypeHEVC_MPP
+	case "OPUS":
+		*t = EncoderTypeOPUS
+	default:
+		return fmt.Errorf("unknown encoder type %q", text)
+	}
+
+	return nil
+}
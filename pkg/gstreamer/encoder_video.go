@@ -3,6 +3,7 @@ package gstreamer
 import "C"
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime"
 	"strings"
@@ -52,6 +53,7 @@ type VideoEncoder struct {
 	outputChan      chan *media.Sample
 	framesTillReset int
 
+	bitrate            atomic.Int64
 	producedFirstFrame atomic.Bool
 	isStopping         atomic.Bool
 	isRunning          atomic.Bool
@@ -127,7 +129,7 @@ func NewVideoEncoder(settings VideoEncoderSettings, captureSettings VideoCapture
 		encoderElement = element
 	}
 
-	return &VideoEncoder{
+	encoder := &VideoEncoder{
 		logger:          log.With().Str("encoderType", "video").Str("encoderName", settings.Name).Logger(),
 		encoderSettings: settings,
 		captureSettings: captureSettings,
@@ -138,7 +140,9 @@ func NewVideoEncoder(settings VideoEncoderSettings, captureSettings VideoCapture
 		inputChan:       inputChan,
 		outputChan:      outputChan,
 		framesTillReset: 14000,
-	}, nil
+	}
+	encoder.bitrate.Store(settings.Bitrate)
+	return encoder, nil
 }
 
 func (e *VideoEncoder) RequestKeyframe() error {
@@ -150,12 +154,31 @@ func (e *VideoEncoder) RequestKeyframe() error {
 
 	pad := e.encoderElement.GetStaticPad("src")
 	if !pad.SendEvent(newKeyFrameEvent()) {
-		panic("failed to send kf event")
+		return errors.New("failed to send keyframe event")
+	}
+
+	return nil
+}
+
+// SetBitrate changes the target bitrate of the running encoder.
+func (e *VideoEncoder) SetBitrate(bitrate int64) error {
+	if e.encoderElement == nil {
+		return errors.New("encoder does not support bitrate changes")
+	}
+
+	if err := e.encoderElement.SetProperty("bps", uint(bitrate)); err != nil {
+		return fmt.Errorf("failed to set bitrate: %w", err)
 	}
 
+	e.bitrate.Store(bitrate)
+	e.logger.Info().Int64("bitrate", bitrate).Msg("bitrate changed")
 	return nil
 }
 
+func (e *VideoEncoder) Bitrate() int64 {
+	return e.bitrate.Load()
+}
+
 func (e *VideoEncoder) Stop() {
 	if e.isStopping.Swap(true) {
 		return
@@ -0,0 +1,276 @@
+package hid
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// ItemType is the type of a short item.
+type ItemType uint8
+
+const (
+	ItemMain   ItemType = 0
+	ItemGlobal ItemType = 1
+	ItemLocal  ItemType = 2
+)
+
+// Tags of the main items.
+const (
+	TagInput         uint8 = 0x8
+	TagOutput        uint8 = 0x9
+	TagCollection    uint8 = 0xa
+	TagFeature       uint8 = 0xb
+	TagEndCollection uint8 = 0xc
+)
+
+// Tags of the global items.
+const (
+	TagUsagePage       uint8 = 0x0
+	TagLogicalMinimum  uint8 = 0x1
+	TagLogicalMaximum  uint8 = 0x2
+	TagPhysicalMinimum uint8 = 0x3
+	TagPhysicalMaximum uint8 = 0x4
+	TagUnitExponent    uint8 = 0x5
+	TagUnit            uint8 = 0x6
+	TagReportSize      uint8 = 0x7
+	TagReportID        uint8 = 0x8
+	TagReportCount     uint8 = 0x9
+	TagPush            uint8 = 0xa
+	TagPop             uint8 = 0xb
+)
+
+// Tags of the local items.
+const (
+	TagUsage        uint8 = 0x0
+	TagUsageMinimum uint8 = 0x1
+	TagUsageMaximum uint8 = 0x2
+)
+
+// Usage pages.
+const (
+	PageGenericDesktop uint16 = 0x01
+	PageKeyboard       uint16 = 0x07
+	PageLED            uint16 = 0x08
+	PageButton         uint16 = 0x09
+	PageConsumer       uint16 = 0x0c
+	PageDigitizer      uint16 = 0x0d
+)
+
+// Usages of the generic desktop page.
+const (
+	UsagePointer              uint16 = 0x01
+	UsageMouse                uint16 = 0x02
+	UsageKeyboard             uint16 = 0x06
+	UsageX                    uint16 = 0x30
+	UsageY                    uint16 = 0x31
+	UsageWheel                uint16 = 0x38
+	UsageResolutionMultiplier uint16 = 0x48
+	UsageSystemControl        uint16 = 0x80
+	UsageSystemPowerDown      uint16 = 0x81
+	UsageSystemWakeUp         uint16 = 0x83
+)
+
+// Usages of the keyboard and LED pages.
+const (
+	UsageKeyboardErrorRollOver uint16 = 0x01
+	UsageKeyboardLeftControl   uint16 = 0xe0
+	UsageKeyboardRightGUI      uint16 = 0xe7
+	UsageLEDNumLock            uint16 = 0x01
+	UsageLEDKana               uint16 = 0x05
+)
+
+// Usages of the consumer page.
+const (
+	UsageConsumerControl uint16 = 0x01
+	UsageACPan           uint16 = 0x238
+)
+
+// Usages of the digitizer page.
+const (
+	UsageTouchScreen         uint16 = 0x04
+	UsageFinger              uint16 = 0x22
+	UsageTipSwitch           uint16 = 0x42
+	UsageContactID           uint16 = 0x51
+	UsageContactCount        uint16 = 0x54
+	UsageContactCountMaximum uint16 = 0x55
+	UsageScanTime            uint16 = 0x56
+)
+
+// CollectionKind is the data of a collection item.
+type CollectionKind uint8
+
+const (
+	CollectionPhysical    CollectionKind = 0x00
+	CollectionApplication CollectionKind = 0x01
+	CollectionLogical     CollectionKind = 0x02
+)
+
+// Flags are the data of input, output and feature items. The zero value is
+// a data array of absolute values.
+type Flags uint32
+
+const (
+	Constant    Flags = 1 << 0
+	Variable    Flags = 1 << 1
+	Relative    Flags = 1 << 2
+	Wrap        Flags = 1 << 3
+	NonLinear   Flags = 1 << 4
+	NoPreferred Flags = 1 << 5
+	NullState   Flags = 1 << 6
+	Volatile    Flags = 1 << 7
+)
+
+// Item is a short item of a report descriptor.
+type Item struct {
+	Type ItemType
+	Tag  uint8
+	// Data is little endian, 0, 1, 2 or 4 bytes long.
+	Data []byte
+}
+
+// Value returns the data as an unsigned number.
+func (i Item) Value() uint32 {
+	var buf [4]byte
+	copy(buf[:], i.Data)
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+// SignedValue returns the data as a two's complement number.
+func (i Item) SignedValue() int32 {
+	switch len(i.Data) {
+	case 1:
+		return int32(int8(i.Data[0]))
+	case 2:
+		return int32(int16(binary.LittleEndian.Uint16(i.Data)))
+	case 4:
+		return int32(binary.LittleEndian.Uint32(i.Data))
+	default:
+		return 0
+	}
+}
+
+// AppendTo appends the encoded item to b.
+func (i Item) AppendTo(b []byte) []byte {
+	size := byte(len(i.Data))
+	if size == 4 {
+		size = 3
+	}
+
+	b = append(b, i.Tag<<4|byte(i.Type)<<2|size)
+	return append(b, i.Data...)
+}
+
+// Descriptor encodes items into a report descriptor.
+func Descriptor(items ...Item) []byte {
+	var b []byte
+	for _, item := range items {
+		b = item.AppendTo(b)
+	}
+
+	return b
+}
+
+func unsignedItem(t ItemType, tag uint8, v uint32) Item {
+	switch {
+	case v <= math.MaxUint8:
+		return Item{Type: t, Tag: tag, Data: []byte{byte(v)}}
+	case v <= math.MaxUint16:
+		return Item{Type: t, Tag: tag, Data: binary.LittleEndian.AppendUint16(nil, uint16(v))}
+	default:
+		return Item{Type: t, Tag: tag, Data: binary.LittleEndian.AppendUint32(nil, v)}
+	}
+}
+
+func signedItem(t ItemType, tag uint8, v int32) Item {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return Item{Type: t, Tag: tag, Data: []byte{byte(v)}}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return Item{Type: t, Tag: tag, Data: binary.LittleEndian.AppendUint16(nil, uint16(v))}
+	default:
+		return Item{Type: t, Tag: tag, Data: binary.LittleEndian.AppendUint32(nil, uint32(v))}
+	}
+}
+
+func UsagePage(page uint16) Item {
+	return unsignedItem(ItemGlobal, TagUsagePage, uint32(page))
+}
+
+func LogicalMinimum(v int32) Item {
+	return signedItem(ItemGlobal, TagLogicalMinimum, v)
+}
+
+func LogicalMaximum(v int32) Item {
+	return signedItem(ItemGlobal, TagLogicalMaximum, v)
+}
+
+func PhysicalMinimum(v int32) Item {
+	return signedItem(ItemGlobal, TagPhysicalMinimum, v)
+}
+
+func PhysicalMaximum(v int32) Item {
+	return signedItem(ItemGlobal, TagPhysicalMaximum, v)
+}
+
+func UnitExponent(v int32) Item {
+	return signedItem(ItemGlobal, TagUnitExponent, v)
+}
+
+func Unit(v uint32) Item {
+	return unsignedItem(ItemGlobal, TagUnit, v)
+}
+
+// ReportSize is the size of each field in bits.
+func ReportSize(bits int) Item {
+	return unsignedItem(ItemGlobal, TagReportSize, uint32(bits))
+}
+
+func ReportID(id uint8) Item {
+	return unsignedItem(ItemGlobal, TagReportID, uint32(id))
+}
+
+// ReportCount is the number of fields of the next main item.
+func ReportCount(n int) Item {
+	return unsignedItem(ItemGlobal, TagReportCount, uint32(n))
+}
+
+func Push() Item {
+	return Item{Type: ItemGlobal, Tag: TagPush}
+}
+
+func Pop() Item {
+	return Item{Type: ItemGlobal, Tag: TagPop}
+}
+
+// Usage is a usage of the current usage page.
+func Usage(usage uint16) Item {
+	return unsignedItem(ItemLocal, TagUsage, uint32(usage))
+}
+
+func UsageMinimum(usage uint16) Item {
+	return unsignedItem(ItemLocal, TagUsageMinimum, uint32(usage))
+}
+
+func UsageMaximum(usage uint16) Item {
+	return unsignedItem(ItemLocal, TagUsageMaximum, uint32(usage))
+}
+
+func Collection(kind CollectionKind) Item {
+	return Item{Type: ItemMain, Tag: TagCollection, Data: []byte{byte(kind)}}
+}
+
+func EndCollection() Item {
+	return Item{Type: ItemMain, Tag: TagEndCollection}
+}
+
+func Input(flags Flags) Item {
+	return unsignedItem(ItemMain, TagInput, uint32(flags))
+}
+
+func Output(flags Flags) Item {
+	return unsignedItem(ItemMain, TagOutput, uint32(flags))
+}
+
+func Feature(flags Flags) Item {
+	return unsignedItem(ItemMain, TagFeature, uint32(flags))
+}
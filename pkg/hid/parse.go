@@ -0,0 +1,428 @@
+package hid
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrTruncated          = errors.New("descriptor ends within an item")
+	ErrLongItem           = errors.New("long items are not supported")
+	ErrUnbalanced         = errors.New("collections are not balanced")
+	ErrReportIDZero       = errors.New("report id 0 is reserved")
+	ErrMixedReportIDs     = errors.New("fields without report id next to reports with id")
+	ErrReportSizeMissing  = errors.New("main item without report size or count")
+	ErrPopWithoutPush     = errors.New("pop without push")
+	ErrUnknownReportField = errors.New("no such field in report")
+	ErrUsageRange         = errors.New("usage minimum above usage maximum")
+	ErrReportTooLong      = errors.New("report data longer than 65536 bits")
+)
+
+// maxArrayUsages bounds the usages of an array field, a whole usage page.
+const maxArrayUsages = 1 << 16
+
+// maxReportBits bounds the data of a report, so a field with a huge report
+// count cannot make Parse allocate its usages.
+const maxReportBits = 1 << 16
+
+// ReportKind is the main item a report is made of.
+type ReportKind uint8
+
+const (
+	KindInput   ReportKind = ReportKind(TagInput)
+	KindOutput  ReportKind = ReportKind(TagOutput)
+	KindFeature ReportKind = ReportKind(TagFeature)
+)
+
+func (k ReportKind) String() string {
+	switch k {
+	case KindInput:
+		return "input"
+	case KindOutput:
+		return "output"
+	case KindFeature:
+		return "feature"
+	default:
+		return "unknown"
+	}
+}
+
+// Field is one input, output or feature item: Count elements of Size bits
+// each, starting Offset bits after the report id.
+type Field struct {
+	Kind     ReportKind
+	ReportID uint8
+	Flags    Flags
+	Offset   int
+	Size     int
+	Count    int
+	// Usages are extended usages (page << 16 | id) of the elements of a
+	// variable field, or the usages an array field can report.
+	Usages         []uint32
+	LogicalMinimum int32
+	LogicalMaximum int32
+}
+
+// ExtendedUsage combines a usage page and a usage id.
+func ExtendedUsage(page, usage uint16) uint32 {
+	return uint32(page)<<16 | uint32(usage)
+}
+
+// Index returns the element of a variable field carrying usage.
+func (f Field) Index(usage uint32) (int, bool) {
+	if f.Flags&Variable == 0 {
+		return 0, false
+	}
+
+	i := slices.Index(f.Usages, usage)
+	return i, i >= 0 && i < f.Count
+}
+
+// Value returns the value an array field reports for usage: its position
+// among the usages offset by the logical minimum.
+func (f Field) Value(usage uint32) (int32, bool) {
+	if f.Flags&Variable != 0 {
+		return 0, false
+	}
+
+	i := slices.Index(f.Usages, usage)
+	return f.LogicalMinimum + int32(i), i >= 0
+}
+
+// Put stores v in element i of the field of report, which starts with the
+// report id when the field has one. Values are truncated to Size bits.
+func (f Field) Put(report []byte, i int, v int32) {
+	offset := f.Offset + i*f.Size
+	if f.ReportID != 0 {
+		offset += 8
+	}
+
+	for bit := 0; bit < f.Size; bit++ {
+		index, mask := (offset+bit)/8, byte(1)<<((offset+bit)%8)
+		if v>>bit&1 != 0 {
+			report[index] |= mask
+		} else {
+			report[index] &^= mask
+		}
+	}
+}
+
+// Get reads element i of the field of report, sign extended when the
+// logical minimum is negative.
+func (f Field) Get(report []byte, i int) int32 {
+	offset := f.Offset + i*f.Size
+	if f.ReportID != 0 {
+		offset += 8
+	}
+
+	var v int32
+	for bit := 0; bit < f.Size; bit++ {
+		if report[(offset+bit)/8]&(1<<((offset+bit)%8)) != 0 {
+			v |= 1 << bit
+		}
+	}
+
+	if f.LogicalMinimum < 0 && f.Size < 32 && v&(1<<(f.Size-1)) != 0 {
+		v -= 1 << f.Size
+	}
+
+	return v
+}
+
+// Report is the layout of a single report.
+type Report struct {
+	Kind   ReportKind
+	ID     uint8
+	Fields []Field
+	// bits is the size of the report data after the id
+	bits int
+}
+
+// Length is the size of the report in bytes, including the report id.
+func (r *Report) Length() int {
+	length := (r.bits + 7) / 8
+	if r.ID != 0 {
+		length++
+	}
+
+	return length
+}
+
+// New returns an empty report with its id set.
+func (r *Report) New() []byte {
+	report := make([]byte, r.Length())
+	if r.ID != 0 {
+		report[0] = r.ID
+	}
+
+	return report
+}
+
+// Usage returns the field and element carrying usage.
+func (r *Report) Usage(page, usage uint16) (Field, int, error) {
+	extended := ExtendedUsage(page, usage)
+	for _, field := range r.Fields {
+		if i, ok := field.Index(extended); ok {
+			return field, i, nil
+		}
+	}
+
+	return Field{}, 0, fmt.Errorf("%w: usage %#04x:%#04x in %s report %d", ErrUnknownReportField, page, usage, r.Kind, r.ID)
+}
+
+// Array returns the first array field reporting usages of page.
+func (r *Report) Array(page uint16) (Field, error) {
+	for _, field := range r.Fields {
+		if field.Flags&(Variable|Constant) == 0 && len(field.Usages) > 0 && uint16(field.Usages[0]>>16) == page {
+			return field, nil
+		}
+	}
+
+	return Field{}, fmt.Errorf("%w: array of page %#04x in %s report %d", ErrUnknownReportField, page, r.Kind, r.ID)
+}
+
+// Layout is the parsed structure of a report descriptor.
+type Layout struct {
+	Reports []*Report
+}
+
+// Report returns the report of kind with id, 0 for descriptors without
+// report ids.
+func (l *Layout) Report(kind ReportKind, id uint8) (*Report, bool) {
+	for _, report := range l.Reports {
+		if report.Kind == kind && report.ID == id {
+			return report, true
+		}
+	}
+
+	return nil, false
+}
+
+// MaxLength is the size in bytes of the longest report of kind.
+func (l *Layout) MaxLength(kind ReportKind) int {
+	length := 0
+	for _, report := range l.Reports {
+		if report.Kind == kind {
+			length = max(length, report.Length())
+		}
+	}
+
+	return length
+}
+
+// Usage finds the report, field and element carrying usage.
+func (l *Layout) Usage(kind ReportKind, page, usage uint16) (*Report, Field, int, error) {
+	for _, report := range l.Reports {
+		if report.Kind != kind {
+			continue
+		}
+
+		if field, i, err := report.Usage(page, usage); err == nil {
+			return report, field, i, nil
+		}
+	}
+
+	return nil, Field{}, 0, fmt.Errorf("%w: %s usage %#04x:%#04x", ErrUnknownReportField, kind, page, usage)
+}
+
+// Items splits a report descriptor into its items.
+func Items(descriptor []byte) ([]Item, error) {
+	var items []Item
+	for i := 0; i < len(descriptor); {
+		prefix := descriptor[i]
+		if prefix == 0xfe {
+			return nil, fmt.Errorf("%w at offset %d", ErrLongItem, i)
+		}
+
+		size := int(prefix & 0x03)
+		if size == 3 {
+			size = 4
+		}
+
+		if i+1+size > len(descriptor) {
+			return nil, fmt.Errorf("%w at offset %d", ErrTruncated, i)
+		}
+
+		items = append(items, Item{
+			Type: ItemType(prefix >> 2 & 0x03),
+			Tag:  prefix >> 4,
+			Data: descriptor[i+1 : i+1+size],
+		})
+		i += 1 + size
+	}
+
+	return items, nil
+}
+
+type globalState struct {
+	usagePage      uint16
+	logicalMinimum int32
+	logicalMaximum int32
+	reportSize     int
+	reportCount    int
+	reportID       uint8
+}
+
+// Parse lays out the input, output and feature reports of a descriptor.
+func Parse(descriptor []byte) (*Layout, error) {
+	items, err := Items(descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := &Layout{}
+	var (
+		global                 globalState
+		stack                  []globalState
+		usages                 []uint32
+		usageMinimum           uint32
+		usageMaximum           uint32
+		hasMinimum, hasMaximum bool
+		depth                  int
+		withID, withoutID      bool
+	)
+
+	// usages of 1 or 2 bytes are on the current page, 4 bytes carry their own
+	extend := func(item Item) uint32 {
+		if len(item.Data) == 4 {
+			return item.Value()
+		}
+
+		return ExtendedUsage(global.usagePage, uint16(item.Value()))
+	}
+
+	for _, item := range items {
+		switch item.Type {
+		case ItemGlobal:
+			switch item.Tag {
+			case TagUsagePage:
+				global.usagePage = uint16(item.Value())
+			case TagLogicalMinimum:
+				global.logicalMinimum = item.SignedValue()
+			case TagLogicalMaximum:
+				global.logicalMaximum = item.SignedValue()
+				// a maximum below the minimum only makes sense unsigned
+				if global.logicalMaximum < global.logicalMinimum {
+					global.logicalMaximum = int32(item.Value())
+				}
+			case TagReportSize:
+				global.reportSize = int(item.Value())
+			case TagReportCount:
+				global.reportCount = int(item.Value())
+			case TagReportID:
+				if item.Value() == 0 {
+					return nil, ErrReportIDZero
+				}
+
+				global.reportID = uint8(item.Value())
+			case TagPush:
+				stack = append(stack, global)
+			case TagPop:
+				if len(stack) == 0 {
+					return nil, ErrPopWithoutPush
+				}
+
+				global, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			}
+		case ItemLocal:
+			switch item.Tag {
+			case TagUsage:
+				usages = append(usages, extend(item))
+			case TagUsageMinimum:
+				usageMinimum, hasMinimum = extend(item), true
+			case TagUsageMaximum:
+				usageMaximum, hasMaximum = extend(item), true
+			}
+		case ItemMain:
+			switch item.Tag {
+			case TagCollection:
+				depth++
+			case TagEndCollection:
+				depth--
+				if depth < 0 {
+					return nil, ErrUnbalanced
+				}
+			case TagInput, TagOutput, TagFeature:
+				if global.reportSize == 0 || global.reportCount == 0 {
+					return nil, ErrReportSizeMissing
+				}
+
+				if global.reportID == 0 {
+					withoutID = true
+				} else {
+					withID = true
+				}
+
+				if withID && withoutID {
+					return nil, ErrMixedReportIDs
+				}
+
+				kind := ReportKind(item.Tag)
+				report, exists := layout.Report(kind, global.reportID)
+				if !exists {
+					report = &Report{Kind: kind, ID: global.reportID}
+				}
+
+				// both factors are checked first, their product could overflow
+				if global.reportSize > maxReportBits || global.reportCount > maxReportBits ||
+					report.bits+global.reportSize*global.reportCount > maxReportBits {
+					return nil, fmt.Errorf("%w: %s report %d", ErrReportTooLong, kind, global.reportID)
+				}
+
+				if !exists {
+					layout.Reports = append(layout.Reports, report)
+				}
+
+				flags := Flags(item.Value())
+				if hasMinimum && hasMaximum {
+					if usageMinimum > usageMaximum {
+						return nil, fmt.Errorf("%w: %#08x > %#08x", ErrUsageRange, usageMinimum, usageMaximum)
+					}
+
+					// a variable field only names as many usages as it has
+					// elements, an array as many as its logical range indexes
+					limit := int64(global.reportCount)
+					if flags&Variable == 0 {
+						limit = min(int64(global.logicalMaximum)-int64(global.logicalMinimum)+1, maxArrayUsages)
+					}
+
+					count := min(int64(usageMaximum)-int64(usageMinimum)+1, limit)
+					for i := range count {
+						usages = append(usages, usageMinimum+uint32(i))
+					}
+				}
+
+				field := Field{
+					Kind:           kind,
+					ReportID:       global.reportID,
+					Flags:          flags,
+					Offset:         report.bits,
+					Size:           global.reportSize,
+					Count:          global.reportCount,
+					Usages:         usages,
+					LogicalMinimum: global.logicalMinimum,
+					LogicalMaximum: global.logicalMaximum,
+				}
+
+				// the last usage repeats for the remaining elements
+				if field.Flags&Variable != 0 && len(usages) > 0 {
+					for len(field.Usages) < field.Count {
+						field.Usages = append(field.Usages, usages[len(usages)-1])
+					}
+				}
+
+				report.Fields = append(report.Fields, field)
+				report.bits += field.Size * field.Count
+			}
+
+			usages, hasMinimum, hasMaximum = nil, false, false
+		}
+	}
+
+	if depth != 0 {
+		return nil, ErrUnbalanced
+	}
+
+	return layout, nil
+}
@@ -0,0 +1,105 @@
+package hid
+
+import (
+	"errors"
+	"testing"
+)
+
+// usageItem is a usage with its page in 4 bytes, the only way to reach the
+// top of the extended usage range.
+func usageItem(tag uint8, usage uint32) Item {
+	return Item{Type: ItemLocal, Tag: tag, Data: []byte{byte(usage), byte(usage >> 8), byte(usage >> 16), byte(usage >> 24)}}
+}
+
+func TestParseUsageRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		minimum    uint32
+		maximum    uint32
+		flags      Flags
+		logicalMax int32
+		count      int
+		wantUsages int
+		wantLast   uint32
+	}{
+		{name: "variable", minimum: 0x90001, maximum: 0x90003, flags: Variable, logicalMax: 1, count: 3, wantUsages: 3, wantLast: 0x90003},
+		{name: "variable wider than count", minimum: 0x90001, maximum: 0x9ffff, flags: Variable, logicalMax: 1, count: 8, wantUsages: 8, wantLast: 0x90008},
+		{name: "up to the last usage", minimum: 0xfffffffe, maximum: 0xffffffff, flags: Variable, logicalMax: 1, count: 4, wantUsages: 4, wantLast: 0xffffffff},
+		{name: "array", minimum: 0x70000, maximum: 0x70065, logicalMax: 0x65, count: 6, wantUsages: 0x66, wantLast: 0x70065},
+		{name: "array wider than logical range", minimum: 0, maximum: 0xffffffff, logicalMax: 0x0f, count: 1, wantUsages: 0x10, wantLast: 0x0f},
+		{name: "array with unsigned logical maximum", minimum: 0, maximum: 0xffffffff, logicalMax: -1, count: 1, wantUsages: 0x100, wantLast: 0xff},
+		{name: "array beyond a usage page", minimum: 0, maximum: 0xffffffff, logicalMax: 0x7fffffff, count: 1, wantUsages: maxArrayUsages, wantLast: maxArrayUsages - 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := Parse(Descriptor(
+				usageItem(TagUsageMinimum, test.minimum),
+				usageItem(TagUsageMaximum, test.maximum),
+				LogicalMinimum(0),
+				LogicalMaximum(test.logicalMax),
+				ReportSize(8),
+				ReportCount(test.count),
+				Input(test.flags),
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			field := layout.Reports[0].Fields[0]
+			if len(field.Usages) != test.wantUsages {
+				t.Fatalf("%d usages, want %d", len(field.Usages), test.wantUsages)
+			}
+
+			if last := field.Usages[len(field.Usages)-1]; last != test.wantLast {
+				t.Errorf("last usage = %#08x, want %#08x", last, test.wantLast)
+			}
+		})
+	}
+}
+
+func TestParseReversedUsageRange(t *testing.T) {
+	_, err := Parse(Descriptor(
+		UsagePage(PageButton),
+		UsageMinimum(3),
+		UsageMaximum(1),
+		LogicalMinimum(0),
+		LogicalMaximum(1),
+		ReportSize(1),
+		ReportCount(3),
+		Input(Variable),
+	))
+	if !errors.Is(err, ErrUsageRange) {
+		t.Fatalf("Parse = %v, want %v", err, ErrUsageRange)
+	}
+}
+
+func TestParseReportTooLong(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []Item
+	}{
+		{name: "huge count", items: []Item{ReportSize(1), ReportCount(0x7fffffff), Input(Variable)}},
+		{name: "huge size", items: []Item{ReportSize(0x7fffffff), ReportCount(1), Input(Variable)}},
+		{name: "over the bound", items: []Item{ReportSize(8), ReportCount(maxReportBits/8 + 1), Input(Variable)}},
+		{name: "over the bound in total", items: []Item{ReportSize(8), ReportCount(maxReportBits / 8), Input(Variable), ReportCount(1), Input(Constant)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := append([]Item{UsagePage(PageButton), UsageMinimum(1), UsageMaximum(1), LogicalMinimum(0), LogicalMaximum(1)}, test.items...)
+			if _, err := Parse(Descriptor(items...)); !errors.Is(err, ErrReportTooLong) {
+				t.Fatalf("Parse = %v, want %v", err, ErrReportTooLong)
+			}
+		})
+	}
+
+	layout, err := Parse(Descriptor(UsagePage(PageButton), UsageMinimum(1), UsageMaximum(1), LogicalMinimum(0), LogicalMaximum(1), ReportSize(8), ReportCount(maxReportBits/8), Input(Variable)))
+	if err != nil {
+		t.Fatalf("report of exactly %d bits: %v", maxReportBits, err)
+	}
+
+	if got := len(layout.Reports[0].Fields[0].Usages); got != maxReportBits/8 {
+		t.Errorf("%d usages, want %d", got, maxReportBits/8)
+	}
+}
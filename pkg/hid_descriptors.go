@@ -0,0 +1,356 @@
+package pkg
+
+import (
+	"fmt"
+	"mini-kvm/pkg/hid"
+	"slices"
+)
+
+// bootKeyboardDescriptor is the 6KRO boot protocol keyboard: modifiers,
+// a reserved byte and six key usages, with the LED output report.
+var bootKeyboardDescriptor = hid.Descriptor(slices.Concat(
+	[]hid.Item{
+		hid.UsagePage(hid.PageGenericDesktop),
+		hid.Usage(hid.UsageKeyboard),
+		hid.Collection(hid.CollectionApplication),
+	},
+	keyboardModifierItems,
+	[]hid.Item{
+		hid.ReportCount(1),
+		hid.ReportSize(8),
+		hid.Input(hid.Constant | hid.Variable),
+	},
+	keyboardLEDItems,
+	[]hid.Item{
+		hid.ReportCount(bootReportKeys),
+		hid.ReportSize(8),
+		hid.LogicalMinimum(0),
+		hid.LogicalMaximum(0x65),
+		hid.UsagePage(hid.PageKeyboard),
+		hid.UsageMinimum(0),
+		hid.UsageMaximum(0x65),
+		hid.Input(0),
+		hid.EndCollection(),
+	},
+)...)
+
+// nkroKeyboardDescriptor is the modifier byte followed by a bitmap of the
+// usages 0x00-0x9f.
+var nkroKeyboardDescriptor = hid.Descriptor(slices.Concat(
+	[]hid.Item{
+		hid.UsagePage(hid.PageGenericDesktop),
+		hid.Usage(hid.UsageKeyboard),
+		hid.Collection(hid.CollectionApplication),
+	},
+	keyboardModifierItems,
+	keyboardLEDItems,
+	[]hid.Item{
+		hid.UsagePage(hid.PageKeyboard),
+		hid.UsageMinimum(0),
+		hid.UsageMaximum(nkroMaxUsage),
+		hid.LogicalMinimum(0),
+		hid.LogicalMaximum(1),
+		hid.ReportSize(1),
+		hid.ReportCount(nkroMaxUsage + 1),
+		hid.Input(hid.Variable),
+		hid.EndCollection(),
+	},
+)...)
+
+var keyboardModifierItems = []hid.Item{
+	hid.UsagePage(hid.PageKeyboard),
+	hid.UsageMinimum(hid.UsageKeyboardLeftControl),
+	hid.UsageMaximum(hid.UsageKeyboardRightGUI),
+	hid.LogicalMinimum(0),
+	hid.LogicalMaximum(1),
+	hid.ReportSize(1),
+	hid.ReportCount(8),
+	hid.Input(hid.Variable),
+}
+
+// keyboardLEDItems are the five lock LEDs padded to a byte.
+var keyboardLEDItems = []hid.Item{
+	hid.ReportCount(5),
+	hid.ReportSize(1),
+	hid.UsagePage(hid.PageLED),
+	hid.UsageMinimum(hid.UsageLEDNumLock),
+	hid.UsageMaximum(hid.UsageLEDKana),
+	hid.Output(hid.Variable),
+	hid.ReportCount(1),
+	hid.ReportSize(3),
+	hid.Output(hid.Constant | hid.Variable),
+}
+
+// pointerDescriptor returns the absolute pointer: buttons, X/Y 0-32767,
+// wheel and AC Pan in report 1, and their resolution multiplier as feature
+// report 2.
+func pointerDescriptor(wheelMultiplier int) []byte {
+	return hid.Descriptor(
+		hid.UsagePage(hid.PageDigitizer),
+		hid.Usage(hid.UsageTouchScreen),
+		hid.Collection(hid.CollectionApplication),
+		hid.ReportID(pointerReportId),
+		hid.UsagePage(hid.PageButton),
+		hid.UsageMinimum(1),
+		hid.UsageMaximum(3),
+		hid.LogicalMinimum(0),
+		hid.LogicalMaximum(1),
+		hid.ReportSize(1),
+		hid.ReportCount(3),
+		hid.Input(hid.Variable),
+		hid.ReportCount(5),
+		hid.Input(hid.Constant|hid.Variable),
+		hid.UsagePage(hid.PageGenericDesktop),
+		hid.Usage(hid.UsageX),
+		hid.Usage(hid.UsageY),
+		hid.LogicalMinimum(0),
+		hid.LogicalMaximum(hidAbsoluteMax),
+		hid.PhysicalMinimum(0),
+		hid.PhysicalMaximum(hidAbsoluteMax),
+		hid.Unit(0),
+		hid.ReportSize(16),
+		hid.ReportCount(2),
+		hid.Input(hid.Variable),
+		hid.Collection(hid.CollectionLogical),
+		hid.ReportID(pointerMultiplierReportId),
+		hid.Usage(hid.UsageResolutionMultiplier),
+		hid.LogicalMinimum(0),
+		hid.LogicalMaximum(1),
+		hid.PhysicalMinimum(1),
+		hid.PhysicalMaximum(int32(wheelMultiplier)),
+		hid.ReportSize(2),
+		hid.ReportCount(1),
+		hid.Feature(hid.Variable),
+		hid.ReportSize(6),
+		hid.Feature(hid.Constant|hid.Variable),
+		hid.ReportID(pointerReportId),
+		hid.Usage(hid.UsageWheel),
+		hid.LogicalMinimum(-127),
+		hid.LogicalMaximum(127),
+		hid.PhysicalMinimum(0),
+		hid.PhysicalMaximum(0),
+		hid.ReportSize(8),
+		hid.ReportCount(1),
+		hid.Input(hid.Variable|hid.Relative),
+		hid.UsagePage(hid.PageConsumer),
+		hid.Usage(hid.UsageACPan),
+		hid.Input(hid.Variable|hid.Relative),
+		hid.EndCollection(),
+		hid.EndCollection(),
+	)
+}
+
+// consumerDescriptor is consumer control (report 1, media keys) and system
+// control (report 2, power down/sleep/wake up).
+var consumerDescriptor = hid.Descriptor(
+	hid.UsagePage(hid.PageConsumer),
+	hid.Usage(hid.UsageConsumerControl),
+	hid.Collection(hid.CollectionApplication),
+	hid.ReportID(consumerReportId),
+	hid.LogicalMinimum(0),
+	hid.LogicalMaximum(0x3ff),
+	hid.UsageMinimum(0),
+	hid.UsageMaximum(0x3ff),
+	hid.ReportSize(16),
+	hid.ReportCount(1),
+	hid.Input(0),
+	hid.EndCollection(),
+	hid.UsagePage(hid.PageGenericDesktop),
+	hid.Usage(hid.UsageSystemControl),
+	hid.Collection(hid.CollectionApplication),
+	hid.ReportID(systemReportId),
+	hid.UsageMinimum(hid.UsageSystemPowerDown),
+	hid.UsageMaximum(hid.UsageSystemWakeUp),
+	hid.LogicalMinimum(1),
+	hid.LogicalMaximum(3),
+	hid.ReportSize(2),
+	hid.ReportCount(1),
+	hid.Input(0),
+	hid.ReportSize(6),
+	hid.Input(hid.Constant|hid.Variable),
+	hid.EndCollection(),
+)
+
+// bootMouseDescriptor is the relative boot mouse: 3 buttons, X/Y deltas and
+// wheel.
+var bootMouseDescriptor = hid.Descriptor(
+	hid.UsagePage(hid.PageGenericDesktop),
+	hid.Usage(hid.UsageMouse),
+	hid.Collection(hid.CollectionApplication),
+	hid.Usage(hid.UsagePointer),
+	hid.Collection(hid.CollectionPhysical),
+	hid.UsagePage(hid.PageButton),
+	hid.UsageMinimum(1),
+	hid.UsageMaximum(3),
+	hid.LogicalMinimum(0),
+	hid.LogicalMaximum(1),
+	hid.ReportCount(3),
+	hid.ReportSize(1),
+	hid.Input(hid.Variable),
+	hid.ReportCount(1),
+	hid.ReportSize(5),
+	hid.Input(hid.Constant|hid.Variable),
+	hid.UsagePage(hid.PageGenericDesktop),
+	hid.Usage(hid.UsageX),
+	hid.Usage(hid.UsageY),
+	hid.Usage(hid.UsageWheel),
+	hid.LogicalMinimum(-127),
+	hid.LogicalMaximum(127),
+	hid.ReportSize(8),
+	hid.ReportCount(3),
+	hid.Input(hid.Variable|hid.Relative),
+	hid.EndCollection(),
+	hid.EndCollection(),
+)
+
+// touchDescriptor is the multi-touch digitizer: maxTouchContacts fingers,
+// contact count and scan time in report 1, and the contact count maximum as
+// feature report 2.
+var touchDescriptor = func() []byte {
+	items := []hid.Item{
+		hid.UsagePage(hid.PageDigitizer),
+		hid.Usage(hid.UsageTouchScreen),
+		hid.Collection(hid.CollectionApplication),
+		hid.ReportID(touchReportId),
+	}
+
+	for range maxTouchContacts {
+		items = append(items,
+			hid.UsagePage(hid.PageDigitizer),
+			hid.Usage(hid.UsageFinger),
+			hid.Collection(hid.CollectionLogical),
+			hid.Usage(hid.UsageTipSwitch),
+			hid.LogicalMinimum(0),
+			hid.LogicalMaximum(1),
+			hid.ReportSize(1),
+			hid.ReportCount(1),
+			hid.Input(hid.Variable),
+			hid.ReportSize(7),
+			hid.Input(hid.Constant|hid.Variable),
+			hid.Usage(hid.UsageContactID),
+			hid.LogicalMaximum(maxTouchContacts-1),
+			hid.ReportSize(8),
+			hid.Input(hid.Variable),
+			hid.UsagePage(hid.PageGenericDesktop),
+			hid.Usage(hid.UsageX),
+			hid.Usage(hid.UsageY),
+			hid.LogicalMaximum(hidAbsoluteMax),
+			hid.ReportSize(16),
+			hid.ReportCount(2),
+			hid.Input(hid.Variable),
+			hid.EndCollection(),
+		)
+	}
+
+	return hid.Descriptor(append(items,
+		hid.UsagePage(hid.PageDigitizer),
+		hid.Usage(hid.UsageContactCount),
+		hid.LogicalMaximum(maxTouchContacts),
+		hid.ReportSize(8),
+		hid.ReportCount(1),
+		hid.Input(hid.Variable),
+		hid.Usage(hid.UsageScanTime),
+		hid.LogicalMaximum(0xffff),
+		hid.ReportSize(16),
+		hid.Input(hid.Variable),
+		hid.ReportID(touchFeatureReportId),
+		hid.Usage(hid.UsageContactCountMaximum),
+		hid.LogicalMaximum(maxTouchContacts),
+		hid.ReportSize(8),
+		hid.Feature(hid.Variable),
+		hid.EndCollection(),
+	)...)
+}()
+
+// mustLayout parses one of the descriptors above, so a failure is a
+// programming error.
+func mustLayout(descriptor []byte) *hid.Layout {
+	layout, err := hid.Parse(descriptor)
+	if err != nil {
+		panic(fmt.Sprintf("invalid report descriptor: %v", err))
+	}
+
+	return layout
+}
+
+// mustReport returns a report of one of the descriptors above.
+func mustReport(descriptor []byte, kind hid.ReportKind, id uint8) *hid.Report {
+	report, exists := mustLayout(descriptor).Report(kind, id)
+	if !exists {
+		panic(fmt.Sprintf("report descriptor has no %s report %d", kind, id))
+	}
+
+	return report
+}
+
+// usageField is the element of a report field carrying one usage.
+type usageField struct {
+	field hid.Field
+	index int
+}
+
+func mustUsage(report *hid.Report, page, usage uint16) usageField {
+	field, i, err := report.Usage(page, usage)
+	if err != nil {
+		panic(err)
+	}
+
+	return usageField{field: field, index: i}
+}
+
+func (u usageField) put(report []byte, v int32) {
+	u.field.Put(report, u.index, v)
+}
+
+// mustUsages returns the elements carrying usage in the first count fields,
+// such as the same usage in every contact of a digitizer.
+func mustUsages(report *hid.Report, page, usage uint16, count int) []usageField {
+	extended := hid.ExtendedUsage(page, usage)
+	var fields []usageField
+	for _, field := range report.Fields {
+		if i, ok := field.Index(extended); ok && len(fields) < count {
+			fields = append(fields, usageField{field: field, index: i})
+		}
+	}
+
+	if len(fields) < count {
+		panic(fmt.Sprintf("%s report %d has %d of %d fields with usage %#04x:%#04x", report.Kind, report.ID, len(fields), count, page, usage))
+	}
+
+	return fields
+}
+
+// mustArray returns the array field reporting usages of page.
+func mustArray(report *hid.Report, page uint16) hid.Field {
+	field, err := report.Array(page)
+	if err != nil {
+		panic(err)
+	}
+
+	return field
+}
+
+// putUsage selects usage in the first element of an array field, or leaves
+// it empty when the field cannot report usage.
+func putUsage(report []byte, field hid.Field, page, usage uint16) {
+	if v, ok := field.Value(hid.ExtendedUsage(page, usage)); ok {
+		field.Put(report, 0, v)
+	}
+}
+
+// putButtons sets the button elements of report from the bits of buttons.
+func putButtons(report []byte, fields []usageField, buttons MouseButton) {
+	for i, field := range fields {
+		field.put(report, int32(buttons>>i&1))
+	}
+}
+
+// mustButtons returns the elements of the first count buttons of report.
+func mustButtons(report *hid.Report, count int) []usageField {
+	fields := make([]usageField, count)
+	for i := range fields {
+		fields[i] = mustUsage(report, hid.PageButton, uint16(i+1))
+	}
+
+	return fields
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestConsumerReports(t *testing.T) {
+	device, host := newTestDevice(t)
+	consumer := &ConsumerController{device: device}
+	tests := []struct {
+		send func() error
+		want []byte
+	}{
+		{func() error { return consumer.sendConsumerReport(ConsumerVolumeUp) }, []byte{consumerReportId, 0xe9, 0x00}},
+		{func() error { return consumer.sendConsumerReport(0) }, []byte{consumerReportId, 0x00, 0x00}},
+		{func() error { return consumer.sendSystemReport(SystemPowerDown) }, []byte{systemReportId, 0x01}},
+		{func() error { return consumer.sendSystemReport(SystemWakeUp) }, []byte{systemReportId, 0x03}},
+		{func() error { return consumer.sendSystemReport(0) }, []byte{systemReportId, 0x00}},
+	}
+
+	for _, test := range tests {
+		if err := test.send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reports := readReports(t, host, len(tests))
+	for i, test := range tests {
+		if !bytes.Equal(reports[i], test.want) {
+			t.Errorf("report %d = % x, want % x", i, reports[i], test.want)
+		}
+	}
+}
+
+func TestTouchReport(t *testing.T) {
+	device, host := newTestDevice(t)
+	touch := &TouchController{device: device}
+	var slots [maxTouchContacts]*touchContact
+	slots[1] = &touchContact{x: 0x1234, y: 0x5678}
+	slots[4] = &touchContact{x: 0x0102, y: 0x0304, lifted: true}
+	if err := touch.sendReport(&slots, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 64)
+	want[0] = touchReportId
+	copy(want[1:], []byte{0x01, 1, 0x34, 0x12, 0x78, 0x56})
+	copy(want[7:], []byte{0x00, 4, 0x02, 0x01, 0x04, 0x03})
+	want[61] = 2
+
+	report := readReports(t, host, 1)[0]
+	// the scan time depends on the clock
+	if len(report) == len(want) {
+		copy(want[62:], report[62:])
+	}
+
+	if !bytes.Equal(report, want) {
+		t.Errorf("report = % x, want % x", report, want)
+	}
+
+	if slots[4] != nil {
+		t.Error("lifted contact is still in its slot")
+	}
+}
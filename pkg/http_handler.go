@@ -1,54 +1,148 @@
 package pkg
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mini-kvm/pkg/auth"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/pion/webrtc/v4"
 	"github.com/rs/zerolog/log"
 )
 
+// maxBodySize limits SDP offers and trickle ICE fragments.
+const maxBodySize = 64 << 10
+
 type HttpHandler struct {
 	server *Server
+	// authenticator is nil when authentication is disabled
+	authenticator *auth.Authenticator
+	corsOrigins   []string
 }
 
-func (h *HttpHandler) whepHandler(res http.ResponseWriter, req *http.Request) {
-	log.Printf("Request to %s, method = %s\n", req.URL, req.Method)
+func (h *HttpHandler) setCORSHeaders(res http.ResponseWriter, req *http.Request, methods string) {
+	origin := req.Header.Get("Origin")
+	res.Header().Add("Vary", "Origin")
+	if origin == "" {
+		return
+	}
+
+	if slices.Contains(h.corsOrigins, "*") {
+		res.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if slices.Contains(h.corsOrigins, origin) {
+		res.Header().Set("Access-Control-Allow-Origin", origin)
+		res.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		return
+	}
+
+	res.Header().Set("Access-Control-Allow-Methods", methods)
+	res.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, Content-Range, Repr-Digest")
+	res.Header().Set("Access-Control-Expose-Headers", "Location, ETag, Range")
+}
+
+// authenticate answers 401 and returns false when req carries no valid
+// session. On success the session is stored in the request context.
+func (h *HttpHandler) authenticate(res http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	if h.authenticator == nil {
+		return req, true
+	}
+
+	session, err := h.authenticator.Authenticate(req)
+	if err != nil {
+		log.Debug().Err(err).Str("remote", req.RemoteAddr).Msg("unauthenticated request")
+		res.Header().Set("WWW-Authenticate", `Bearer realm="mini-kvm"`)
+		writeProblem(res, http.StatusUnauthorized, err.Error())
+		return req, false
+	}
 
-	res.Header().Add("Access-Control-Allow-Origin", "*")
-	res.Header().Add("Access-Control-Allow-Methods", "POST, PATCH, DELETE")
-	res.Header().Add("Access-Control-Allow-Headers", "*")
-	res.Header().Add("Access-Control-Expose-Headers", "Location")
-	//res.Header().Add("Access-Control-Allow-Headers", "Authorization")
+	return req.WithContext(auth.WithSession(req.Context(), session)), true
+}
 
+func (h *HttpHandler) whepHandler(res http.ResponseWriter, req *http.Request) {
+	log.Debug().Str("url", req.URL.String()).Str("method", req.Method).Msg("whep request")
+
+	h.setCORSHeaders(res, req, "POST, PATCH, DELETE")
 	if req.Method == http.MethodOptions {
 		return
 	}
 
+	req, ok := h.authenticate(res, req)
+	if !ok {
+		return
+	}
+
 	switch req.Method {
 	case http.MethodPost:
 		h.handleWhepPost(res, req)
 	case http.MethodPatch:
 		h.handleWhepPatch(res, req)
+	case http.MethodDelete:
+		h.handleWhepDelete(res, req)
+	default:
+		writeMethodNotAllowed(res, "POST, PATCH, DELETE, OPTIONS")
 	}
+}
+
+// hasContentType reports whether req declares the given media type.
+func hasContentType(req *http.Request, expected string) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == expected
+}
 
+func writeJSON(res http.ResponseWriter, status int, body any) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
 }
 
 func (h *HttpHandler) handleWhepPost(res http.ResponseWriter, req *http.Request) {
-	offer, err := io.ReadAll(req.Body)
+	if req.URL.Query().Has("id") {
+		writeMethodNotAllowed(res, "PATCH, DELETE, OPTIONS")
+		return
+	}
+
+	if !hasContentType(req, "application/sdp") {
+		writeProblem(res, http.StatusUnsupportedMediaType, "offer must be sent as application/sdp")
+		return
+	}
+
+	offer, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxBodySize))
 	if err != nil {
-		log.Panic().Err(err).Msg("failed to read request body")
+		writeProblem(res, http.StatusBadRequest, fmt.Sprintf("failed to read offer: %v", err))
+		return
+	}
+
+	// without authentication everyone may take control
+	user, isAdmin := "", true
+	if session, ok := auth.SessionFromContext(req.Context()); ok {
+		user, isAdmin = session.User, session.Admin
 	}
 
 	clientId, answer, err := h.server.CreateClient(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer, SDP: string(offer),
-	})
+	}, user, isAdmin)
 	if err != nil {
-		log.Panic().Err(err).Msg("failed to create client")
+		switch {
+		case errors.Is(err, ErrInvalidOffer):
+			writeProblem(res, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrNoMedia):
+			res.Header().Set("Retry-After", "5")
+			writeProblem(res, http.StatusServiceUnavailable, err.Error())
+		default:
+			log.Error().Err(err).Msg("failed to create client")
+			writeProblem(res, http.StatusInternalServerError, "failed to create session")
+		}
+		return
 	}
 
+	res.Header().Set("Content-Type", "application/sdp")
 	res.Header().Add("Location", fmt.Sprintf("/connect?id=%s", clientId))
 	res.WriteHeader(http.StatusCreated)
 	fmt.Fprint(res, answer.SDP)
@@ -57,19 +151,25 @@ func (h *HttpHandler) handleWhepPost(res http.ResponseWriter, req *http.Request)
 func (h *HttpHandler) handleWhepPatch(res http.ResponseWriter, req *http.Request) {
 	clientId := req.URL.Query().Get("id")
 	if clientId == "" {
-		res.WriteHeader(http.StatusBadRequest)
+		writeProblem(res, http.StatusBadRequest, "missing id")
 		return
 	}
 
-	client, exists := h.server.clients.Load(clientId)
+	client, exists := h.sessionClient(req, clientId)
 	if !exists {
-		res.WriteHeader(http.StatusNotFound)
+		writeProblem(res, http.StatusNotFound, "unknown session")
 		return
 	}
 
-	body, err := io.ReadAll(req.Body)
+	if !hasContentType(req, "application/trickle-ice-sdpfrag") {
+		writeProblem(res, http.StatusUnsupportedMediaType, "candidates must be sent as application/trickle-ice-sdpfrag")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxBodySize))
 	if err != nil {
-		log.Panic().Err(err).Msg("failed to read request body")
+		writeProblem(res, http.StatusBadRequest, fmt.Sprintf("failed to read candidates: %v", err))
+		return
 	}
 
 	candidateLines := parseTrickleICE(string(body))
@@ -80,15 +180,56 @@ func (h *HttpHandler) handleWhepPatch(res http.ResponseWriter, req *http.Request
 			}
 			err := client.connection.AddICECandidate(candidate)
 			if err != nil {
-				http.Error(res, err.Error(), http.StatusBadRequest)
+				writeProblem(res, http.StatusBadRequest, err.Error())
 				return
 			}
 		}
 	}
 
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HttpHandler) handleWhepDelete(res http.ResponseWriter, req *http.Request) {
+	clientId := req.URL.Query().Get("id")
+	if clientId == "" {
+		writeProblem(res, http.StatusBadRequest, "missing id")
+		return
+	}
+
+	if _, exists := h.sessionClient(req, clientId); !exists {
+		writeProblem(res, http.StatusNotFound, "unknown session")
+		return
+	}
+
+	if err := h.server.RemoveClient(clientId); err != nil {
+		if errors.Is(err, ErrClientNotFound) {
+			writeProblem(res, http.StatusNotFound, "unknown session")
+			return
+		}
+
+		log.Error().Err(err).Str("id", clientId).Msg("failed to remove client")
+	}
+
 	res.WriteHeader(http.StatusOK)
 }
 
+// sessionClient returns the client of a WHEP session owned by the user of
+// req, or of any session for admins. Sessions of other users are reported
+// as unknown, which does not tell whether they exist.
+func (h *HttpHandler) sessionClient(req *http.Request, clientId string) (*Client, bool) {
+	client, exists := h.server.clients.Load(clientId)
+	if !exists {
+		return nil, false
+	}
+
+	session, ok := auth.SessionFromContext(req.Context())
+	if ok && !session.Admin && session.User != client.User() {
+		return nil, false
+	}
+
+	return client, true
+}
+
 func parseTrickleICE(sdpFrag string) []string {
 	lines := strings.Split(sdpFrag, "\r\n")
 	var candidates []string
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"encoding/json"
+	"mini-kvm/pkg/auth"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWhepHandlerProblems(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		noMedia     bool
+		status      int
+		allow       string
+	}{
+		{name: "bad offer", method: http.MethodPost, target: "/connect", contentType: "application/sdp", body: "not sdp", status: http.StatusBadRequest},
+		{name: "offer content type", method: http.MethodPost, target: "/connect", contentType: "text/plain", body: "v=0", status: http.StatusUnsupportedMediaType},
+		{name: "no media", method: http.MethodPost, target: "/connect", contentType: "application/sdp", body: "v=0", noMedia: true, status: http.StatusServiceUnavailable},
+		{name: "method", method: http.MethodPut, target: "/connect", status: http.StatusMethodNotAllowed, allow: "POST, PATCH, DELETE, OPTIONS"},
+		{name: "post to session", method: http.MethodPost, target: "/connect?id=a", contentType: "application/sdp", status: http.StatusMethodNotAllowed, allow: "PATCH, DELETE, OPTIONS"},
+		{name: "patch unknown session", method: http.MethodPatch, target: "/connect?id=unknown", contentType: "application/trickle-ice-sdpfrag", status: http.StatusNotFound},
+		{name: "delete unknown session", method: http.MethodDelete, target: "/connect?id=unknown", status: http.StatusNotFound},
+		{name: "delete without id", method: http.MethodDelete, target: "/connect", status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &Server{}
+			server.mediaAvailable.Store(!test.noMedia)
+			handler := &HttpHandler{server: server}
+
+			req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+
+			res := httptest.NewRecorder()
+			handler.whepHandler(res, req)
+
+			if res.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", res.Code, test.status, res.Body)
+			}
+
+			if contentType := res.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", contentType)
+			}
+
+			if allow := res.Header().Get("Allow"); allow != test.allow {
+				t.Errorf("Allow = %q, want %q", allow, test.allow)
+			}
+
+			var body problem
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if body.Status != test.status {
+				t.Errorf("problem status = %d, want %d", body.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestWhepSessionsOfOtherUsers(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		user   string
+		admin  bool
+		status int
+	}{
+		{name: "owner", method: http.MethodPatch, user: "alice", status: http.StatusNoContent},
+		{name: "admin", method: http.MethodPatch, user: "root", admin: true, status: http.StatusNoContent},
+		{name: "patch of another user", method: http.MethodPatch, user: "bob", status: http.StatusNotFound},
+		{name: "delete of another user", method: http.MethodDelete, user: "bob", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &Server{}
+			server.clients.Set("a", &Client{id: "a", user: "alice"})
+			handler := &HttpHandler{server: server}
+
+			req := httptest.NewRequest(test.method, "/connect?id=a", strings.NewReader(""))
+			req.Header.Set("Content-Type", "application/trickle-ice-sdpfrag")
+			req = req.WithContext(auth.WithSession(req.Context(), &auth.Session{User: test.user, Admin: test.admin}))
+			res := httptest.NewRecorder()
+			handler.whepHandler(res, req)
+
+			if res.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", res.Code, test.status, res.Body)
+			}
+
+			if _, exists := server.clients.Load("a"); !exists {
+				t.Error("session was removed")
+			}
+		})
+	}
+}
+
+func TestTypeHandlerRejectsDelay(t *testing.T) {
+	for _, delay := range []string{"-1", "1001", "9223372036854775807"} {
+		handler := &HttpHandler{server: &Server{}}
+		req := httptest.NewRequest(http.MethodPost, "/type", strings.NewReader(`{"text": "a", "delay_ms": `+delay+`}`))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handler.typeHandler(res, req)
+
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("delay_ms %s: status = %d, want %d: %s", delay, res.Code, http.StatusUnprocessableEntity, res.Body)
+		}
+	}
+}
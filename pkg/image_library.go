@@ -0,0 +1,721 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mini-kvm/pkg/config"
+	"mini-kvm/pkg/protocol"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrImageExists     = errors.New("image already exists")
+	ErrImageBusy       = errors.New("image is being transferred")
+	ErrImageAttached   = errors.New("image is attached, eject it first")
+	ErrUploadOffset    = errors.New("chunk does not continue the upload")
+	ErrUploadSize      = errors.New("size differs from the upload in progress")
+	ErrDigestMismatch  = errors.New("sha-256 of the image does not match")
+	ErrInvalidDigest   = errors.New("sha-256 must be 64 hex digits")
+	ErrNoSpace         = errors.New("not enough free space for the image")
+	ErrInvalidImageURL = errors.New("image url must be http or https")
+)
+
+const (
+	// imageProgressInterval limits the progress events of a transfer.
+	imageProgressInterval = 500 * time.Millisecond
+	// reservedSpace is left free on the filesystem of the images.
+	reservedSpace = 64 << 20
+	// maxImageRedirects is how many redirects a fetch follows.
+	maxImageRedirects = 5
+)
+
+// imageClient fetches images. It gives up on servers that do not answer,
+// but not on downloads that take long.
+var imageClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          1,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxImageRedirects)
+		}
+
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return ErrInvalidImageURL
+		}
+
+		return nil
+	},
+}
+
+// Image is a file in the images directory.
+type Image struct {
+	Name string
+	Size int64
+	// Modified is a unix timestamp in milliseconds.
+	Modified int64
+	// SHA256 is the hex digest of images uploaded or fetched by the server.
+	SHA256 string
+}
+
+// ImageProgress reports an upload or fetch into the image library. Total is
+// -1 while unknown.
+type ImageProgress struct {
+	Name     string
+	Received int64
+	Total    int64
+	Done     bool
+	Error    error
+}
+
+// imageUpload is the state of a resumable upload, saved next to its partial
+// file so that uploads survive restarts.
+type imageUpload struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ImageLibrary is the directory of images the mass storage drive can attach.
+// Files being written are hidden behind names starting with a dot: the
+// partial image, the state of its upload and the digest of a finished image.
+type ImageLibrary struct {
+	dir string
+
+	mutex sync.Mutex
+	// busy holds the images being written, with the cancel function of
+	// fetches and nil for uploads
+	busy map[string]context.CancelFunc
+	// announced holds the sizes of unfinished transfers, whose missing bytes
+	// are kept free for them
+	announced map[string]int64
+}
+
+// NewImageLibrary opens the images in dir. Unfinished uploads can be resumed,
+// the partial images of interrupted fetches are removed.
+func NewImageLibrary(dir string) (*ImageLibrary, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create images directory: %w", err)
+	}
+
+	l := &ImageLibrary{dir: dir, busy: make(map[string]context.CancelFunc), announced: make(map[string]int64)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read images directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		hidden, ok := strings.CutPrefix(entry.Name(), ".")
+		name, part := strings.CutSuffix(hidden, ".part")
+		if !ok || !part {
+			continue
+		}
+
+		upload, err := l.loadUpload(name)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Info().Str("image", name).Msg("removing image of an interrupted fetch")
+			os.Remove(l.hiddenPath(name, ".part"))
+		} else if err != nil {
+			log.Error().Err(err).Str("image", name).Msg("failed to read upload")
+		} else {
+			l.announced[name] = upload.Size
+		}
+	}
+
+	return l, nil
+}
+
+// Images lists the finished images sorted by name.
+func (l *ImageLibrary) Images() ([]Image, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	images := make([]Image, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !config.ValidImageName(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		digest, _ := os.ReadFile(l.hiddenPath(entry.Name(), ".sha256"))
+		images = append(images, Image{
+			Name:     entry.Name(),
+			Size:     info.Size(),
+			Modified: info.ModTime().UnixMilli(),
+			SHA256:   strings.TrimSpace(string(digest)),
+		})
+	}
+
+	return images, nil
+}
+
+// Path returns the file of a finished image.
+func (l *ImageLibrary) Path(name string) (string, error) {
+	if !config.ValidImageName(name) {
+		return "", ErrInvalidImageName
+	}
+
+	path := filepath.Join(l.dir, name)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || err == nil && !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: %s", ErrImageNotFound, name)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to open image %s: %w", name, err)
+	}
+
+	return path, nil
+}
+
+// FreeSpace is the space left for images in bytes.
+func (l *ImageLibrary) FreeSpace() (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(l.dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to read free space: %w", err)
+	}
+
+	return max(int64(stat.Bavail)*int64(stat.Bsize)-reservedSpace, 0), nil
+}
+
+// Received returns how much of an upload of size bytes has arrived.
+func (l *ImageLibrary) Received(name string, size int64) (int64, error) {
+	if err := l.checkNew(name); err != nil {
+		return 0, err
+	}
+
+	upload, err := l.loadUpload(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if upload.Size != size {
+		return 0, ErrUploadSize
+	}
+
+	return l.partSize(name)
+}
+
+// Upload appends the bytes of chunk at offset start to the upload of an
+// image of size bytes. It returns the bytes received so far, also with
+// ErrUploadOffset when start does not continue them. Once all bytes arrived
+// the image is checked against sha256Hex, when given with any chunk, and
+// moved into the library.
+func (l *ImageLibrary) Upload(name string, start, size int64, chunk io.Reader, sha256Hex string, progress func(ImageProgress)) (int64, error) {
+	if err := validDigest(sha256Hex); err != nil {
+		return 0, err
+	}
+
+	if err := l.checkNew(name); err != nil {
+		return 0, err
+	}
+
+	if err := l.acquire(name, nil); err != nil {
+		return 0, err
+	}
+	defer l.release(name)
+
+	upload, err := l.loadUpload(name)
+	if errors.Is(err, os.ErrNotExist) {
+		if start != 0 {
+			return 0, ErrUploadOffset
+		}
+
+		if _, err := l.reserve(name, size); err != nil {
+			return 0, err
+		}
+
+		upload = imageUpload{Size: size}
+		if err := os.WriteFile(l.hiddenPath(name, ".part"), nil, 0644); err != nil {
+			l.removeTransfer(name)
+			return 0, fmt.Errorf("failed to create image %s: %w", name, err)
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	if upload.Size != size {
+		return 0, ErrUploadSize
+	}
+
+	if sha256Hex != "" {
+		if upload.SHA256 != "" && !strings.EqualFold(upload.SHA256, sha256Hex) {
+			return 0, ErrDigestMismatch
+		}
+
+		upload.SHA256 = strings.ToLower(sha256Hex)
+	}
+
+	if err := l.saveUpload(name, upload); err != nil {
+		return 0, err
+	}
+
+	received, err := l.partSize(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if start != received {
+		return received, ErrUploadOffset
+	}
+
+	file, err := os.OpenFile(l.hiddenPath(name, ".part"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return received, fmt.Errorf("failed to open image %s: %w", name, err)
+	}
+
+	writer := &progressWriter{progress: ImageProgress{Name: name, Received: received, Total: size}, report: progress}
+	n, copyErr := io.Copy(io.MultiWriter(file, writer), io.LimitReader(chunk, size-received))
+	received += n
+	if err := errors.Join(file.Close(), copyErr); err != nil {
+		return received, fmt.Errorf("failed to write image %s: %w", name, err)
+	}
+
+	if received < size {
+		progress(writer.progress)
+		return received, nil
+	}
+
+	digest, err := fileDigest(l.hiddenPath(name, ".part"))
+	if err != nil {
+		return received, err
+	}
+
+	if err := l.finish(name, digest, upload.SHA256); err != nil {
+		l.removeTransfer(name)
+		progress(ImageProgress{Name: name, Received: received, Total: size, Done: true, Error: err})
+		return received, err
+	}
+
+	progress(ImageProgress{Name: name, Received: received, Total: size, Done: true})
+	return received, nil
+}
+
+// Fetch downloads the image from rawURL in the background, reporting its
+// progress until it is done.
+func (l *ImageLibrary) Fetch(name, rawURL, sha256Hex string, progress func(ImageProgress)) error {
+	if err := validDigest(sha256Hex); err != nil {
+		return err
+	}
+
+	if u, err := url.Parse(rawURL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return ErrInvalidImageURL
+	}
+
+	if err := l.checkNew(name); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := l.acquire(name, cancel); err != nil {
+		cancel()
+		return err
+	}
+
+	go func() {
+		defer l.release(name)
+		defer cancel()
+
+		received, err := l.fetch(ctx, name, rawURL, strings.ToLower(sha256Hex), progress)
+		if err != nil {
+			l.removeTransfer(name)
+			log.Error().Err(err).Str("image", name).Str("url", rawURL).Msg("failed to fetch image")
+		} else {
+			log.Info().Str("image", name).Str("url", rawURL).Msg("image fetched")
+		}
+
+		progress(ImageProgress{Name: name, Received: received, Total: received, Done: true, Error: err})
+	}()
+
+	return nil
+}
+
+// fetch downloads the image and returns the bytes received.
+func (l *ImageLibrary) fetch(ctx context.Context, name, rawURL, sha256Hex string, progress func(ImageProgress)) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := imageClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected response %s", res.Status)
+	}
+
+	free, err := l.reserve(name, res.ContentLength)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Create(l.hiddenPath(name, ".part"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create image %s: %w", name, err)
+	}
+
+	hash := sha256.New()
+	writer := &progressWriter{progress: ImageProgress{Name: name, Total: res.ContentLength}, report: progress}
+	// servers may send more than they announced, or announce nothing
+	body := &spaceReader{reader: res.Body, free: free}
+	received, copyErr := io.Copy(io.MultiWriter(file, hash, writer), body)
+	if err := errors.Join(copyErr, file.Close()); err != nil {
+		return received, fmt.Errorf("failed to download image %s: %w", name, err)
+	}
+
+	if res.ContentLength >= 0 && received != res.ContentLength {
+		return received, fmt.Errorf("failed to download image %s: %w", name, io.ErrUnexpectedEOF)
+	}
+
+	return received, l.finish(name, hex.EncodeToString(hash.Sum(nil)), sha256Hex)
+}
+
+// Delete removes an image, the upload of an image or cancels its fetch.
+func (l *ImageLibrary) Delete(name string) error {
+	if !config.ValidImageName(name) {
+		return ErrInvalidImageName
+	}
+
+	l.mutex.Lock()
+	cancel, busy := l.busy[name]
+	l.mutex.Unlock()
+	if busy && cancel == nil {
+		return ErrImageBusy
+	} else if busy {
+		// the fetch removes its partial image
+		cancel()
+		return nil
+	}
+
+	found := false
+	for _, path := range []string{filepath.Join(l.dir, name), l.hiddenPath(name, ".sha256"), l.hiddenPath(name, ".part"), l.hiddenPath(name, ".upload")} {
+		err := os.Remove(path)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete image %s: %w", name, err)
+		}
+	}
+
+	l.unreserve(name)
+	if !found {
+		return fmt.Errorf("%w: %s", ErrImageNotFound, name)
+	}
+
+	log.Info().Str("image", name).Msg("image deleted")
+	return nil
+}
+
+// finish checks the digest of a complete partial image and moves it into
+// the library.
+func (l *ImageLibrary) finish(name, digest, expected string) error {
+	if expected != "" && digest != expected {
+		return fmt.Errorf("%w: got %s", ErrDigestMismatch, digest)
+	}
+
+	if err := os.WriteFile(l.hiddenPath(name, ".sha256"), []byte(digest+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to save digest of %s: %w", name, err)
+	}
+
+	if err := os.Rename(l.hiddenPath(name, ".part"), filepath.Join(l.dir, name)); err != nil {
+		return fmt.Errorf("failed to save image %s: %w", name, err)
+	}
+
+	os.Remove(l.hiddenPath(name, ".upload"))
+	l.unreserve(name)
+	return nil
+}
+
+// checkNew returns an error unless name is a valid name of no image yet.
+func (l *ImageLibrary) checkNew(name string) error {
+	if !config.ValidImageName(name) {
+		return ErrInvalidImageName
+	}
+
+	if _, err := os.Lstat(filepath.Join(l.dir, name)); err == nil {
+		return ErrImageExists
+	}
+
+	return nil
+}
+
+// reserve keeps size bytes free for the transfer of name, unless it is -1
+// for unknown, and returns the bytes it may write. Bytes other transfers
+// announced but have not written yet do not count as free.
+func (l *ImageLibrary) reserve(name string, size int64) (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	free, err := l.FreeSpace()
+	if err != nil {
+		return 0, err
+	}
+
+	for other, announced := range l.announced {
+		if other == name {
+			continue
+		}
+
+		received, err := l.partSize(other)
+		if err != nil {
+			return 0, err
+		}
+
+		free -= max(announced-received, 0)
+	}
+
+	if size > free {
+		return 0, fmt.Errorf("%w: %d bytes needed, %d free", ErrNoSpace, size, max(free, 0))
+	}
+
+	if size >= 0 {
+		l.announced[name] = size
+	}
+
+	return free, nil
+}
+
+func (l *ImageLibrary) unreserve(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.announced, name)
+}
+
+func (l *ImageLibrary) acquire(name string, cancel context.CancelFunc) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, busy := l.busy[name]; busy {
+		return ErrImageBusy
+	}
+
+	l.busy[name] = cancel
+	return nil
+}
+
+func (l *ImageLibrary) release(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.busy, name)
+}
+
+func (l *ImageLibrary) loadUpload(name string) (imageUpload, error) {
+	var upload imageUpload
+	data, err := os.ReadFile(l.hiddenPath(name, ".upload"))
+	if err != nil {
+		return upload, err
+	}
+
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return upload, fmt.Errorf("failed to read upload of %s: %w", name, err)
+	}
+
+	return upload, nil
+}
+
+func (l *ImageLibrary) saveUpload(name string, upload imageUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(l.hiddenPath(name, ".upload"), data, 0644); err != nil {
+		return fmt.Errorf("failed to save upload of %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (l *ImageLibrary) partSize(name string) (int64, error) {
+	info, err := os.Stat(l.hiddenPath(name, ".part"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read upload of %s: %w", name, err)
+	}
+
+	return info.Size(), nil
+}
+
+// removeTransfer deletes the partial image and upload state of name.
+func (l *ImageLibrary) removeTransfer(name string) {
+	os.Remove(l.hiddenPath(name, ".part"))
+	os.Remove(l.hiddenPath(name, ".upload"))
+	l.unreserve(name)
+}
+
+func (l *ImageLibrary) hiddenPath(name, suffix string) string {
+	return filepath.Join(l.dir, "."+name+suffix)
+}
+
+func validDigest(sha256Hex string) error {
+	if sha256Hex == "" {
+		return nil
+	}
+
+	if decoded, err := hex.DecodeString(sha256Hex); err != nil || len(decoded) != sha256.Size {
+		return ErrInvalidDigest
+	}
+
+	return nil
+}
+
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", filepath.Base(path), err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// spaceReader fails with ErrNoSpace once more than free bytes were read.
+type spaceReader struct {
+	reader io.Reader
+	free   int64
+	read   int64
+}
+
+func (r *spaceReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.read+int64(n) > r.free {
+		n = int(r.free - r.read)
+		r.read = r.free
+		return n, fmt.Errorf("%w: more than %d bytes", ErrNoSpace, r.free)
+	}
+
+	r.read += int64(n)
+	return n, err
+}
+
+// progressWriter counts the bytes of a transfer and reports them at most
+// every imageProgressInterval.
+type progressWriter struct {
+	progress   ImageProgress
+	report     func(ImageProgress)
+	lastReport time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.progress.Received += int64(len(p))
+	if time.Since(w.lastReport) >= imageProgressInterval {
+		w.lastReport = time.Now()
+		w.report(w.progress)
+	}
+
+	return len(p), nil
+}
+
+func (s *Server) imageLibrary() (*ImageLibrary, error) {
+	if s.virtualMedia == nil {
+		return nil, ErrMassStorageDisabled
+	}
+
+	return s.virtualMedia.images, nil
+}
+
+// UploadImage stores a chunk of an image upload and tells every client about
+// its progress, see ImageLibrary.Upload.
+func (s *Server) UploadImage(name string, start, size int64, chunk io.Reader, sha256Hex string) (int64, error) {
+	images, err := s.imageLibrary()
+	if err != nil {
+		return 0, err
+	}
+
+	return images.Upload(name, start, size, chunk, sha256Hex, s.broadcastImageProgress)
+}
+
+// FetchImage downloads an image from rawURL in the background and tells every
+// client about its progress.
+func (s *Server) FetchImage(name, rawURL, sha256Hex string) error {
+	images, err := s.imageLibrary()
+	if err != nil {
+		return err
+	}
+
+	return images.Fetch(name, rawURL, sha256Hex, s.broadcastImageProgress)
+}
+
+// ImagePath returns the file of a complete image.
+func (s *Server) ImagePath(name string) (string, error) {
+	images, err := s.imageLibrary()
+	if err != nil {
+		return "", err
+	}
+
+	return images.Path(name)
+}
+
+// ImageReceived returns how much of an upload of size bytes arrived, see
+// ImageLibrary.Received.
+func (s *Server) ImageReceived(name string, size int64) (int64, error) {
+	images, err := s.imageLibrary()
+	if err != nil {
+		return 0, err
+	}
+
+	return images.Received(name, size)
+}
+
+// DeleteImage removes an image which is not attached.
+func (s *Server) DeleteImage(name string) error {
+	images, err := s.imageLibrary()
+	if err != nil {
+		return err
+	}
+
+	if s.virtualMedia.Medium().Image == name {
+		return ErrImageAttached
+	}
+
+	return images.Delete(name)
+}
+
+func (s *Server) broadcastImageProgress(progress ImageProgress) {
+	msg := &protocol.ImageProgress{
+		Name:     progress.Name,
+		Received: progress.Received,
+		Total:    progress.Total,
+		Done:     progress.Done,
+	}
+	if progress.Error != nil {
+		msg.Error = progress.Error.Error()
+	}
+
+	s.Broadcast(msg)
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestImageLibrary(t *testing.T, dir string) *ImageLibrary {
+	t.Helper()
+	library, err := NewImageLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return library
+}
+
+func sha256Hex(data string) string {
+	digest := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(digest[:])
+}
+
+// assertEmptyDir checks that a failed transfer left nothing behind.
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		t.Errorf("%s was left behind", entry.Name())
+	}
+}
+
+func ignoreProgress(ImageProgress) {}
+
+func TestUploadDigestMismatch(t *testing.T) {
+	dir := t.TempDir()
+	library := newTestImageLibrary(t, dir)
+	_, err := library.Upload("disk.img", 0, 8, strings.NewReader("abcdefgh"), sha256Hex("other"), ignoreProgress)
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Upload = %v, want %v", err, ErrDigestMismatch)
+	}
+
+	assertEmptyDir(t, dir)
+}
+
+func TestUploadResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	received, err := newTestImageLibrary(t, dir).Upload("disk.img", 0, 8, strings.NewReader("abcd"), sha256Hex("abcdefgh"), ignoreProgress)
+	if err != nil || received != 4 {
+		t.Fatalf("Upload = %d, %v, want 4", received, err)
+	}
+
+	library := newTestImageLibrary(t, dir)
+	if received, err := library.Received("disk.img", 8); err != nil || received != 4 {
+		t.Fatalf("Received = %d, %v, want 4", received, err)
+	}
+
+	if _, err := library.Received("disk.img", 16); !errors.Is(err, ErrUploadSize) {
+		t.Errorf("Received of another size = %v, want %v", err, ErrUploadSize)
+	}
+
+	// the digest sent with the first chunk still applies
+	received, err = library.Upload("disk.img", 4, 8, strings.NewReader("efgh"), "", ignoreProgress)
+	if err != nil || received != 8 {
+		t.Fatalf("Upload = %d, %v, want 8", received, err)
+	}
+
+	images, err := library.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 || images[0].Name != "disk.img" || images[0].Size != 8 || images[0].SHA256 != sha256Hex("abcdefgh") {
+		t.Errorf("Images = %+v", images)
+	}
+
+	assertMissing(t, library.hiddenPath("disk.img", ".part"))
+	assertMissing(t, library.hiddenPath("disk.img", ".upload"))
+}
+
+func TestFetchDigestMismatch(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, "abcdefgh")
+	}))
+	defer remote.Close()
+
+	dir := t.TempDir()
+	library := newTestImageLibrary(t, dir)
+	done := make(chan ImageProgress, 1)
+	err := library.Fetch("disk.img", remote.URL, sha256Hex("other"), func(progress ImageProgress) {
+		if progress.Done {
+			done <- progress
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case progress := <-done:
+		if !errors.Is(progress.Error, ErrDigestMismatch) {
+			t.Fatalf("fetch failed with %v, want %v", progress.Error, ErrDigestMismatch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch did not finish")
+	}
+
+	assertEmptyDir(t, dir)
+}
+
+func TestSpaceReader(t *testing.T) {
+	data, err := io.ReadAll(&spaceReader{reader: strings.NewReader("abcdefgh"), free: 8})
+	if err != nil || string(data) != "abcdefgh" {
+		t.Errorf("ReadAll = %q, %v, want abcdefgh", data, err)
+	}
+
+	data, err = io.ReadAll(&spaceReader{reader: strings.NewReader("abcdefgh"), free: 4})
+	if !errors.Is(err, ErrNoSpace) || string(data) != "abcd" {
+		t.Errorf("ReadAll = %q, %v, want abcd and %v", data, err, ErrNoSpace)
+	}
+}
+
+func assertMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s exists: %v", path, err)
+	}
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != want {
+		t.Errorf("%s = %q, want %q", path, data, want)
+	}
+}
+
+func TestUploadsReserveTheirSize(t *testing.T) {
+	dir := t.TempDir()
+	library := newTestImageLibrary(t, dir)
+	free, err := library.FreeSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if free < 1<<20 {
+		t.Skipf("only %d bytes free", free)
+	}
+
+	// each upload fits on its own, not both of them
+	size := free/2 + 1<<16
+	if _, err := library.Upload("a.img", 0, size, strings.NewReader("a"), "", ignoreProgress); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := library.Upload("b.img", 0, size, strings.NewReader("b"), "", ignoreProgress); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("second Upload = %v, want %v", err, ErrNoSpace)
+	}
+
+	// the reservation outlives a restart
+	library = newTestImageLibrary(t, dir)
+	if _, err := library.Upload("b.img", 0, size, strings.NewReader("b"), "", ignoreProgress); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Upload after restart = %v, want %v", err, ErrNoSpace)
+	}
+
+	if err := library.Delete("a.img"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := library.Upload("b.img", 0, size, strings.NewReader("b"), "", ignoreProgress); err != nil {
+		t.Fatalf("Upload after deleting the first = %v", err)
+	}
+}
+
+func TestNewImageLibraryRemovesInterruptedFetches(t *testing.T) {
+	dir := t.TempDir()
+	library := newTestImageLibrary(t, dir)
+	if _, err := library.Upload("upload.img", 0, 8, strings.NewReader("abcd"), "", ignoreProgress); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(library.hiddenPath("fetch.img", ".part"), []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	library = newTestImageLibrary(t, dir)
+	assertMissing(t, library.hiddenPath("fetch.img", ".part"))
+	if received, err := library.Received("upload.img", 8); err != nil || received != 4 {
+		t.Errorf("Received = %d, %v, want 4", received, err)
+	}
+}
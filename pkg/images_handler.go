@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageTransferTimeout bounds a single upload or download request, the
+// server timeouts are far too short for images.
+const imageTransferTimeout = time.Hour
+
+type fetchRequest struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+/*
+imagesHandler manages the image library of the mass storage drive
+
+	GET    /images                                        images and free space
+	GET    /images/{name}                                 downloads an image, with Range support
+	PUT    /images/{name}        Content-Range: bytes 0-1048575/4194304
+	                                                      uploads a chunk, 308 until the last one, then 201
+	DELETE /images/{name}                                 deletes an image or its upload, cancels a fetch, 204
+	POST   /images/{name}/fetch  {"url": "https://...", "sha256": "..."}
+	                                                      fetches an image in the background, 202
+
+Uploads without Content-Range send the whole image. A PUT without body whose
+Content-Range has an asterisk instead of the range asks for the received
+bytes, which come back in the Range header of a 308. A Repr-Digest header
+with a sha-256 digest on any chunk is checked once the image is complete.
+Progress is sent to every viewer as image.progress.
+*/
+func (h *HttpHandler) imagesHandler(res http.ResponseWriter, req *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/images"), "/"), "/")
+	methods := "GET"
+	switch {
+	case name != "" && action == "fetch":
+		methods = "POST"
+	case name != "" && action == "":
+		methods = "GET, PUT, DELETE"
+	case name != "" || action != "":
+		http.NotFound(res, req)
+		return
+	}
+
+	h.setCORSHeaders(res, req, methods)
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	req, ok := h.authenticate(res, req)
+	if !ok {
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodGet && name == "":
+		images, err := h.server.mediaImages()
+		if err != nil {
+			writeMediaError(res, err)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, images)
+	case req.Method == http.MethodGet && action == "":
+		h.handleImageGet(res, req, name)
+	case req.Method == http.MethodPut && action == "":
+		if !h.isAdmin(res, req, "change images") {
+			return
+		}
+
+		h.handleImagePut(res, req, name)
+	case req.Method == http.MethodDelete && action == "":
+		if !h.isAdmin(res, req, "change images") {
+			return
+		}
+
+		if err := h.server.DeleteImage(name); err != nil {
+			writeMediaError(res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPost && action == "fetch":
+		if !hasContentType(req, "application/json") {
+			writeProblem(res, http.StatusUnsupportedMediaType, "fetch must be sent as application/json")
+			return
+		}
+
+		if !h.isAdmin(res, req, "change images") {
+			return
+		}
+
+		var body fetchRequest
+		if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxBodySize)).Decode(&body); err != nil {
+			writeProblem(res, http.StatusBadRequest, "invalid fetch request")
+			return
+		}
+
+		if err := h.server.FetchImage(name, body.URL, body.SHA256); err != nil {
+			writeMediaError(res, err)
+			return
+		}
+
+		res.Header().Set("Location", "/images/"+name)
+		res.WriteHeader(http.StatusAccepted)
+	default:
+		writeMethodNotAllowed(res, methods+", OPTIONS")
+	}
+}
+
+func (h *HttpHandler) handleImageGet(res http.ResponseWriter, req *http.Request, name string) {
+	path, err := h.server.ImagePath(name)
+	if err != nil {
+		writeMediaError(res, err)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		writeMediaError(res, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeMediaError(res, err)
+		return
+	}
+
+	http.NewResponseController(res).SetWriteDeadline(time.Now().Add(imageTransferTimeout))
+	res.Header().Set("Content-Type", "application/octet-stream")
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(res, req, name, info.ModTime(), file)
+}
+
+func (h *HttpHandler) handleImagePut(res http.ResponseWriter, req *http.Request, name string) {
+	start, end, size := int64(0), req.ContentLength-1, req.ContentLength
+	if header := req.Header.Get("Content-Range"); header != "" {
+		var err error
+		if start, end, size, err = parseContentRange(header); err != nil {
+			writeProblem(res, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if req.ContentLength < 0 {
+		writeProblem(res, http.StatusLengthRequired, "uploads need Content-Length or Content-Range")
+		return
+	}
+
+	if size <= 0 {
+		writeProblem(res, http.StatusBadRequest, "image must not be empty")
+		return
+	}
+
+	digest, err := reprDigestSHA256(req.Header.Get("Repr-Digest"))
+	if err != nil {
+		writeMediaError(res, err)
+		return
+	}
+
+	// bytes */size asks how much of the upload arrived
+	if start < 0 {
+		received, err := h.server.ImageReceived(name, size)
+		if err != nil {
+			writeMediaError(res, err)
+			return
+		}
+
+		writeUploadIncomplete(res, received)
+		return
+	}
+
+	if req.ContentLength >= 0 && req.ContentLength != end-start+1 {
+		writeProblem(res, http.StatusBadRequest, "Content-Length does not match Content-Range")
+		return
+	}
+
+	http.NewResponseController(res).SetReadDeadline(time.Now().Add(imageTransferTimeout))
+	received, err := h.server.UploadImage(name, start, size, io.LimitReader(req.Body, end-start+1), digest)
+	if errors.Is(err, ErrUploadOffset) {
+		setReceivedRange(res, received)
+	}
+
+	if err != nil {
+		writeMediaError(res, err)
+		return
+	}
+
+	if received < size {
+		writeUploadIncomplete(res, received)
+		return
+	}
+
+	res.Header().Set("Location", "/images/"+name)
+	res.WriteHeader(http.StatusCreated)
+}
+
+// writeUploadIncomplete answers 308 with the bytes received so far, which
+// resumable upload clients continue from.
+func writeUploadIncomplete(res http.ResponseWriter, received int64) {
+	setReceivedRange(res, received)
+	res.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func setReceivedRange(res http.ResponseWriter, received int64) {
+	if received > 0 {
+		res.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+}
+
+// parseContentRange parses "bytes start-end/size", and "bytes */size" with
+// start and end -1.
+func parseContentRange(header string) (start, end, size int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", header)
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+
+	span, total, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+
+	if size, err = strconv.ParseInt(total, 10, 64); err != nil || size < 0 {
+		return 0, 0, 0, invalid
+	}
+
+	if span == "*" {
+		return -1, -1, size, nil
+	}
+
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, 0, invalid
+	}
+
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || start < 0 || end < start || end >= size {
+		return 0, 0, 0, invalid
+	}
+
+	return start, end, size, nil
+}
+
+// reprDigestSHA256 returns the hex sha-256 of an RFC 9530 Repr-Digest header,
+// empty when it carries none.
+func reprDigestSHA256(header string) (string, error) {
+	for _, member := range strings.Split(header, ",") {
+		algorithm, value, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+
+		digest, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil || len(digest) != sha256.Size {
+			return "", ErrInvalidDigest
+		}
+
+		return hex.EncodeToString(digest), nil
+	}
+
+	return "", nil
+}
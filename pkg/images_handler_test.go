@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header           string
+		start, end, size int64
+		invalid          bool
+	}{
+		{header: "bytes 0-1048575/4194304", start: 0, end: 1048575, size: 4194304},
+		{header: "bytes 4-7/8", start: 4, end: 7, size: 8},
+		{header: "bytes */8", start: -1, end: -1, size: 8},
+		{header: "bytes 0-8/8", invalid: true},
+		{header: "bytes 4-3/8", invalid: true},
+		{header: "bytes -1-3/8", invalid: true},
+		{header: "bytes 0-3/*", invalid: true},
+		{header: "bytes 0-3", invalid: true},
+		{header: "bytes 3/8", invalid: true},
+		{header: "items 0-3/8", invalid: true},
+		{header: "", invalid: true},
+	}
+
+	for _, test := range tests {
+		start, end, size, err := parseContentRange(test.header)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseContentRange(%q) = %d, %d, %d, want an error", test.header, start, end, size)
+			}
+			continue
+		}
+
+		if err != nil || start != test.start || end != test.end || size != test.size {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v, want %d, %d, %d", test.header, start, end, size, err, test.start, test.end, test.size)
+		}
+	}
+}
+
+func TestReprDigestSHA256(t *testing.T) {
+	digest := sha256.Sum256([]byte("abcdefgh"))
+	encoded := base64.StdEncoding.EncodeToString(digest[:])
+	tests := []struct {
+		header string
+		want   string
+		err    error
+	}{
+		{header: "", want: ""},
+		{header: "sha-256=:" + encoded + ":", want: sha256Hex("abcdefgh")},
+		{header: "sha-512=:AAAA:, SHA-256=:" + encoded + ":", want: sha256Hex("abcdefgh")},
+		{header: "sha-512=:AAAA:", want: ""},
+		{header: "sha-256=:not base64:", err: ErrInvalidDigest},
+		{header: "sha-256=:AAAA:", err: ErrInvalidDigest},
+	}
+
+	for _, test := range tests {
+		got, err := reprDigestSHA256(test.header)
+		if !errors.Is(err, test.err) || got != test.want {
+			t.Errorf("reprDigestSHA256(%q) = %q, %v, want %q, %v", test.header, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestImagePutResumes(t *testing.T) {
+	images := newTestImageLibrary(t, t.TempDir())
+	handler := &HttpHandler{server: &Server{virtualMedia: &VirtualMedia{images: images}}}
+	put := func(contentRange, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/images/disk.img", strings.NewReader(body))
+		req.Header.Set("Content-Range", contentRange)
+		res := httptest.NewRecorder()
+		handler.handleImagePut(res, req, "disk.img")
+		return res
+	}
+
+	tests := []struct {
+		name         string
+		contentRange string
+		body         string
+		status       int
+		received     string
+	}{
+		{name: "first chunk", contentRange: "bytes 0-3/8", body: "abcd", status: http.StatusPermanentRedirect, received: "bytes=0-3"},
+		{name: "offset mismatch", contentRange: "bytes 6-7/8", body: "gh", status: http.StatusConflict, received: "bytes=0-3"},
+		{name: "received bytes", contentRange: "bytes */8", status: http.StatusPermanentRedirect, received: "bytes=0-3"},
+		{name: "last chunk", contentRange: "bytes 4-7/8", body: "efgh", status: http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		res := put(test.contentRange, test.body)
+		if res.Code != test.status {
+			t.Fatalf("%s: status = %d, want %d: %s", test.name, res.Code, test.status, res.Body)
+		}
+
+		if received := res.Header().Get("Range"); received != test.received {
+			t.Errorf("%s: Range = %q, want %q", test.name, received, test.received)
+		}
+	}
+
+	path, err := images.Path("disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFile(t, path, "abcdefgh")
+}
@@ -2,9 +2,12 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"slices"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -12,67 +15,134 @@ import (
 type KeyPressEvent struct {
 	KeyCode JSKeyCode `json:"key_code"`
 	IsDown  bool      `json:"is_down"`
+
+	// client is the id of the client pressing the key
+	client string
 }
 
-type KeyboardController struct {
-	device      *os.File
-	pressedKeys map[JSKeyCode]bool
-	eventChan   chan KeyPressEvent
+var ErrKeyboardClosed = errors.New("keyboard is closed")
+
+type tapRequest struct {
+	keystroke Keystroke
+	result    chan error
 }
 
-func NewKeyboardController(ctx context.Context, devicePath string) *KeyboardController {
-	c := &KeyboardController{
-		eventChan:   make(chan KeyPressEvent, 100),
-		pressedKeys: make(map[JSKeyCode]bool, 6),
-	}
+type KeyboardController struct {
+	device *os.File
+	format KeyboardReportFormat
+	// pressedKeys maps each key held down to the client pressing it
+	pressedKeys       map[JSKeyCode]string
+	eventChan         chan KeyPressEvent
+	releaseChan       chan struct{}
+	releaseClientChan chan string
+	tapChan           chan tapRequest
+
+	leds ledState
+
+	// writeErrors is only touched by the dispatcher
+	writeErrors writeErrorLog
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closeErr error
+}
 
-	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0666)
+func NewKeyboardController(ctx context.Context, devicePath string, format KeyboardReportFormat) *KeyboardController {
+	// the host writes LED output reports to the same device
+	device, err := os.OpenFile(devicePath, os.O_RDWR, 0666)
 	if err != nil {
 		log.Fatal().Err(err).Str("path", devicePath).Msg("failed to open device")
 	}
 
-	c.device = device
+	return newKeyboardController(ctx, device, format)
+}
+
+func newKeyboardController(ctx context.Context, device *os.File, format KeyboardReportFormat) *KeyboardController {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &KeyboardController{
+		device:            device,
+		format:            format,
+		eventChan:         make(chan KeyPressEvent, 100),
+		releaseChan:       make(chan struct{}, 1),
+		releaseClientChan: make(chan string, 8),
+		tapChan:           make(chan tapRequest),
+		pressedKeys:       make(map[JSKeyCode]string, 6),
+		writeErrors:       writeErrorLog{device: "keyboard"},
+		cancel:            cancel,
+		done:              make(chan struct{}),
+	}
+
 	go c.usbActionDispatcher(ctx)
+	go c.ledReader()
 	return c
 }
 
+// ledReader tracks the LED output reports of the host until the device is
+// closed.
+func (m *KeyboardController) ledReader() {
+	report := make([]byte, 8)
+	for {
+		n, err := m.device.Read(report)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Error().Err(err).Msg("failed to read keyboard leds")
+			}
+
+			return
+		}
+
+		if n > 0 {
+			m.leds.set(KeyboardLEDs(report[0]))
+		}
+	}
+}
+
 func (m *KeyboardController) usbActionDispatcher(ctx context.Context) {
-	defer m.device.Close()
+	defer close(m.done)
 	pressedKeysArr := make([]JSKeyCode, 0, 6)
 	prevPressedKeysArr := make([]JSKeyCode, 0, 6)
+	update := func() {
+		pressedKeysArr = pressedKeysArr[:0]
+		for k := range m.pressedKeys {
+			pressedKeysArr = append(pressedKeysArr, k)
+		}
+
+		slices.Sort(pressedKeysArr)
+		if !slices.Equal(pressedKeysArr, prevPressedKeysArr) {
+			prevPressedKeysArr = prevPressedKeysArr[:0]
+			for _, k := range pressedKeysArr {
+				prevPressedKeysArr = append(prevPressedKeysArr, k)
+			}
+
+			// only the change is reported, releasing everything first would
+			// break combinations which need their keys held in order, like
+			// Alt+SysRq
+			m.writeErrors.check(m.sendReport(prevPressedKeysArr), "failed to press keys")
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
+			m.closeErr = errors.Join(m.release(), m.device.Close())
 			return
+		case <-m.releaseChan:
+			clear(m.pressedKeys)
+			prevPressedKeysArr = prevPressedKeysArr[:0]
+			m.writeErrors.check(m.release(), "failed to release keys")
+		case client := <-m.releaseClientChan:
+			maps.DeleteFunc(m.pressedKeys, func(_ JSKeyCode, owner string) bool { return owner == client })
+			update()
+		case req := <-m.tapChan:
+			req.result <- m.tap(req.keystroke, prevPressedKeysArr)
 		case keyPress := <-m.eventChan:
 			if keyPress.IsDown {
-				m.pressedKeys[keyPress.KeyCode] = true
+				m.pressedKeys[keyPress.KeyCode] = keyPress.client
 			} else {
 				delete(m.pressedKeys, keyPress.KeyCode)
 			}
 
-			clear(pressedKeysArr)
-			for k := range m.pressedKeys {
-				pressedKeysArr = append(pressedKeysArr, k)
-			}
-
-			slices.Sort(pressedKeysArr)
-			if !slices.Equal(pressedKeysArr, prevPressedKeysArr) {
-				clear(prevPressedKeysArr)
-				for _, k := range pressedKeysArr {
-					prevPressedKeysArr = append(prevPressedKeysArr, k)
-				}
-
-				fmt.Println("selected keys:", prevPressedKeysArr)
-				if err := m.release(); err != nil {
-					log.Error().Err(err).Msg("failed to release keys")
-				}
-
-				if err := m.sendReport(prevPressedKeysArr); err != nil {
-					log.Error().Err(err).Msg("failed to press keys")
-				}
-			}
-			fmt.Println("keyboard event received")
+			update()
 		}
 	}
 }
@@ -81,37 +151,123 @@ func (m *KeyboardController) EventChan() chan KeyPressEvent {
 	return m.eventChan
 }
 
-func (m *KeyboardController) release() error {
-	return m.sendReport([]JSKeyCode{})
-}
-
-/*
-Report Structure for HID Keyboard
-
-Byte 0: Modifier keys (bit flags)
-Byte 1: Reserved (always 0x00)
-Byte 2: Key code 1
-Byte 3: Key code 2
-Byte 4: Key code 3
-Byte 5: Key code 4
-Byte 6: Key code 5
-Byte 7: Key code 6
-*/
-func (m *KeyboardController) sendReport(keys []JSKeyCode) error {
-	report := make([]byte, 8)
-	report[0] = byte(ModNone)
-	report[1] = 0x00
-
-	for i := 0; i < len(keys) && i < 6; i++ {
-		key := keys[i].ToKey()
-		if key.IsModifier() {
-			report[0] = byte(Key(report[0]) | key)
-			continue
+// Type taps each keystroke in order, waiting delay after every keystroke.
+// progress, when not nil, is called with the number of keystrokes typed so
+// far. Cancelling ctx stops typing after the current keystroke. Keys held by
+// the controlling client stay pressed around every keystroke.
+func (m *KeyboardController) Type(ctx context.Context, keystrokes []Keystroke, delay time.Duration, progress func(typed, total int)) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	for i, keystroke := range keystrokes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		req := tapRequest{keystroke: keystroke, result: make(chan error, 1)}
+		select {
+		case m.tapChan <- req:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.done:
+			return ErrKeyboardClosed
+		}
+
+		if err := <-req.result; err != nil {
+			return fmt.Errorf("failed to type keystroke %d: %w", i, err)
+		}
+
+		if progress != nil {
+			progress(i+1, len(keystrokes))
+		}
+
+		if delay > 0 && i < len(keystrokes)-1 {
+			timer.Reset(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+// LEDs returns the lock key state last reported by the host.
+func (m *KeyboardController) LEDs() KeyboardLEDs {
+	return m.leds.get()
+}
+
+// SubscribeLEDs calls fn whenever the host changes its lock key state. fn
+// runs on the reader goroutine and must not block. The returned function
+// removes the subscription.
+func (m *KeyboardController) SubscribeLEDs(fn func(KeyboardLEDs)) func() {
+	return m.leds.subscribe(fn)
+}
+
+// Close releases all keys and closes the device.
+func (m *KeyboardController) Close(ctx context.Context) error {
+	m.cancel()
+	select {
+	case <-m.done:
+		return m.closeErr
+	case <-ctx.Done():
+		return fmt.Errorf("failed to close keyboard: %w", ctx.Err())
+	}
+}
+
+// ReleaseAll lifts every pressed key on the host.
+func (m *KeyboardController) ReleaseAll() {
+	select {
+	case m.releaseChan <- struct{}{}:
+	default:
+	}
+}
+
+// ReleaseClient lifts the keys pressed by the client with the given id.
+func (m *KeyboardController) ReleaseClient(id string) {
+	select {
+	case m.releaseClientChan <- id:
+	case <-m.done:
+	}
+}
+
+// tap presses and releases a single keystroke, then restores the keys held.
+func (m *KeyboardController) tap(keystroke Keystroke, held []JSKeyCode) error {
+	keys := []Key{keystroke.Key}
+	for modifier := KeyLeftCtrl; modifier <= KeyRightGUI; modifier++ {
+		if keystroke.Modifiers&modifier.Modifier() != 0 {
+			keys = append(keys, modifier)
 		}
+	}
+
+	if _, err := m.device.Write(m.format.Encode(keys)); err != nil {
+		return err
+	}
+
+	if err := m.release(); err != nil {
+		return err
+	}
+
+	if len(held) == 0 {
+		return nil
+	}
+
+	return m.sendReport(held)
+}
+
+func (m *KeyboardController) release() error {
+	return m.sendReport(nil)
+}
 
-		report[2+i] = byte(key)
+func (m *KeyboardController) sendReport(codes []JSKeyCode) error {
+	keys := make([]Key, 0, len(codes))
+	for _, code := range codes {
+		keys = append(keys, code.ToKey())
 	}
 
-	_, err := m.device.Write(report)
+	_, err := m.device.Write(m.format.Encode(keys))
 	return err
 }
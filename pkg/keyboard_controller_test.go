@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"mini-kvm/pkg/config"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestKeyboard returns a keyboard writing to a test device and the host
+// end of it.
+func newTestKeyboard(t *testing.T, format KeyboardReportFormat) (*KeyboardController, *os.File) {
+	t.Helper()
+	device, host := newTestDevice(t)
+	keyboard := newKeyboardController(context.Background(), device, format)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		keyboard.Close(ctx)
+	})
+
+	return keyboard, host
+}
+
+func TestSysRqMacroHoldsAltSysRq(t *testing.T) {
+	keyboard, host := newTestKeyboard(t, KeyboardReport6KRO)
+	macro, found := findBuiltinMacro("alt-sysrq-reisub")
+	if !found {
+		t.Fatal("alt-sysrq-reisub is not built in")
+	}
+
+	// the pauses only matter to the host
+	macro.Steps = slices.DeleteFunc(slices.Clone(macro.Steps), func(step config.MacroStep) bool { return step.Wait > 0 })
+	server := &Server{keyboardController: keyboard}
+	if err := server.playMacro(context.Background(), macro); err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(keys ...Key) []byte { return KeyboardReport6KRO.Encode(keys) }
+	want := [][]byte{
+		encode(KeyLeftAlt),
+		encode(KeyLeftAlt, KeyPrintScreen),
+	}
+	for _, key := range []Key{KeyR, KeyE, KeyI, KeyS, KeyU, KeyB} {
+		want = append(want,
+			encode(KeyLeftAlt, key, KeyPrintScreen),
+			encode(KeyLeftAlt, KeyPrintScreen),
+		)
+	}
+	want = append(want, encode(KeyLeftAlt), encode())
+
+	reports := readReports(t, host, len(want))
+	for i := range want {
+		if !bytes.Equal(reports[i], want[i]) {
+			t.Errorf("report %d = % x, want % x", i, reports[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"sync"
+)
+
+/*
+Report Structure for HID Keyboard LEDs (host -> device)
+
+Byte 0: LED bit flags
+  - Bit 0: Num Lock
+  - Bit 1: Caps Lock
+  - Bit 2: Scroll Lock
+  - Bit 3: Compose
+  - Bit 4: Kana
+  - Bits 5-7: Padding
+*/
+type KeyboardLEDs uint8
+
+const (
+	LEDNumLock KeyboardLEDs = 1 << iota
+	LEDCapsLock
+	LEDScrollLock
+	LEDCompose
+	LEDKana
+)
+
+func (l KeyboardLEDs) Has(led KeyboardLEDs) bool {
+	return l&led != 0
+}
+
+// ledState holds the last LED report of the host and notifies subscribers
+// when it changes.
+type ledState struct {
+	mutex       sync.Mutex
+	leds        KeyboardLEDs
+	nextId      int
+	subscribers map[int]func(KeyboardLEDs)
+}
+
+func (s *ledState) get() KeyboardLEDs {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.leds
+}
+
+func (s *ledState) set(leds KeyboardLEDs) {
+	s.mutex.Lock()
+	if s.leds == leds {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.leds = leds
+	subscribers := make([]func(KeyboardLEDs), 0, len(s.subscribers))
+	for _, subscriber := range s.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	s.mutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(leds)
+	}
+}
+
+func (s *ledState) subscribe(fn func(KeyboardLEDs)) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[int]func(KeyboardLEDs))
+	}
+
+	id := s.nextId
+	s.nextId++
+	s.subscribers[id] = fn
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, id)
+	}
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"fmt"
+	"mini-kvm/pkg/hid"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type KeyboardReportFormat int
+
+const (
+	// KeyboardReport6KRO is the boot protocol report understood by BIOS and
+	// UEFI setup screens.
+	KeyboardReport6KRO KeyboardReportFormat = iota
+	// KeyboardReportNKRO reports every key in a bitmap.
+	KeyboardReportNKRO
+)
+
+const (
+	bootReportKeys = 6
+	nkroMaxUsage   = 0x9F
+)
+
+// keyboardReportLayout locates the fields of a keyboard input report in its
+// descriptor.
+type keyboardReportLayout struct {
+	report    *hid.Report
+	modifiers usageField
+	// keys is the key array of the boot report, or the bitmap of NKRO
+	keys hid.Field
+}
+
+func newKeyboardReportLayout(descriptor []byte) keyboardReportLayout {
+	report := mustReport(descriptor, hid.KindInput, 0)
+	layout := keyboardReportLayout{
+		report:    report,
+		modifiers: mustUsage(report, hid.PageKeyboard, hid.UsageKeyboardLeftControl),
+	}
+
+	if bitmap, _, err := report.Usage(hid.PageKeyboard, 0); err == nil {
+		layout.keys = bitmap
+	} else if layout.keys, err = report.Array(hid.PageKeyboard); err != nil {
+		panic(err)
+	}
+
+	return layout
+}
+
+var keyboardReportLayouts = map[KeyboardReportFormat]keyboardReportLayout{
+	KeyboardReport6KRO: newKeyboardReportLayout(bootKeyboardDescriptor),
+	KeyboardReportNKRO: newKeyboardReportLayout(nkroKeyboardDescriptor),
+}
+
+func (f KeyboardReportFormat) String() string {
+	switch f {
+	case KeyboardReport6KRO:
+		return "6kro"
+	case KeyboardReportNKRO:
+		return "nkro"
+	default:
+		return "unknown"
+	}
+}
+
+func (f KeyboardReportFormat) Length() int {
+	return keyboardReportLayouts[f].report.Length()
+}
+
+/*
+Encode builds the input report for the pressed keys. Modifier keys are set
+in the modifier byte.
+
+Report Structure for HID Keyboard:
+
+Byte 0: Modifier keys (bit flags)
+Byte 1: Reserved (always 0x00)
+Byte 2: Key code 1
+Byte 3: Key code 2
+Byte 4: Key code 3
+Byte 5: Key code 4
+Byte 6: Key code 5
+Byte 7: Key code 6
+
+More than six keys report ErrorRollOver in every key slot.
+
+Report Structure for NKRO HID Keyboard:
+
+Byte 0:     Modifier keys (bit flags)
+Byte 1-20:  One bit per key usage 0x00-0x9F, LSB first
+*/
+func (f KeyboardReportFormat) Encode(keys []Key) []byte {
+	layout := keyboardReportLayouts[f]
+	report := layout.report.New()
+	n := 0
+	for _, key := range keys {
+		if key.IsModifier() {
+			layout.modifiers.field.Put(report, layout.modifiers.index+int(key-KeyLeftCtrl), 1)
+			continue
+		}
+
+		if key == 0 {
+			continue
+		}
+
+		if layout.keys.Flags&hid.Variable != 0 {
+			if i, ok := layout.keys.Index(hid.ExtendedUsage(hid.PageKeyboard, uint16(key))); ok {
+				layout.keys.Put(report, i, 1)
+			}
+			continue
+		}
+
+		if n == layout.keys.Count {
+			for i := range layout.keys.Count {
+				layout.keys.Put(report, i, int32(hid.UsageKeyboardErrorRollOver))
+			}
+			break
+		}
+
+		layout.keys.Put(report, n, int32(key))
+		n++
+	}
+
+	return report
+}
+
+// configfsGadgets is where the USB gadget configuration is mounted.
+const configfsGadgets = "/sys/kernel/config/usb_gadget"
+
+// DetectKeyboardReportFormat looks up the configfs HID function backing
+// devicePath and picks the format matching its report length.
+func DetectKeyboardReportFormat(devicePath string) (KeyboardReportFormat, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(devicePath, &stat); err != nil {
+		return KeyboardReport6KRO, fmt.Errorf("failed to stat %s: %w", devicePath, err)
+	}
+
+	dev := fmt.Sprintf("%d:%d", unix.Major(stat.Rdev), unix.Minor(stat.Rdev))
+	functions, err := filepath.Glob(filepath.Join(configfsGadgets, "*", "functions", "hid.*"))
+	if err != nil {
+		return KeyboardReport6KRO, err
+	}
+
+	for _, function := range functions {
+		data, err := os.ReadFile(filepath.Join(function, "dev"))
+		if err != nil || strings.TrimSpace(string(data)) != dev {
+			continue
+		}
+
+		data, err = os.ReadFile(filepath.Join(function, "report_length"))
+		if err != nil {
+			return KeyboardReport6KRO, fmt.Errorf("failed to read report length of %s: %w", function, err)
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return KeyboardReport6KRO, fmt.Errorf("invalid report length of %s: %w", function, err)
+		}
+
+		switch length {
+		case KeyboardReport6KRO.Length():
+			return KeyboardReport6KRO, nil
+		case KeyboardReportNKRO.Length():
+			return KeyboardReportNKRO, nil
+		default:
+			return KeyboardReport6KRO, fmt.Errorf("unsupported keyboard report length %d of %s", length, function)
+		}
+	}
+
+	return KeyboardReport6KRO, fmt.Errorf("no gadget function found for %s", devicePath)
+}
@@ -6,7 +6,16 @@ package pkg
 type Key byte
 
 func (k Key) IsModifier() bool {
-	return k == ModLeftCtrl || k == ModLeftShift || k == ModLeftAlt || k == ModLeftGUI || k == ModRightCtrl || k == ModRightShift || k == ModRightAlt || k == ModRightGUI
+	return k >= KeyLeftCtrl && k <= KeyRightGUI
+}
+
+// Modifier returns the bit of the modifier byte for a modifier key usage.
+func (k Key) Modifier() Key {
+	if !k.IsModifier() {
+		return ModNone
+	}
+
+	return 1 << (k - KeyLeftCtrl)
 }
 
 // Letter keys
@@ -131,36 +140,49 @@ const (
 
 // Additional keys
 const (
-	KeyNonUSBackslashKey     = 0x64 // Non-US \ and |
-	KeyApplication       Key = 0x65 // Application (Windows Menu key)
-	KeyPower             Key = 0x66
-	KeyKPEqual           Key = 0x67 // Keypad =
-	KeyF13               Key = 0x68
-	KeyF14               Key = 0x69
-	KeyF15               Key = 0x6A
-	KeyF16               Key = 0x6B
-	KeyF17               Key = 0x6C
-	KeyF18               Key = 0x6D
-	KeyF19               Key = 0x6E
-	KeyF20               Key = 0x6F
-	KeyF21               Key = 0x70
-	KeyF22               Key = 0x71
-	KeyF23               Key = 0x72
-	KeyF24               Key = 0x73
-	KeyExecute           Key = 0x74
-	KeyHelp              Key = 0x75
-	KeyMenu              Key = 0x76
-	KeySelect            Key = 0x77
-	KeyStop              Key = 0x78
-	KeyAgain             Key = 0x79
-	KeyUndo              Key = 0x7A
-	KeyCut               Key = 0x7B
-	KeyCopy              Key = 0x7C
-	KeyPaste             Key = 0x7D
-	KeyFind              Key = 0x7E
-	KeyMute              Key = 0x7F
-	KeyVolumeUp          Key = 0x80
-	KeyVolumeDown        Key = 0x81
+	KeyNonUSBackslash Key = 0x64 // Non-US \ and |
+	KeyApplication    Key = 0x65 // Application (Windows Menu key)
+	KeyPower          Key = 0x66
+	KeyKPEqual        Key = 0x67 // Keypad =
+	KeyF13            Key = 0x68
+	KeyF14            Key = 0x69
+	KeyF15            Key = 0x6A
+	KeyF16            Key = 0x6B
+	KeyF17            Key = 0x6C
+	KeyF18            Key = 0x6D
+	KeyF19            Key = 0x6E
+	KeyF20            Key = 0x6F
+	KeyF21            Key = 0x70
+	KeyF22            Key = 0x71
+	KeyF23            Key = 0x72
+	KeyF24            Key = 0x73
+	KeyExecute        Key = 0x74
+	KeyHelp           Key = 0x75
+	KeyMenu           Key = 0x76
+	KeySelect         Key = 0x77
+	KeyStop           Key = 0x78
+	KeyAgain          Key = 0x79
+	KeyUndo           Key = 0x7A
+	KeyCut            Key = 0x7B
+	KeyCopy           Key = 0x7C
+	KeyPaste          Key = 0x7D
+	KeyFind           Key = 0x7E
+	KeyMute           Key = 0x7F
+	KeyVolumeUp       Key = 0x80
+	KeyVolumeDown     Key = 0x81
+)
+
+// Modifier key usages, sent as bits of the modifier byte rather than in the
+// key array
+const (
+	KeyLeftCtrl   Key = 0xE0
+	KeyLeftShift  Key = 0xE1
+	KeyLeftAlt    Key = 0xE2
+	KeyLeftGUI    Key = 0xE3
+	KeyRightCtrl  Key = 0xE4
+	KeyRightShift Key = 0xE5
+	KeyRightAlt   Key = 0xE6
+	KeyRightGUI   Key = 0xE7
 )
 
 // Modifier keys - these are NOT keycodes, they're bit flags for the modifier byte
@@ -178,13 +200,13 @@ const (
 
 // Convenience aliases
 const (
-	KeyCtrl    Key = ModLeftCtrl
-	KeyShift   Key = ModLeftShift
-	KeyAlt     Key = ModLeftAlt
-	KeySuper   Key = ModLeftGUI
-	KeyMeta    Key = ModLeftGUI
-	KeyCommand Key = ModLeftGUI
-	KeyOption  Key = ModLeftAlt
+	KeyCtrl    Key = KeyLeftCtrl
+	KeyShift   Key = KeyLeftShift
+	KeyAlt     Key = KeyLeftAlt
+	KeySuper   Key = KeyLeftGUI
+	KeyMeta    Key = KeyLeftGUI
+	KeyCommand Key = KeyLeftGUI
+	KeyOption  Key = KeyLeftAlt
 )
 
 type JSKeyCode string
@@ -233,6 +255,8 @@ var JSCodeToHID = map[JSKeyCode]Key{
 	"Slash":        KeySlash,      // /
 	"CapsLock":     KeyCapsLock,
 
+	"IntlBackslash": KeyNonUSBackslash, // ISO key left of Z
+
 	// Control keys
 	"PrintScreen": KeyPrintScreen,
 	"ScrollLock":  KeyScrollLock,
@@ -268,15 +292,15 @@ var JSCodeToHID = map[JSKeyCode]Key{
 	"NumpadDecimal":  KeyKPDot,   // .
 	"NumpadEqual":    KeyKPEqual, // =
 
-	// Modifier keys (these return 0 since they're handled as modifiers)
-	"ControlLeft":  KeyCtrl,
-	"ShiftLeft":    KeyShift,
-	"AltLeft":      KeyAlt,
-	"MetaLeft":     KeyMeta, // Windows/Command key
-	"ControlRight": KeyCtrl,
-	"ShiftRight":   KeyShift,
-	"AltRight":     KeyAlt,
-	"MetaRight":    KeyMeta,
+	// Modifier keys (sent as bits of the modifier byte)
+	"ControlLeft":  KeyLeftCtrl,
+	"ShiftLeft":    KeyLeftShift,
+	"AltLeft":      KeyLeftAlt,
+	"MetaLeft":     KeyLeftGUI, // Windows/Command key
+	"ControlRight": KeyRightCtrl,
+	"ShiftRight":   KeyRightShift,
+	"AltRight":     KeyRightAlt, // AltGr
+	"MetaRight":    KeyRightGUI,
 
 	// Additional keys
 	"ContextMenu":     KeyApplication, // Menu key
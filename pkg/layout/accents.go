@@ -0,0 +1,25 @@
+package layout
+
+// accents maps the base characters a dead key combines with to the result.
+var accents = map[string]map[rune]rune{
+	"acute": {
+		'a': 'á', 'e': 'é', 'i': 'í', 'o': 'ó', 'u': 'ú', 'y': 'ý',
+		'A': 'Á', 'E': 'É', 'I': 'Í', 'O': 'Ó', 'U': 'Ú', 'Y': 'Ý',
+	},
+	"grave": {
+		'a': 'à', 'e': 'è', 'i': 'ì', 'o': 'ò', 'u': 'ù',
+		'A': 'À', 'E': 'È', 'I': 'Ì', 'O': 'Ò', 'U': 'Ù',
+	},
+	"circumflex": {
+		'a': 'â', 'e': 'ê', 'i': 'î', 'o': 'ô', 'u': 'û',
+		'A': 'Â', 'E': 'Ê', 'I': 'Î', 'O': 'Ô', 'U': 'Û',
+	},
+	"diaeresis": {
+		'a': 'ä', 'e': 'ë', 'i': 'ï', 'o': 'ö', 'u': 'ü', 'y': 'ÿ',
+		'A': 'Ä', 'E': 'Ë', 'I': 'Ï', 'O': 'Ö', 'U': 'Ü',
+	},
+	"tilde": {
+		'a': 'ã', 'n': 'ñ', 'o': 'õ',
+		'A': 'Ã', 'N': 'Ñ', 'O': 'Õ',
+	},
+}
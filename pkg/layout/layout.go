@@ -0,0 +1,277 @@
+// Package layout translates characters to the keystrokes typing them on a
+// host configured with a given keyboard layout.
+package layout
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Modifier bits of the HID keyboard report.
+const (
+	ModShift uint8 = 0x02 // Left Shift
+	ModAltGr uint8 = 0x40 // Right Alt
+)
+
+// levels are the modifiers selecting each character of a key entry.
+var levels = []uint8{0, ModShift, ModAltGr, ModShift | ModAltGr}
+
+var (
+	ErrUnknownLayout = errors.New("unknown keyboard layout")
+	ErrUnknownAccent = errors.New("unknown dead key accent")
+)
+
+// Keystroke is a key, named by its KeyboardEvent.code, tapped while holding
+// Modifiers.
+type Keystroke struct {
+	Code      string
+	Modifiers uint8
+}
+
+/*
+File is the YAML form of a layout
+
+	name: de
+	description: German
+	keys:
+	  Digit2: ["2", "\"", "²"]   # base, shift, altgr, shift+altgr
+	dead_keys:
+	  - {key: Equal, level: 0, accent: acute}
+*/
+type File struct {
+	Name        string              `yaml:"name"`
+	Description string              `yaml:"description"`
+	Keys        map[string][]string `yaml:"keys"`
+	DeadKeys    []DeadKey           `yaml:"dead_keys"`
+}
+
+type DeadKey struct {
+	Key    string `yaml:"key"`
+	Level  int    `yaml:"level"`
+	Accent string `yaml:"accent"`
+}
+
+type Layout struct {
+	Name        string
+	Description string
+	chars       map[rune][]Keystroke
+}
+
+// Keystrokes returns the keystrokes typing r, which are two for characters
+// composed with a dead key.
+func (l *Layout) Keystrokes(r rune) ([]Keystroke, bool) {
+	keystrokes, exists := l.chars[r]
+	return keystrokes, exists
+}
+
+func Parse(data []byte) (*Layout, error) {
+	var file File
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse layout: %w", err)
+	}
+
+	return file.Layout()
+}
+
+// Layout resolves the character table of f. Characters reachable with a
+// single keystroke win over dead key compositions, and lower levels over
+// higher ones.
+func (f *File) Layout() (*Layout, error) {
+	if f.Name == "" {
+		return nil, errors.New("layout name must not be empty")
+	}
+
+	l := &Layout{
+		Name:        f.Name,
+		Description: f.Description,
+		chars:       make(map[rune][]Keystroke),
+	}
+
+	type deadKey struct {
+		keystroke Keystroke
+		accent    map[rune]rune
+	}
+
+	dead := make(map[Keystroke]bool, len(f.DeadKeys))
+	deadKeys := make([]deadKey, 0, len(f.DeadKeys))
+	for _, d := range f.DeadKeys {
+		if d.Level < 0 || d.Level >= len(levels) {
+			return nil, fmt.Errorf("%s: dead key %s has invalid level %d", f.Name, d.Key, d.Level)
+		}
+
+		accent, exists := accents[d.Accent]
+		if !exists {
+			return nil, fmt.Errorf("%s: %w %q", f.Name, ErrUnknownAccent, d.Accent)
+		}
+
+		keystroke := Keystroke{Code: d.Key, Modifiers: levels[d.Level]}
+		dead[keystroke] = true
+		deadKeys = append(deadKeys, deadKey{keystroke, accent})
+	}
+
+	codes := make([]string, 0, len(f.Keys))
+	for code, chars := range f.Keys {
+		if len(chars) > len(levels) {
+			return nil, fmt.Errorf("%s: key %s has more than %d levels", f.Name, code, len(levels))
+		}
+
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	// dead keys type their own character when followed by space, unless
+	// another key types it directly
+	deadOnly := make(map[rune]bool)
+	for level, modifiers := range levels {
+		for _, code := range codes {
+			chars := f.Keys[code]
+			if level >= len(chars) || chars[level] == "" {
+				continue
+			}
+
+			r, err := singleRune(chars[level])
+			if err != nil {
+				return nil, fmt.Errorf("%s: key %s level %d: %w", f.Name, code, level, err)
+			}
+
+			keystroke := Keystroke{Code: code, Modifiers: modifiers}
+			if dead[keystroke] {
+				if _, exists := l.chars[r]; !exists {
+					deadOnly[r] = true
+					l.chars[r] = []Keystroke{keystroke, {Code: "Space"}}
+				}
+				continue
+			}
+
+			if _, exists := l.chars[r]; !exists || deadOnly[r] {
+				delete(deadOnly, r)
+				l.chars[r] = []Keystroke{keystroke}
+			}
+		}
+	}
+
+	for r, code := range map[rune]string{' ': "Space", '\n': "Enter", '\t': "Tab"} {
+		if _, exists := l.chars[r]; !exists {
+			l.chars[r] = []Keystroke{{Code: code}}
+		}
+	}
+
+	for _, d := range deadKeys {
+		bases := make([]rune, 0, len(d.accent))
+		for base := range d.accent {
+			bases = append(bases, base)
+		}
+		slices.Sort(bases)
+
+		for _, base := range bases {
+			composed := d.accent[base]
+			baseKeystrokes, exists := l.chars[base]
+			if _, typable := l.chars[composed]; typable || !exists || len(baseKeystrokes) != 1 {
+				continue
+			}
+
+			l.chars[composed] = []Keystroke{d.keystroke, baseKeystrokes[0]}
+		}
+	}
+
+	return l, nil
+}
+
+func singleRune(s string) (rune, error) {
+	runes := []rune(s)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("%q is not a single character", s)
+	}
+
+	return runes[0], nil
+}
+
+//go:embed layouts/*.yaml
+var builtin embed.FS
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]*Layout)
+)
+
+func init() {
+	if err := loadFS(builtin, "layouts"); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds l, replacing any layout of the same name.
+func Register(l *Layout) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[l.Name] = l
+}
+
+func Get(name string) (*Layout, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	l, exists := registry[name]
+	if !exists {
+		return nil, fmt.Errorf("%w %q", ErrUnknownLayout, name)
+	}
+
+	return l, nil
+}
+
+func Names() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// LoadDir registers every *.yaml layout in dir. Layouts named like a built-in
+// one replace it.
+func LoadDir(dir string) error {
+	return loadFS(os.DirFS(dir), ".")
+}
+
+func loadFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return fmt.Errorf("failed to read layouts: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".yaml") {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read layout %s: %w", entry.Name(), err)
+		}
+
+		l, err := Parse(data)
+		if err != nil {
+			return fmt.Errorf("failed to load layout %s: %w", entry.Name(), err)
+		}
+
+		Register(l)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package layout
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestBuiltinLayouts(t *testing.T) {
+	tests := []struct {
+		layout string
+		char   rune
+		want   []Keystroke
+	}{
+		{layout: "de", char: 'z', want: []Keystroke{{Code: "KeyY"}}},
+		{layout: "de", char: '@', want: []Keystroke{{Code: "KeyQ", Modifiers: ModAltGr}}},
+		// lone accents are the dead key followed by space
+		{layout: "de", char: '^', want: []Keystroke{{Code: "Backquote"}, {Code: "Space"}}},
+		{layout: "de", char: '`', want: []Keystroke{{Code: "Equal", Modifiers: ModShift}, {Code: "Space"}}},
+		{layout: "de", char: 'ô', want: []Keystroke{{Code: "Backquote"}, {Code: "KeyO"}}},
+		{layout: "de", char: 'é', want: []Keystroke{{Code: "Equal"}, {Code: "KeyE"}}},
+		{layout: "de", char: 'É', want: []Keystroke{{Code: "Equal"}, {Code: "KeyE", Modifiers: ModShift}}},
+		{layout: "de", char: 'è', want: []Keystroke{{Code: "Equal", Modifiers: ModShift}, {Code: "KeyE"}}},
+		// a key typing the character directly beats the dead key
+		{layout: "fr", char: '^', want: []Keystroke{{Code: "Digit9", Modifiers: ModAltGr}}},
+		{layout: "fr", char: 'é', want: []Keystroke{{Code: "Digit2"}}},
+		{layout: "fr", char: 'à', want: []Keystroke{{Code: "Digit0"}}},
+		{layout: "fr", char: '`', want: []Keystroke{{Code: "Digit7", Modifiers: ModAltGr}, {Code: "Space"}}},
+		{layout: "fr", char: 'ô', want: []Keystroke{{Code: "BracketLeft"}, {Code: "KeyO"}}},
+		{layout: "fr", char: 'ë', want: []Keystroke{{Code: "BracketLeft", Modifiers: ModShift}, {Code: "KeyE"}}},
+		{layout: "fr", char: 'ñ', want: []Keystroke{{Code: "Digit2", Modifiers: ModAltGr}, {Code: "KeyN"}}},
+		{layout: "fr", char: 'Ô', want: []Keystroke{{Code: "BracketLeft"}, {Code: "KeyO", Modifiers: ModShift}}},
+	}
+
+	for _, test := range tests {
+		l, err := Get(test.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if keystrokes, ok := l.Keystrokes(test.char); !ok || !slices.Equal(keystrokes, test.want) {
+			t.Errorf("%s: Keystrokes(%q) = %v, %t, want %v", test.layout, test.char, keystrokes, ok, test.want)
+		}
+	}
+}
+
+func TestConflictingKeys(t *testing.T) {
+	l, err := Parse([]byte(`
+name: test
+keys:
+  KeyA: [a, A, x]
+  KeyB: [x, B]
+  KeyC: [c, C]
+  KeyD: [d, c]
+  KeyE: ["´"]
+  KeyF: [f, "´"]
+  KeyG: [g, G, á]
+  KeyH: [h, "!"]
+  KeyI: [i, "!"]
+  KeyO: [o, O]
+  KeyU: [u, U, "^"]
+dead_keys:
+  - {key: KeyE, level: 0, accent: acute}
+  - {key: KeyU, level: 2, accent: circumflex}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		char rune
+		want []Keystroke
+	}{
+		{name: "lower level", char: 'x', want: []Keystroke{{Code: "KeyB"}}},
+		{name: "lower level over a later key", char: 'c', want: []Keystroke{{Code: "KeyC"}}},
+		{name: "first key of a level", char: '!', want: []Keystroke{{Code: "KeyH", Modifiers: ModShift}}},
+		{name: "direct key over a lower dead key", char: '´', want: []Keystroke{{Code: "KeyF", Modifiers: ModShift}}},
+		{name: "dead key and space", char: '^', want: []Keystroke{{Code: "KeyU", Modifiers: ModAltGr}, {Code: "Space"}}},
+		{name: "direct key over a composition", char: 'á', want: []Keystroke{{Code: "KeyG", Modifiers: ModAltGr}}},
+		{name: "composition", char: 'Á', want: []Keystroke{{Code: "KeyE"}, {Code: "KeyA", Modifiers: ModShift}}},
+		{name: "composition at a higher level", char: 'ô', want: []Keystroke{{Code: "KeyU", Modifiers: ModAltGr}, {Code: "KeyO"}}},
+		{name: "implicit space", char: ' ', want: []Keystroke{{Code: "Space"}}},
+	}
+
+	for _, test := range tests {
+		if keystrokes, ok := l.Keystrokes(test.char); !ok || !slices.Equal(keystrokes, test.want) {
+			t.Errorf("%s: Keystrokes(%q) = %v, %t, want %v", test.name, test.char, keystrokes, ok, test.want)
+		}
+	}
+
+	// no composition without a key for its base
+	if keystrokes, ok := l.Keystrokes('ý'); ok {
+		t.Errorf("Keystrokes('ý') = %v, want none", keystrokes)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want error
+	}{
+		{name: "no name", yaml: "keys: {KeyA: [a]}"},
+		{name: "unknown field", yaml: "name: x\nkeyz: {}"},
+		{name: "two characters", yaml: "name: x\nkeys: {KeyA: [ab]}"},
+		{name: "five levels", yaml: "name: x\nkeys: {KeyA: [a, b, c, d, e]}"},
+		{name: "dead key level", yaml: "name: x\ndead_keys: [{key: KeyA, level: 4, accent: acute}]"},
+		{name: "unknown accent", yaml: "name: x\ndead_keys: [{key: KeyA, level: 0, accent: ring}]", want: ErrUnknownAccent},
+	}
+
+	for _, test := range tests {
+		if _, err := Parse([]byte(test.yaml)); err == nil || test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: Parse = %v, want an error", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"mini-kvm/pkg/auth"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token     string    `json:"token"`
+	User      string    `json:"user"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (h *HttpHandler) loginHandler(res http.ResponseWriter, req *http.Request) {
+	h.setCORSHeaders(res, req, "POST")
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeMethodNotAllowed(res, "POST, OPTIONS")
+		return
+	}
+
+	if h.authenticator == nil {
+		writeProblem(res, http.StatusNotFound, "authentication is disabled")
+		return
+	}
+
+	var credentials loginRequest
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, 4096)).Decode(&credentials); err != nil {
+		writeProblem(res, http.StatusBadRequest, "invalid login request")
+		return
+	}
+
+	token, session, err := h.authenticator.Login(credentials.Username, credentials.Password)
+	if err != nil {
+		if !errors.Is(err, auth.ErrInvalidCredentials) {
+			log.Error().Err(err).Msg("failed to create session")
+			writeProblem(res, http.StatusInternalServerError, "failed to create session")
+			return
+		}
+
+		log.Warn().Str("user", credentials.Username).Str("remote", req.RemoteAddr).Msg("failed login")
+		res.Header().Set("WWW-Authenticate", `Bearer realm="mini-kvm"`)
+		writeProblem(res, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	log.Info().Str("user", session.User).Str("remote", req.RemoteAddr).Msg("logged in")
+	http.SetCookie(res, &http.Cookie{
+		Name:     auth.CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(res).Encode(loginResponse{
+		Token:     token,
+		User:      session.User,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+func (h *HttpHandler) logoutHandler(res http.ResponseWriter, req *http.Request) {
+	h.setCORSHeaders(res, req, "POST")
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeMethodNotAllowed(res, "POST, OPTIONS")
+		return
+	}
+
+	// copies of the token, such as a bearer token handed to a script, stop
+	// working as well
+	if h.authenticator != nil {
+		if session, err := h.authenticator.Authenticate(req); err == nil {
+			h.authenticator.Logout(session.User)
+			log.Info().Str("user", session.User).Str("remote", req.RemoteAddr).Msg("logged out")
+		}
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     auth.CookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	res.WriteHeader(http.StatusNoContent)
+}
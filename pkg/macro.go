@@ -0,0 +1,422 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/config"
+	"mini-kvm/pkg/protocol"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrMacroNotFound = errors.New("macro not found")
+	ErrMacroRunning  = errors.New("a macro is already running")
+	ErrMacroBuiltin  = errors.New("built-in macros cannot be changed")
+	ErrInvalidMacro  = errors.New("invalid macro")
+	ErrNotRecording  = errors.New("no macro is being recorded")
+)
+
+const (
+	// macroClient owns the keys pressed by macros, they are released when
+	// the macro ends.
+	macroClient = "macro"
+	// minRecordedWait drops the pauses between recorded key events which are
+	// too short to matter.
+	minRecordedWait = 10 * time.Millisecond
+)
+
+// builtinMacros are the key combinations browsers and operating systems
+// catch before the page sees them, and the hotkeys of common firmware.
+var builtinMacros = func() []config.Macro {
+	macros := []config.Macro{
+		tapMacro("ctrl-alt-del", "ControlLeft", "AltLeft", "Delete"),
+		tapMacro("ctrl-alt-backspace", "ControlLeft", "AltLeft", "Backspace"),
+		tapMacro("ctrl-shift-esc", "ControlLeft", "ShiftLeft", "Escape"),
+		tapMacro("alt-tab", "AltLeft", "Tab"),
+		tapMacro("alt-f4", "AltLeft", "F4"),
+		tapMacro("meta", "MetaLeft"),
+		tapMacro("meta-l", "MetaLeft", "KeyL"),
+		tapMacro("print-screen", "PrintScreen"),
+		{
+			// safely reboots a hung Linux kernel, the pauses give each
+			// request time to finish
+			Name: "alt-sysrq-reisub",
+			Steps: []config.MacroStep{
+				{Down: []string{"AltLeft", "PrintScreen"}},
+				{Tap: []string{"KeyR"}}, {Wait: time.Second},
+				{Tap: []string{"KeyE"}}, {Wait: 2 * time.Second},
+				{Tap: []string{"KeyI"}}, {Wait: 2 * time.Second},
+				{Tap: []string{"KeyS"}}, {Wait: 2 * time.Second},
+				{Tap: []string{"KeyU"}}, {Wait: 2 * time.Second},
+				{Tap: []string{"KeyB"}},
+				{Up: []string{"PrintScreen", "AltLeft"}},
+			},
+		},
+	}
+
+	for i := 1; i <= 12; i++ {
+		macros = append(macros, tapMacro(fmt.Sprintf("ctrl-alt-f%d", i), "ControlLeft", "AltLeft", fmt.Sprintf("F%d", i)))
+	}
+
+	// firmware only looks for its setup and boot menu keys for a moment
+	// during POST, so they are tapped for a few seconds
+	for _, key := range []string{"Delete", "F1", "F2", "F8", "F9", "F10", "F11", "F12", "Escape"} {
+		steps := make([]config.MacroStep, 0, 40)
+		for range 20 {
+			steps = append(steps, config.MacroStep{Tap: []string{key}}, config.MacroStep{Wait: 250 * time.Millisecond})
+		}
+
+		macros = append(macros, config.Macro{Name: "boot-" + strings.ToLower(key), Steps: steps})
+	}
+
+	return macros
+}()
+
+func tapMacro(name string, keys ...string) config.Macro {
+	return config.Macro{Name: name, Steps: []config.MacroStep{{Tap: keys}}}
+}
+
+// macroStore holds the macros added in the config or through the API.
+type macroStore struct {
+	mutex  sync.Mutex
+	macros []config.Macro
+}
+
+// macroRunState is the single macro running on the keyboard.
+type macroRunState struct {
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+}
+
+// validateMacro checks macro including its key codes.
+func validateMacro(macro config.Macro) error {
+	if err := macro.Validate(); err != nil {
+		return err
+	}
+
+	for i, step := range macro.Steps {
+		for _, keys := range [][]string{step.Down, step.Up, step.Tap} {
+			for _, key := range keys {
+				if _, exists := JSCodeToHID[JSKeyCode(key)]; !exists && !IsConsumerKey(JSKeyCode(key)) {
+					return fmt.Errorf("step %d of macro %s: unknown key %q", i, macro.Name, key)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func findBuiltinMacro(name string) (config.Macro, bool) {
+	index := slices.IndexFunc(builtinMacros, func(m config.Macro) bool { return m.Name == name })
+	if index < 0 {
+		return config.Macro{}, false
+	}
+
+	return builtinMacros[index], true
+}
+
+// Macro returns the built-in or added macro with the given name.
+func (s *Server) Macro(name string) (config.Macro, error) {
+	if macro, exists := findBuiltinMacro(name); exists {
+		return macro, nil
+	}
+
+	s.macros.mutex.Lock()
+	defer s.macros.mutex.Unlock()
+	index := slices.IndexFunc(s.macros.macros, func(m config.Macro) bool { return m.Name == name })
+	if index < 0 {
+		return config.Macro{}, ErrMacroNotFound
+	}
+
+	return s.macros.macros[index], nil
+}
+
+// Macros lists the built-in macros followed by the added ones.
+func (s *Server) Macros() *protocol.Macros {
+	s.macros.mutex.Lock()
+	defer s.macros.mutex.Unlock()
+	msg := &protocol.Macros{Macros: make([]protocol.Macro, 0, len(builtinMacros)+len(s.macros.macros))}
+	for _, macro := range builtinMacros {
+		protocolMacro := toProtocolMacro(macro)
+		protocolMacro.Builtin = true
+		msg.Macros = append(msg.Macros, protocolMacro)
+	}
+
+	for _, macro := range s.macros.macros {
+		msg.Macros = append(msg.Macros, toProtocolMacro(macro))
+	}
+
+	return msg
+}
+
+// SaveMacro adds macro or replaces the added macro of the same name, saves
+// the macros to the config file and tells every client. It reports whether
+// the macro was new.
+func (s *Server) SaveMacro(macro config.Macro) (bool, error) {
+	if _, exists := findBuiltinMacro(macro.Name); exists {
+		return false, ErrMacroBuiltin
+	}
+
+	if err := validateMacro(macro); err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidMacro, err)
+	}
+
+	return s.updateMacros(func(macros []config.Macro) ([]config.Macro, bool, error) {
+		index := slices.IndexFunc(macros, func(m config.Macro) bool { return m.Name == macro.Name })
+		if index < 0 {
+			return append(macros, macro), true, nil
+		}
+
+		macros[index] = macro
+		return macros, false, nil
+	})
+}
+
+// DeleteMacro removes an added macro.
+func (s *Server) DeleteMacro(name string) error {
+	if _, exists := findBuiltinMacro(name); exists {
+		return ErrMacroBuiltin
+	}
+
+	_, err := s.updateMacros(func(macros []config.Macro) ([]config.Macro, bool, error) {
+		index := slices.IndexFunc(macros, func(m config.Macro) bool { return m.Name == name })
+		if index < 0 {
+			return nil, false, ErrMacroNotFound
+		}
+
+		return slices.Delete(macros, index, index+1), false, nil
+	})
+	return err
+}
+
+func (s *Server) updateMacros(update func(macros []config.Macro) ([]config.Macro, bool, error)) (bool, error) {
+	s.macros.mutex.Lock()
+	macros, created, err := update(slices.Clone(s.macros.macros))
+	if err != nil {
+		s.macros.mutex.Unlock()
+		return false, err
+	}
+
+	s.macros.macros = macros
+	s.macros.mutex.Unlock()
+
+	s.Broadcast(s.Macros())
+	if s.configPath == "" {
+		log.Warn().Msg("running without a config file, macros are lost on restart")
+		return created, nil
+	}
+
+	if err := config.SaveMacros(s.configPath, macros); err != nil {
+		return created, fmt.Errorf("failed to save macros: %w", err)
+	}
+
+	return created, nil
+}
+
+// RunMacro plays the named macro in the background. onDone, when not nil, is
+// called once the macro has finished.
+func (s *Server) RunMacro(name string, onDone func(err error)) error {
+	macro, err := s.Macro(name)
+	if err != nil {
+		return err
+	}
+
+	if s.inputPaused() {
+		return ErrHostSuspended
+	}
+
+	unlock := s.lockKeyboardJobs()
+	if s.typing.progress.Running {
+		unlock()
+		return ErrTypingInProgress
+	}
+
+	if s.macroRun.cancel != nil {
+		unlock()
+		return ErrMacroRunning
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.macroRun.cancel = cancel
+	unlock()
+
+	go func() {
+		err := s.playMacro(ctx, macro)
+		cancel()
+		s.macroRun.mutex.Lock()
+		s.macroRun.cancel = nil
+		s.macroRun.mutex.Unlock()
+
+		if err != nil {
+			log.Error().Err(err).Str("macro", name).Msg("macro stopped")
+		}
+
+		if onDone != nil {
+			onDone(err)
+		}
+	}()
+
+	return nil
+}
+
+// lockKeyboardJobs locks the state of typing and of macros together, so that
+// only one of them can start on the keyboard. It returns the unlock
+// function.
+func (s *Server) lockKeyboardJobs() func() {
+	s.typing.mutex.Lock()
+	s.macroRun.mutex.Lock()
+	return func() {
+		s.macroRun.mutex.Unlock()
+		s.typing.mutex.Unlock()
+	}
+}
+
+// CancelMacro stops the running macro, reporting whether one was running.
+func (s *Server) CancelMacro() bool {
+	s.macroRun.mutex.Lock()
+	defer s.macroRun.mutex.Unlock()
+	if s.macroRun.cancel == nil {
+		return false
+	}
+
+	s.macroRun.cancel()
+	return true
+}
+
+func (s *Server) playMacro(ctx context.Context, macro config.Macro) error {
+	// keys left down by the macro or by cancelling it are released through
+	// the same channels, so that the release can't overtake the presses
+	down := make(map[JSKeyCode]bool)
+	press := func(key string, isDown bool) {
+		down[JSKeyCode(key)] = isDown
+		s.sendKey(KeyPressEvent{KeyCode: JSKeyCode(key), IsDown: isDown, client: macroClient})
+	}
+	defer func() {
+		for key, isDown := range down {
+			if isDown {
+				s.sendKey(KeyPressEvent{KeyCode: key, IsDown: false, client: macroClient})
+			}
+		}
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	wait := func(d time.Duration) error {
+		timer.Reset(d)
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, step := range macro.Steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		switch {
+		case step.Wait > 0:
+			if err := wait(step.Wait); err != nil {
+				return err
+			}
+		case len(step.Down) > 0:
+			for _, key := range step.Down {
+				press(key, true)
+			}
+		case len(step.Up) > 0:
+			for _, key := range step.Up {
+				press(key, false)
+			}
+		case len(step.Tap) > 0:
+			for _, key := range step.Tap {
+				press(key, true)
+			}
+
+			for _, key := range slices.Backward(step.Tap) {
+				press(key, false)
+			}
+
+			if err := wait(s.typeDelay); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendKey routes a key event to the device sending its usage.
+func (s *Server) sendKey(k KeyPressEvent) {
+	if s.consumerController != nil && IsConsumerKey(k.KeyCode) {
+		s.consumerController.EventChan() <- k
+		return
+	}
+
+	s.keyboardController.EventChan() <- k
+}
+
+// macroRecorder turns the key events of a client into macro steps.
+type macroRecorder struct {
+	mutex sync.Mutex
+	steps []config.MacroStep
+	last  time.Time
+	// waited sums the recorded waits, which a macro bounds in total
+	waited time.Duration
+}
+
+func (r *macroRecorder) record(k KeyPressEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.steps) >= config.MaxMacroSteps-1 {
+		return
+	}
+
+	now := time.Now()
+	if gap := now.Sub(r.last).Round(time.Millisecond); !r.last.IsZero() && gap >= minRecordedWait {
+		if wait := min(gap, config.MaxMacroDuration-r.waited); wait > 0 {
+			r.steps = append(r.steps, config.MacroStep{Wait: wait})
+			r.waited += wait
+		}
+	}
+	r.last = now
+
+	if k.IsDown {
+		r.steps = append(r.steps, config.MacroStep{Down: []string{string(k.KeyCode)}})
+	} else {
+		r.steps = append(r.steps, config.MacroStep{Up: []string{string(k.KeyCode)}})
+	}
+}
+
+func (r *macroRecorder) macro(name string) config.Macro {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return config.Macro{Name: name, Steps: slices.Clone(r.steps)}
+}
+
+func toProtocolMacro(macro config.Macro) protocol.Macro {
+	steps := make([]protocol.MacroStep, 0, len(macro.Steps))
+	for _, step := range macro.Steps {
+		steps = append(steps, protocol.MacroStep{Down: step.Down, Up: step.Up, Tap: step.Tap, Wait: step.Wait.Milliseconds()})
+	}
+
+	return protocol.Macro{Name: macro.Name, Steps: steps}
+}
+
+func fromProtocolMacro(macro protocol.Macro) config.Macro {
+	steps := make([]config.MacroStep, 0, len(macro.Steps))
+	for _, step := range macro.Steps {
+		steps = append(steps, config.MacroStep{Down: step.Down, Up: step.Up, Tap: step.Tap, Wait: time.Duration(step.Wait) * time.Millisecond})
+	}
+
+	return config.Macro{Name: macro.Name, Steps: steps}
+}
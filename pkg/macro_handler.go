@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"mini-kvm/pkg/auth"
+	"mini-kvm/pkg/protocol"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxMacroSize limits the macro sent by a single request.
+const maxMacroSize = 256 << 10
+
+type macroRequest struct {
+	Steps []protocol.MacroStep `json:"steps"`
+}
+
+/*
+macrosHandler lists, changes and runs macros
+
+	GET    /macros                                                  built-in and added macros
+	GET    /macros/{name}                                           a single macro
+	PUT    /macros/{name}      {"steps": [{"tap": ["KeyA"]}, ...]}  adds or replaces a macro, 201 or 204
+	DELETE /macros/{name}                                           removes an added macro, 204
+	POST   /macros/{name}/run                                       starts the macro, 202
+*/
+func (h *HttpHandler) macrosHandler(res http.ResponseWriter, req *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/macros"), "/"), "/")
+	methods := "GET"
+	switch {
+	case name != "" && action == "run":
+		methods = "POST"
+	case name != "" && action == "":
+		methods = "GET, PUT, DELETE"
+	case name != "" || action != "":
+		http.NotFound(res, req)
+		return
+	}
+
+	h.setCORSHeaders(res, req, methods)
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	req, ok := h.authenticate(res, req)
+	if !ok {
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodGet && name == "":
+		writeJSON(res, http.StatusOK, h.server.Macros())
+	case req.Method == http.MethodGet && action == "":
+		macro, err := h.server.Macro(name)
+		if err != nil {
+			writeProblem(res, http.StatusNotFound, err.Error())
+			return
+		}
+
+		protocolMacro := toProtocolMacro(macro)
+		_, protocolMacro.Builtin = findBuiltinMacro(name)
+		writeJSON(res, http.StatusOK, protocolMacro)
+	case req.Method == http.MethodPut && action == "":
+		h.handleMacroPut(res, req, name)
+	case req.Method == http.MethodDelete && action == "":
+		if !h.isAdmin(res, req, "change macros") {
+			return
+		}
+
+		if err := h.server.DeleteMacro(name); err != nil {
+			writeMacroError(res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPost && action == "run":
+		if !h.mayType(res, req) {
+			return
+		}
+
+		if err := h.server.RunMacro(name, nil); err != nil {
+			writeMacroError(res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusAccepted)
+	default:
+		writeMethodNotAllowed(res, methods+", OPTIONS")
+	}
+}
+
+func (h *HttpHandler) handleMacroPut(res http.ResponseWriter, req *http.Request, name string) {
+	if !hasContentType(req, "application/json") {
+		writeProblem(res, http.StatusUnsupportedMediaType, "macro must be sent as application/json")
+		return
+	}
+
+	if !h.isAdmin(res, req, "change macros") {
+		return
+	}
+
+	var body macroRequest
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxMacroSize)).Decode(&body); err != nil {
+		writeProblem(res, http.StatusBadRequest, "invalid macro")
+		return
+	}
+
+	created, err := h.server.SaveMacro(fromProtocolMacro(protocol.Macro{Name: name, Steps: body.Steps}))
+	if err != nil {
+		writeMacroError(res, err)
+		return
+	}
+
+	if created {
+		res.Header().Set("Location", "/macros/"+name)
+		res.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// isAdmin answers 403 and returns false when the session of req may not do
+// action, such as changing the configuration.
+func (h *HttpHandler) isAdmin(res http.ResponseWriter, req *http.Request, action string) bool {
+	if session, ok := auth.SessionFromContext(req.Context()); ok && !session.Admin {
+		writeProblem(res, http.StatusForbidden, "only admins can "+action)
+		return false
+	}
+
+	return true
+}
+
+func writeMacroError(res http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrMacroNotFound):
+		writeProblem(res, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrMacroBuiltin):
+		writeProblem(res, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrMacroRunning), errors.Is(err, ErrTypingInProgress), errors.Is(err, ErrHostSuspended):
+		writeProblem(res, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidMacro):
+		writeProblem(res, http.StatusUnprocessableEntity, err.Error())
+	default:
+		log.Error().Err(err).Msg("failed to change macros")
+		writeProblem(res, http.StatusInternalServerError, "failed to change macros")
+	}
+}
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"mini-kvm/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestMacroRecorderBoundsWaits(t *testing.T) {
+	var recorder macroRecorder
+	for i := range 6 {
+		recorder.record(KeyPressEvent{KeyCode: "KeyA", IsDown: i%2 == 0})
+		// each pause is shorter than the bound, all of them together longer
+		recorder.mutex.Lock()
+		recorder.last = recorder.last.Add(-2 * time.Minute)
+		recorder.mutex.Unlock()
+	}
+
+	macro := recorder.macro("slow")
+	if err := macro.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var waited time.Duration
+	for _, step := range macro.Steps {
+		waited += step.Wait
+	}
+
+	if waited != config.MaxMacroDuration {
+		t.Errorf("waited %s, want %s", waited, config.MaxMacroDuration)
+	}
+
+	// waits are dropped once the bound is reached, keys are not
+	if len(macro.Steps) != 6+3 {
+		t.Errorf("%d steps, want 9: %+v", len(macro.Steps), macro.Steps)
+	}
+}
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"mini-kvm/pkg/config"
+	"mini-kvm/pkg/protocol"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+/*
+mediaHandler shows and changes the image attached to the mass storage drive
+
+	GET    /media                                                             the attached image
+	PUT    /media {"image": "debian.iso", "cdrom": true, "read_only": true}   attaches an image, 204
+	DELETE /media                                                             detaches the image, 204
+*/
+func (h *HttpHandler) mediaHandler(res http.ResponseWriter, req *http.Request) {
+	h.setCORSHeaders(res, req, "GET, PUT, DELETE")
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	req, ok := h.authenticate(res, req)
+	if !ok {
+		return
+	}
+
+	if h.server.virtualMedia == nil {
+		writeMediaError(res, ErrMassStorageDisabled)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(res, http.StatusOK, toProtocolMedia(h.server.virtualMedia.Medium()))
+	case http.MethodPut:
+		if !hasContentType(req, "application/json") {
+			writeProblem(res, http.StatusUnsupportedMediaType, "medium must be sent as application/json")
+			return
+		}
+
+		if !h.mayType(res, req) {
+			return
+		}
+
+		var body protocol.Media
+		if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxBodySize)).Decode(&body); err != nil || body.Image == "" {
+			writeProblem(res, http.StatusBadRequest, "invalid medium")
+			return
+		}
+
+		if err := h.server.AttachMedium(config.Medium{Image: body.Image, CDROM: body.CDROM, ReadOnly: body.ReadOnly}); err != nil {
+			writeMediaError(res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !h.mayType(res, req) {
+			return
+		}
+
+		if err := h.server.AttachMedium(config.Medium{}); err != nil {
+			writeMediaError(res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(res, "GET, PUT, DELETE, OPTIONS")
+	}
+}
+
+func writeMediaError(res http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrMassStorageDisabled), errors.Is(err, ErrImageNotFound):
+		writeProblem(res, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrImageExists), errors.Is(err, ErrImageBusy), errors.Is(err, ErrImageAttached),
+		errors.Is(err, ErrUploadSize), errors.Is(err, ErrUploadOffset):
+		writeProblem(res, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidImageName), errors.Is(err, ErrInvalidDigest), errors.Is(err, ErrInvalidImageURL),
+		errors.Is(err, ErrDigestMismatch):
+		writeProblem(res, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, ErrNoSpace):
+		writeProblem(res, http.StatusInsufficientStorage, err.Error())
+	default:
+		log.Error().Err(err).Msg("failed to change virtual media")
+		writeProblem(res, http.StatusInternalServerError, "failed to change virtual media")
+	}
+}
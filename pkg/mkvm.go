@@ -4,8 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"mini-kvm/pkg/auth"
+	"mini-kvm/pkg/config"
+	"mini-kvm/pkg/gadget"
 	"mini-kvm/pkg/gstreamer"
+	"mini-kvm/pkg/layout"
+	"mini-kvm/pkg/tlscert"
+	"net"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -14,78 +21,280 @@ import (
 	"github.com/pion/webrtc/v4/pkg/media"
 )
 
-var httpServer = &http.Server{
-	Addr:         ":8080",
-	ReadTimeout:  10 * time.Second,
-	WriteTimeout: 10 * time.Second,
-	IdleTimeout:  60 * time.Second,
-}
+// captureRetryInterval is how long to wait before reopening a failed capture
+// device, e.g. after the HDMI grabber was unplugged.
+const captureRetryInterval = 3 * time.Second
+
+func Run(ctx context.Context, cfg *config.Config) error {
+	httpServer := &http.Server{
+		Addr:         cfg.Listen,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	if cfg.HID.LayoutsDir != "" {
+		if err := layout.LoadDir(cfg.HID.LayoutsDir); err != nil {
+			return fmt.Errorf("failed to start: %w", err)
+		}
+	}
+
+	gadgetManager := gadget.NewManager("/")
+	var virtualMedia *VirtualMedia
+	var usbLink *USBLink
+	if cfg.Gadget.Enabled {
+		if err := SetupGadget(gadgetManager, cfg); err != nil {
+			return fmt.Errorf("failed to start: %w", err)
+		}
+
+		usbLink = NewUSBLink(gadgetManager, cfg.Gadget.Name, cfg.Gadget.UDC)
+		if slices.Contains(cfg.Gadget.Functions, "mass_storage") {
+			images, err := NewImageLibrary(cfg.MassStorage.ImagesDir)
+			if err != nil {
+				return fmt.Errorf("failed to start: %w", err)
+			}
+
+			virtualMedia = NewVirtualMedia(gadgetManager, cfg.Gadget.Name, images)
+		}
+	} else if udcs, err := gadgetManager.UDCs(); err != nil {
+		log.Warn().Err(err).Msg("failed to find the usb device controller, its state is not watched")
+	} else if cfg.Gadget.UDC != "" || len(udcs) > 0 {
+		// the state and remote wakeup of the gadget set up by another tool
+		// still work through its controller
+		udc := cfg.Gadget.UDC
+		if udc == "" {
+			udc = udcs[0]
+		}
+
+		usbLink = NewUSBLink(gadgetManager, "", udc)
+	}
 
-func Run(ctx context.Context) error {
 	inputChan := make(chan *gst.Buffer, 30)
 	outputChan := make(chan *media.Sample, 100)
 	captureSettings := gstreamer.V4L2CaptureSettings{
 		VideoCaptureSettings: gstreamer.VideoCaptureSettings{
-			Width:     1920,
-			Height:    1080,
-			Framerate: 30,
+			Width:     cfg.Video.Width,
+			Height:    cfg.Video.Height,
+			Framerate: cfg.Video.Framerate,
 		},
-		Mode:   gstreamer.VideoCaptureModeMJPEG,
-		Device: "/dev/video0",
+		Mode:   cfg.Video.Mode,
+		Device: cfg.Video.Device,
 	}
-	videoCapture, err := gstreamer.NewV4L2Capturer(captureSettings)
+	videoEncoder, err := gstreamer.NewVideoEncoder(gstreamer.VideoEncoderSettings{
+		Name:           "out",
+		EncoderType:    cfg.Video.Encoder,
+		Width:          captureSettings.Width,
+		Height:         captureSettings.Height,
+		Framerate:      captureSettings.Framerate,
+		Bitrate:        cfg.Video.Bitrate,
+		EncoderOptions: cfg.Video.EncoderOptions,
+	}, captureSettings.VideoCaptureSettings, inputChan, outputChan)
 	if err != nil {
 		return fmt.Errorf("failed to start: %w", err)
 	}
 
-	videoEncoder, err := gstreamer.NewVideoEncoder(gstreamer.VideoEncoderSettings{
-		Name:        "out",
-		EncoderType: gstreamer.EncoderTypeHEVC_MPP,
-		Width:       captureSettings.Width,
-		Height:      captureSettings.Height,
-		Framerate:   captureSettings.Framerate,
-		Bitrate:     2_000_000,
-		EncoderOptions: map[string]string{
-			"rc-mode":     "vbr",
-			"max-pending": "4",
-			"header-mode": "each-idr",
-			"gop":         "60",
-		},
-	}, captureSettings.VideoCaptureSettings, inputChan, outputChan)
+	server, err := NewServer(ctx, cfg, outputChan, videoEncoder, virtualMedia, usbLink)
 	if err != nil {
 		return fmt.Errorf("failed to start: %w", err)
 	}
 
-	videoCapture.AddEncoder(videoEncoder)
-	if err := videoCapture.Start(); err != nil {
+	captureFailed := make(chan error, 1)
+	startCapture := func() (*gstreamer.V4L2Capturer, error) {
+		videoCapture, err := gstreamer.NewV4L2Capturer(captureSettings)
+		if err != nil {
+			return nil, err
+		}
+
+		videoCapture.SetOnFailureHandler(func(err error) {
+			select {
+			case captureFailed <- err:
+			default:
+			}
+		})
+		videoCapture.AddEncoder(videoEncoder)
+		if err := videoCapture.Start(); err != nil {
+			return nil, err
+		}
+
+		return videoCapture, nil
+	}
+
+	videoCapture, err := startCapture()
+	if err != nil {
 		return fmt.Errorf("failed to start: %w", err)
 	}
 
 	videoEncoder.Start()
-	server, err := NewServer(ctx, outputChan)
+	server.SetVideoCapture(videoCapture)
+	server.SetMediaAvailable(true)
+
+	webHandler, err := NewWebHandler(cfg.Web.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to start: %w", err)
+	}
 
 	httpHandler := HttpHandler{
-		server: server,
+		server:      server,
+		corsOrigins: cfg.CORSOrigins,
+	}
+	if cfg.Auth.Disabled {
+		log.Warn().Msg("authentication is disabled, anyone who can reach the server controls the target")
+	} else {
+		users := make([]auth.User, 0, len(cfg.Auth.Users))
+		for _, user := range cfg.Auth.Users {
+			users = append(users, auth.User{Name: user.Name, PasswordHash: []byte(user.PasswordHash), Admin: user.Admin})
+		}
+
+		// a fresh install has no users yet, it is still reachable without
+		// disabling authentication
+		if len(users) == 0 {
+			password, err := auth.InitialPassword(cfg.Auth.InitialPasswordFile)
+			if err != nil {
+				return fmt.Errorf("failed to start: %w", err)
+			}
+
+			hash, err := auth.HashPassword(password)
+			if err != nil {
+				return fmt.Errorf("failed to start: %w", err)
+			}
+
+			users = append(users, auth.User{Name: "admin", PasswordHash: []byte(hash), Admin: true})
+			log.Warn().Str("user", "admin").Str("password_file", cfg.Auth.InitialPasswordFile).Msg("auth.users is empty, log in with the password in the file until users are configured")
+		}
+
+		if cfg.Auth.Secret == "" {
+			log.Warn().Msg("auth.secret is not set, sessions will not survive a restart")
+		}
+
+		httpHandler.authenticator, err = auth.NewAuthenticator([]byte(cfg.Auth.Secret), cfg.Auth.SessionTTL, users...)
+		if err != nil {
+			return fmt.Errorf("failed to start: %w", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect", httpHandler.whepHandler)
+	mux.HandleFunc("/login", httpHandler.loginHandler)
+	mux.HandleFunc("/logout", httpHandler.logoutHandler)
+	mux.HandleFunc("/type", httpHandler.typeHandler)
+	mux.HandleFunc("/macros", httpHandler.macrosHandler)
+	mux.HandleFunc("/macros/", httpHandler.macrosHandler)
+	mux.HandleFunc("/media", httpHandler.mediaHandler)
+	mux.HandleFunc("/images", httpHandler.imagesHandler)
+	mux.HandleFunc("/images/", httpHandler.imagesHandler)
+	mux.HandleFunc("/usb", httpHandler.usbHandler)
+	mux.HandleFunc("/usb/", httpHandler.usbHandler)
+	mux.Handle("/", webHandler)
+	httpServer.Handler = mux
+
+	var redirectServer *http.Server
+	if cfg.TLS.Enabled {
+		if cfg.TLS.SelfSigned {
+			if err := tlscert.EnsureSelfSigned(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.Hosts); err != nil {
+				return fmt.Errorf("failed to start: %w", err)
+			}
+		}
+
+		if cfg.TLS.RedirectHTTP != "" {
+			redirectServer = &http.Server{
+				Addr:         cfg.TLS.RedirectHTTP,
+				Handler:      httpsRedirectHandler(cfg.Listen),
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: 10 * time.Second,
+			}
+
+			go func() {
+				log.Printf("HTTPS redirect starting on %s\n", redirectServer.Addr)
+				if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Fatal().Err(err).Msg("failed to start redirect server")
+				}
+			}()
+		}
 	}
-	http.HandleFunc("/connect", httpHandler.whepHandler)
 
 	go func() {
 		log.Printf("Server starting on %s\n", httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if cfg.TLS.Enabled {
+			err = httpServer.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("failed to start server")
 		}
 	}()
 
+	var captureRetry <-chan time.Time
 	for {
 		select {
-		case <-ctx.Done():
-			fmt.Println("ctx done")
-			return nil
-		case sample := <-outputChan:
-			if err := server.videoTrack.WriteSample(*sample); err != nil {
-				log.Error().Err(err).Msg("failed to write sample")
+		case err := <-captureFailed:
+			log.Error().Err(err).Msg("video capture failed")
+			server.CaptureLost(err)
+			videoCapture.Stop()
+			captureRetry = time.After(captureRetryInterval)
+		case <-captureRetry:
+			restarted, err := startCapture()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to restart video capture")
+				captureRetry = time.After(captureRetryInterval)
+				break
 			}
+
+			// clients are told about the recovery with the first sample
+			videoCapture, captureRetry = restarted, nil
+			server.SetVideoCapture(videoCapture)
+		case <-ctx.Done():
+			return shutdown(cfg.ShutdownTimeout,
+				shutdownStep{"http server", func(ctx context.Context) error {
+					if redirectServer != nil {
+						if err := redirectServer.Shutdown(ctx); err != nil {
+							return err
+						}
+					}
+
+					return httpServer.Shutdown(ctx)
+				}},
+				shutdownStep{"clients", func(ctx context.Context) error {
+					return server.CloseClients()
+				}},
+				shutdownStep{"hid devices", server.CloseControllers},
+				shutdownStep{"usb gadget", func(ctx context.Context) error {
+					if !cfg.Gadget.Enabled || !cfg.Gadget.RemoveOnExit {
+						return nil
+					}
+
+					return gadgetManager.Remove(cfg.Gadget.Name)
+				}},
+				shutdownStep{"video capture", func(ctx context.Context) error {
+					server.CaptureLost(nil)
+					videoCapture.Stop()
+					return nil
+				}},
+				shutdownStep{"video encoder", func(ctx context.Context) error {
+					videoEncoder.Stop()
+					return nil
+				}},
+			)
 		}
 	}
+}
+
+// httpsRedirectHandler sends clients to the same host on the port of the TLS
+// listener.
+func httpsRedirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
 
+		http.Redirect(res, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
 }
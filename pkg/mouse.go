@@ -1,5 +1,7 @@
 package pkg
 
+import "maps"
+
 type MouseButton uint8
 
 const (
@@ -23,3 +25,20 @@ func (b JSMouseButton) ToMouseButton() MouseButton {
 		panic("unknown mouse button")
 	}
 }
+
+// pressedButtons maps each button held down to the client pressing it.
+type pressedButtons map[MouseButton]string
+
+func (p pressedButtons) buttons() MouseButton {
+	buttons := ButtonNone
+	for button := range p {
+		buttons |= button
+	}
+
+	return buttons
+}
+
+// releaseClient lifts the buttons of the client with the given id.
+func (p pressedButtons) releaseClient(id string) {
+	maps.DeleteFunc(p, func(_ MouseButton, owner string) bool { return owner == id })
+}
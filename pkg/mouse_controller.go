@@ -2,13 +2,19 @@ package pkg
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
+	"mini-kvm/pkg/hid"
 	"os"
 
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	pointerReportId           = 0x01
+	pointerMultiplierReportId = 0x02
+)
+
 type MouseEventKind uint8
 
 const (
@@ -17,32 +23,65 @@ const (
 	MouseWheelEventKind
 )
 
+// MouseMode selects the device a MouseEvent is sent to. Clients switch to
+// relative mode while the browser holds a pointer lock.
+type MouseMode uint8
+
+const (
+	MouseModeAbsolute MouseMode = iota
+	MouseModeRelative
+)
+
 type MouseEvent struct {
 	Kind MouseEventKind `json:"a"`
+	Mode MouseMode      `json:"m"`
 
 	//MouseMovedEventKind
 	X uint16 `json:"x"`
 	Y uint16 `json:"y"`
+	// MouseModeRelative
+	DX int16 `json:"dx"`
+	DY int16 `json:"dy"`
 
 	//MouseButtonEventKind
 	Button JSMouseButton `json:"b"`
 	IsDown bool          `json:"d"`
 
-	WheelX int8 `json:"wx"`
-	WheelY int8 `json:"wy"`
+	//MouseWheelEventKind, browser scroll deltas in pixels
+	WheelX float64 `json:"wx"`
+	WheelY float64 `json:"wy"`
+
+	// client is the id of the client sending the event
+	client string
 }
 
 type MouseController struct {
-	device                    *os.File
-	eventChan                 chan MouseEvent
-	screenWidth, screenHeight int
+	device            *os.File
+	eventChan         chan MouseEvent
+	releaseChan       chan struct{}
+	releaseClientChan chan string
+	mapper            *PointerMapper
+	wheel             *wheelAccumulator
+
+	// writeErrors is only touched by the dispatcher
+	writeErrors writeErrorLog
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closeErr error
 }
 
-func NewMouseController(ctx context.Context, devicePath string, screenWidth, screenHeight int) *MouseController {
+func NewMouseController(ctx context.Context, devicePath string, mapper *PointerMapper, wheelStep float64, wheelMultiplier int) *MouseController {
+	ctx, cancel := context.WithCancel(ctx)
 	c := &MouseController{
-		eventChan:    make(chan MouseEvent, 100),
-		screenWidth:  screenWidth,
-		screenHeight: screenHeight,
+		eventChan:         make(chan MouseEvent, 100),
+		releaseChan:       make(chan struct{}, 1),
+		releaseClientChan: make(chan string, 8),
+		writeErrors:       writeErrorLog{device: "mouse"},
+		cancel:            cancel,
+		done:              make(chan struct{}),
+		mapper:            mapper,
+		wheel:             newWheelAccumulator(wheelStep, wheelMultiplier),
 	}
 
 	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0666)
@@ -56,55 +95,87 @@ func NewMouseController(ctx context.Context, devicePath string, screenWidth, scr
 	return c
 }
 
-func (m *MouseController) screenToHID(screenX, screenY uint16) (uint16, uint16) {
-	hidX := uint16((float64(screenX) / float64(m.screenWidth)) * 32767)
-	hidY := uint16((float64(screenY) / float64(m.screenHeight)) * 32767)
-	return hidX, hidY
-}
 func (m *MouseController) usbActionDispatcher(ctx context.Context) {
-	defer m.device.Close()
+	defer close(m.done)
 	lastX, lastY := uint16(0), uint16(0)
-	pressedButtons := make(map[MouseButton]bool)
+	pressed := make(pressedButtons)
 	buttons := ButtonNone
 	for {
 		select {
 		case <-ctx.Done():
+			m.closeErr = errors.Join(m.sendReport(lastX, lastY, ButtonNone, 0, 0), m.device.Close())
 			return
+		case <-m.releaseChan:
+			clear(pressed)
+			buttons = ButtonNone
+			m.wheel.reset()
+			m.writeErrors.check(m.sendReport(lastX, lastY, buttons, 0, 0), "failed to release buttons")
+		case client := <-m.releaseClientChan:
+			pressed.releaseClient(client)
+			if buttons != pressed.buttons() {
+				buttons = pressed.buttons()
+				m.writeErrors.check(m.sendReport(lastX, lastY, buttons, 0, 0), "failed to release buttons")
+			}
 		case ml := <-m.eventChan:
 			switch ml.Kind {
 			case MouseMovedEventKind:
-				ml.X, ml.Y = m.screenToHID(ml.X, ml.Y)
+				ml.X, ml.Y = m.mapper.ToHID(ml.X, ml.Y)
 				lastX, lastY = ml.X, ml.Y
-				if err := m.sendReport(ml.X, ml.Y, buttons, 0); err != nil {
-					log.Error().Err(err).Msg("failed to sendReport mouse location")
-				}
+				m.writeErrors.check(m.sendReport(ml.X, ml.Y, buttons, 0, 0), "failed to sendReport mouse location")
 			case MouseButtonEventKind:
 				if ml.IsDown {
-					pressedButtons[ml.Button.ToMouseButton()] = true
+					pressed[ml.Button.ToMouseButton()] = ml.client
 				} else {
-					delete(pressedButtons, ml.Button.ToMouseButton())
+					delete(pressed, ml.Button.ToMouseButton())
 				}
 
-				buttons = ButtonNone
-				for k, v := range pressedButtons {
-					if v {
-						buttons |= k
-					}
-				}
+				buttons = pressed.buttons()
 
-				if err := m.sendReport(lastX, lastY, buttons, 0); err != nil {
-					log.Error().Err(err).Msg("failed to sendReport mouse location")
-				}
+				m.writeErrors.check(m.sendReport(lastX, lastY, buttons, 0, 0), "failed to sendReport mouse location")
 			case MouseWheelEventKind:
-				if err := m.sendReport(ml.X, ml.Y, buttons, ml.WheelX); err != nil {
-					log.Error().Err(err).Msg("failed to sendReport wheel")
-				}
+				wheel, pan := m.wheel.add(ml.WheelX, ml.WheelY)
+				m.writeErrors.check(m.scroll(lastX, lastY, buttons, wheel, pan), "failed to sendReport wheel")
 			}
-			fmt.Println("mouse event received <- ", ml.X, ml.Y)
 		}
 	}
 }
 
+// scroll splits wheel units beyond the range of a report into several reports.
+func (m *MouseController) scroll(x, y uint16, buttons MouseButton, wheel, pan int) error {
+	for wheel != 0 || pan != 0 {
+		stepWheel, stepPan := clampDelta(wheel), clampDelta(pan)
+		if err := m.sendReport(x, y, buttons, stepWheel, stepPan); err != nil {
+			return err
+		}
+
+		wheel -= int(stepWheel)
+		pan -= int(stepPan)
+	}
+
+	return nil
+}
+
+// pointerReportLayout locates the elements of the absolute pointer report.
+type pointerReportLayout struct {
+	report     *hid.Report
+	buttons    []usageField
+	x, y       usageField
+	wheel, pan usageField
+}
+
+var pointerLayout = func() pointerReportLayout {
+	// the wheel multiplier only changes the feature report
+	report := mustReport(pointerDescriptor(1), hid.KindInput, pointerReportId)
+	return pointerReportLayout{
+		report:  report,
+		buttons: mustButtons(report, 3),
+		x:       mustUsage(report, hid.PageGenericDesktop, hid.UsageX),
+		y:       mustUsage(report, hid.PageGenericDesktop, hid.UsageY),
+		wheel:   mustUsage(report, hid.PageGenericDesktop, hid.UsageWheel),
+		pan:     mustUsage(report, hid.PageConsumer, hid.UsageACPan),
+	}
+}()
+
 /*
 Report Structure for HID Touch Screen
 
@@ -115,19 +186,47 @@ Byte 3: X coordinate (high byte)
 Byte 4: Y coordinate (low byte)
 Byte 5: Y coordinate (high byte)
 Byte 6: Wheel (signed byte)
+Byte 7: AC Pan (signed byte)
 */
-func (m *MouseController) sendReport(x, y uint16, buttons MouseButton, wheel int8) error {
-	report := make([]byte, 7)
-	report[0] = 0x01
-	report[1] = byte(buttons)
-	binary.LittleEndian.PutUint16(report[2:4], x)
-	binary.LittleEndian.PutUint16(report[4:6], y)
-	report[6] = byte(wheel)
+func (m *MouseController) sendReport(x, y uint16, buttons MouseButton, wheel, pan int8) error {
+	report := pointerLayout.report.New()
+	putButtons(report, pointerLayout.buttons, buttons)
+	pointerLayout.x.put(report, int32(x))
+	pointerLayout.y.put(report, int32(y))
+	pointerLayout.wheel.put(report, int32(wheel))
+	pointerLayout.pan.put(report, int32(pan))
 
 	_, err := m.device.Write(report)
 	return err
 }
 
+// ReleaseClient lifts the buttons pressed by the client with the given id.
+func (m *MouseController) ReleaseClient(id string) {
+	select {
+	case m.releaseClientChan <- id:
+	case <-m.done:
+	}
+}
+
+// Close releases all buttons and closes the device.
+func (m *MouseController) Close(ctx context.Context) error {
+	m.cancel()
+	select {
+	case <-m.done:
+		return m.closeErr
+	case <-ctx.Done():
+		return fmt.Errorf("failed to close mouse: %w", ctx.Err())
+	}
+}
+
+// ReleaseAll lifts every pressed button on the host.
+func (m *MouseController) ReleaseAll() {
+	select {
+	case m.releaseChan <- struct{}{}:
+	default:
+	}
+}
+
 func (m *MouseController) EventChan() chan MouseEvent {
 	return m.eventChan
 }
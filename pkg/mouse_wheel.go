@@ -0,0 +1,32 @@
+package pkg
+
+import "math"
+
+// wheelAccumulator turns browser scroll deltas in pixels into wheel units,
+// keeping the remainder for the next event so that slow touchpad scrolling
+// still adds up to whole detents.
+type wheelAccumulator struct {
+	// unitsPerPixel is the resolution multiplier divided by the pixels of one
+	// detent
+	unitsPerPixel float64
+	x, y          float64
+}
+
+func newWheelAccumulator(step float64, multiplier int) *wheelAccumulator {
+	return &wheelAccumulator{unitsPerPixel: float64(multiplier) / step}
+}
+
+// add returns the vertical wheel and horizontal pan units to report. Browsers
+// scroll down for positive deltas while the wheel scrolls up.
+func (w *wheelAccumulator) add(deltaX, deltaY float64) (wheel, pan int) {
+	w.x += deltaX * w.unitsPerPixel
+	w.y -= deltaY * w.unitsPerPixel
+	pan, wheel = int(math.Trunc(w.x)), int(math.Trunc(w.y))
+	w.x -= float64(pan)
+	w.y -= float64(wheel)
+	return wheel, pan
+}
+
+func (w *wheelAccumulator) reset() {
+	w.x, w.y = 0, 0
+}
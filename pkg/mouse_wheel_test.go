@@ -0,0 +1,78 @@
+package pkg
+
+import "testing"
+
+func TestWheelAccumulator(t *testing.T) {
+	type delta struct{ x, y float64 }
+	type units struct{ wheel, pan int }
+	tests := []struct {
+		name       string
+		step       float64
+		multiplier int
+		deltas     []delta
+		want       []units
+	}{
+		{name: "one detent", step: 100, multiplier: 1, deltas: []delta{{0, 100}, {0, -100}, {100, 0}, {-100, 0}}, want: []units{{-1, 0}, {1, 0}, {0, 1}, {0, -1}}},
+		{name: "remainder carries", step: 100, multiplier: 1, deltas: []delta{{0, 40}, {0, 40}, {0, 40}, {0, 80}}, want: []units{{0, 0}, {0, 0}, {-1, 0}, {-1, 0}}},
+		{name: "remainder carries back", step: 100, multiplier: 1, deltas: []delta{{60, 0}, {-50, 0}, {-50, 0}}, want: []units{{0, 0}, {0, 0}, {0, 0}}},
+		{name: "multiplier", step: 120, multiplier: 8, deltas: []delta{{0, 15}, {0, 120}, {0, -45}}, want: []units{{-1, 0}, {-8, 0}, {3, 0}}},
+		{name: "both axes", step: 10, multiplier: 1, deltas: []delta{{25, -35}, {5, 5}}, want: []units{{3, 2}, {0, 1}}},
+	}
+
+	for _, test := range tests {
+		w := newWheelAccumulator(test.step, test.multiplier)
+		for i, d := range test.deltas {
+			if wheel, pan := w.add(d.x, d.y); (units{wheel, pan}) != test.want[i] {
+				t.Errorf("%s: add %d = %d, %d, want %+v", test.name, i, wheel, pan, test.want[i])
+			}
+		}
+	}
+}
+
+func TestWheelAccumulatorReset(t *testing.T) {
+	w := newWheelAccumulator(100, 1)
+	w.add(90, 90)
+	w.reset()
+	if wheel, pan := w.add(20, 20); wheel != 0 || pan != 0 {
+		t.Errorf("add after reset = %d, %d, want 0, 0", wheel, pan)
+	}
+}
+
+func TestScrollSplitsReports(t *testing.T) {
+	device, host := newTestDevice(t)
+	mouse := &MouseController{device: device}
+	if err := mouse.scroll(10, 20, ButtonLeft, 300, -130); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][4]int32{{127, -127, 10, 20}, {127, -3, 10, 20}, {46, 0, 10, 20}}
+	for i, report := range readReports(t, host, len(want)) {
+		got := [4]int32{
+			pointerLayout.wheel.field.Get(report, pointerLayout.wheel.index),
+			pointerLayout.pan.field.Get(report, pointerLayout.pan.index),
+			pointerLayout.x.field.Get(report, pointerLayout.x.index),
+			pointerLayout.y.field.Get(report, pointerLayout.y.index),
+		}
+		if got != want[i] {
+			t.Errorf("report %d: wheel, pan, x, y = %v, want %v", i, got, want[i])
+		}
+
+		if buttons := pointerLayout.buttons[0].field.Get(report, pointerLayout.buttons[0].index); buttons != 1 {
+			t.Errorf("report %d: left button = %d, want it held", i, buttons)
+		}
+	}
+
+	// scrolling nothing sends nothing, the next report is the move
+	if err := mouse.scroll(0, 0, ButtonNone, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mouse.sendReport(30, 40, ButtonNone, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	report := readReports(t, host, 1)[0]
+	if x := pointerLayout.x.field.Get(report, pointerLayout.x.index); x != 30 {
+		t.Errorf("x = %d, want 30", x)
+	}
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"mini-kvm/pkg/config"
+	"sync"
+)
+
+// hidAbsoluteMax is the logical maximum of absolute pointer and touch
+// coordinates.
+const hidAbsoluteMax = 32767
+
+// PointerMapper turns pixels of the captured frame into absolute HID
+// coordinates. It follows the resolution of the running capture and the
+// calibration of the target, and is shared by the absolute pointer and touch.
+type PointerMapper struct {
+	mutex         sync.RWMutex
+	width, height int
+	calibration   config.Calibration
+}
+
+func NewPointerMapper(width, height int, calibration config.Calibration) *PointerMapper {
+	return &PointerMapper{width: width, height: height, calibration: calibration}
+}
+
+// SetFrameSize updates the resolution clients send coordinates in.
+func (p *PointerMapper) SetFrameSize(width, height int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.width, p.height = width, height
+}
+
+func (p *PointerMapper) FrameSize() (int, int) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.width, p.height
+}
+
+func (p *PointerMapper) SetCalibration(calibration config.Calibration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.calibration = calibration
+}
+
+func (p *PointerMapper) Calibration() config.Calibration {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.calibration
+}
+
+// ToHID maps a frame pixel to the target screen. Pixels outside of the active
+// area are clamped to its border.
+func (p *PointerMapper) ToHID(x, y uint16) (uint16, uint16) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	area := p.calibration.ActiveArea
+	if area.IsEmpty() {
+		area = config.Area{Right: 1, Bottom: 1}
+	}
+
+	u := (float64(x)/float64(p.width) - area.Left) / (area.Right - area.Left)
+	v := (float64(y)/float64(p.height) - area.Top) / (area.Bottom - area.Top)
+	u = u*p.calibration.ScaleX + p.calibration.OffsetX
+	v = v*p.calibration.ScaleY + p.calibration.OffsetY
+	return uint16(max(0, min(u, 1)) * hidAbsoluteMax), uint16(max(0, min(v, 1)) * hidAbsoluteMax)
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"mini-kvm/pkg/config"
+	"testing"
+)
+
+func TestToHID(t *testing.T) {
+	identity := config.Calibration{ScaleX: 1, ScaleY: 1}
+	// a 4:3 target in the middle of a 1000x500 frame
+	letterboxed := config.Calibration{ActiveArea: config.Area{Left: 0.2, Top: 0.1, Right: 0.8, Bottom: 0.9}, ScaleX: 1, ScaleY: 1}
+	tests := []struct {
+		name        string
+		calibration config.Calibration
+		x, y        uint16
+		wantX       uint16
+		wantY       uint16
+	}{
+		{name: "empty area is the frame", calibration: identity, x: 0, y: 0, wantX: 0, wantY: 0},
+		{name: "empty area centre", calibration: identity, x: 500, y: 250, wantX: 16383, wantY: 16383},
+		{name: "empty area corner", calibration: identity, x: 1000, y: 500, wantX: hidAbsoluteMax, wantY: hidAbsoluteMax},
+		{name: "letterboxed top left", calibration: letterboxed, x: 200, y: 50, wantX: 0, wantY: 0},
+		{name: "letterboxed centre", calibration: letterboxed, x: 500, y: 250, wantX: 16383, wantY: 16383},
+		{name: "letterboxed bottom right", calibration: letterboxed, x: 800, y: 450, wantX: hidAbsoluteMax, wantY: hidAbsoluteMax},
+		{name: "clamped left of the area", calibration: letterboxed, x: 10, y: 250, wantX: 0, wantY: 16383},
+		{name: "clamped below the area", calibration: letterboxed, x: 500, y: 499, wantX: 16383, wantY: hidAbsoluteMax},
+		{name: "clamped beyond the frame", calibration: identity, x: 2000, y: 1000, wantX: hidAbsoluteMax, wantY: hidAbsoluteMax},
+		{name: "scale and offset", calibration: config.Calibration{ScaleX: 0.5, ScaleY: 2, OffsetX: 0.25, OffsetY: -0.5}, x: 500, y: 250, wantX: 16383, wantY: 16383},
+		{name: "offset clamped", calibration: config.Calibration{ScaleX: 1, ScaleY: 1, OffsetX: -0.5, OffsetY: 0.5}, x: 100, y: 400, wantX: 0, wantY: hidAbsoluteMax},
+	}
+
+	for _, test := range tests {
+		x, y := NewPointerMapper(1000, 500, test.calibration).ToHID(test.x, test.y)
+		if x != test.wantX || y != test.wantY {
+			t.Errorf("%s: ToHID(%d, %d) = %d, %d, want %d, %d", test.name, test.x, test.y, x, y, test.wantX, test.wantY)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// problem is an RFC 9457 problem details body.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeProblem(res http.ResponseWriter, status int, detail string) {
+	res.Header().Set("Content-Type", "application/problem+json")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+func writeMethodNotAllowed(res http.ResponseWriter, allow string) {
+	res.Header().Set("Allow", allow)
+	writeProblem(res, http.StatusMethodNotAllowed, "")
+}
@@ -0,0 +1,402 @@
+package protocol
+
+const (
+	// server -> client
+	TypeHello            Type = "hello"
+	TypeViewers          Type = "viewers"
+	TypeVideo            Type = "video"
+	TypeKeyboardLEDs     Type = "keyboard.leds"
+	TypeKeyboardLayout   Type = "keyboard.layout"
+	TypeCapture          Type = "capture"
+	TypeControlState     Type = "control.state"
+	TypeControlRequested Type = "control.requested"
+	TypeTextProgress     Type = "text.progress"
+	TypeCalibration      Type = "calibration"
+	TypeMacros           Type = "macros"
+	TypeMacroDone        Type = "macro.done"
+	TypeMedia            Type = "media"
+	TypeMediaImages      Type = "media.images"
+	TypeImageProgress    Type = "image.progress"
+	TypeUSB              Type = "usb"
+	TypePong             Type = "pong"
+	TypeError            Type = "error"
+
+	// client -> server
+	TypePing              Type = "ping"
+	TypeKeyframe          Type = "keyframe"
+	TypeBitrate           Type = "bitrate"
+	TypeControlRequest    Type = "control.request"
+	TypeControlGrant      Type = "control.grant"
+	TypeControlTake       Type = "control.take"
+	TypeControlRelease    Type = "control.release"
+	TypeTextType          Type = "text.type"
+	TypeTextCancel        Type = "text.cancel"
+	TypeCalibrationDetect Type = "calibration.detect"
+	TypeInputRelease      Type = "input.release"
+	TypeMacroRun          Type = "macro.run"
+	TypeMacroRecordStart  Type = "macro.record.start"
+	TypeMacroRecordStop   Type = "macro.record.stop"
+	TypeMediaList         Type = "media.list"
+	TypeMediaAttach       Type = "media.attach"
+	TypeMediaDetach       Type = "media.detach"
+	TypeUSBWakeup         Type = "usb.wakeup"
+	TypeUSBReplug         Type = "usb.replug"
+)
+
+func init() {
+	Register(func() Message { return &Hello{} })
+	Register(func() Message { return &Viewers{} })
+	Register(func() Message { return &Video{} })
+	Register(func() Message { return &KeyboardLEDs{} })
+	Register(func() Message { return &KeyboardLayout{} })
+	Register(func() Message { return &Capture{} })
+	Register(func() Message { return &ControlState{} })
+	Register(func() Message { return &ControlRequested{} })
+	Register(func() Message { return &TextProgress{} })
+	Register(func() Message { return &Calibration{} })
+	Register(func() Message { return &Macros{} })
+	Register(func() Message { return &MacroDone{} })
+	Register(func() Message { return &Media{} })
+	Register(func() Message { return &MediaImages{} })
+	Register(func() Message { return &ImageProgress{} })
+	Register(func() Message { return &USB{} })
+	Register(func() Message { return &Pong{} })
+	Register(func() Message { return &Error{} })
+
+	Register(func() Message { return &Ping{} })
+	Register(func() Message { return &Keyframe{} })
+	Register(func() Message { return &Bitrate{} })
+	Register(func() Message { return &ControlRequest{} })
+	Register(func() Message { return &ControlGrant{} })
+	Register(func() Message { return &ControlTake{} })
+	Register(func() Message { return &ControlRelease{} })
+	Register(func() Message { return &TextType{} })
+	Register(func() Message { return &TextCancel{} })
+	Register(func() Message { return &CalibrationDetect{} })
+	Register(func() Message { return &InputRelease{} })
+	Register(func() Message { return &MacroRun{} })
+	Register(func() Message { return &MacroRecordStart{} })
+	Register(func() Message { return &MacroRecordStop{} })
+	Register(func() Message { return &MediaList{} })
+	Register(func() Message { return &MediaAttach{} })
+	Register(func() Message { return &MediaDetach{} })
+	Register(func() Message { return &USBWakeup{} })
+	Register(func() Message { return &USBReplug{} })
+}
+
+// Hello is the first message on every control channel.
+type Hello struct {
+	Version  int    `json:"version"`
+	ClientId string `json:"client_id"`
+	User     string `json:"user,omitempty"`
+	// Layouts lists the keyboard layouts text can be typed with.
+	Layouts []string `json:"layouts"`
+}
+
+func (*Hello) Type() Type { return TypeHello }
+
+type Viewers struct {
+	Count int `json:"count"`
+}
+
+func (*Viewers) Type() Type { return TypeViewers }
+
+type Video struct {
+	Width     int   `json:"width"`
+	Height    int   `json:"height"`
+	Framerate int   `json:"framerate"`
+	Bitrate   int64 `json:"bitrate"`
+}
+
+func (*Video) Type() Type { return TypeVideo }
+
+type KeyboardLEDs struct {
+	NumLock    bool `json:"num_lock"`
+	CapsLock   bool `json:"caps_lock"`
+	ScrollLock bool `json:"scroll_lock"`
+	Compose    bool `json:"compose"`
+	Kana       bool `json:"kana"`
+}
+
+func (*KeyboardLEDs) Type() Type { return TypeKeyboardLEDs }
+
+type CaptureState string
+
+const (
+	CaptureStateLost      CaptureState = "lost"
+	CaptureStateRecovered CaptureState = "recovered"
+)
+
+type Capture struct {
+	State CaptureState `json:"state"`
+	Error string       `json:"error,omitempty"`
+}
+
+func (*Capture) Type() Type { return TypeCapture }
+
+type ControlRole string
+
+const (
+	ControlRoleController ControlRole = "controller"
+	ControlRoleViewer     ControlRole = "viewer"
+)
+
+type ControlState struct {
+	Role           ControlRole `json:"role"`
+	Controller     string      `json:"controller,omitempty"`
+	ControllerUser string      `json:"controller_user,omitempty"`
+}
+
+func (*ControlState) Type() Type { return TypeControlState }
+
+// ControlRequested tells the controller that another client asks for control.
+type ControlRequested struct {
+	Client string `json:"client"`
+	User   string `json:"user,omitempty"`
+}
+
+func (*ControlRequested) Type() Type { return TypeControlRequested }
+
+// KeyboardLayout selects the layout of the target for typing text in this
+// session. The server confirms the selection with the same message.
+type KeyboardLayout struct {
+	Layout string `json:"layout"`
+}
+
+func (*KeyboardLayout) Type() Type { return TypeKeyboardLayout }
+
+// Calibration maps the captured picture onto the target screen. The server
+// sends it when the control channel opens and to everyone after a change;
+// the controller sends it to change the calibration.
+type Calibration struct {
+	ActiveArea Area    `json:"active_area"`
+	OffsetX    float64 `json:"offset_x"`
+	OffsetY    float64 `json:"offset_y"`
+	ScaleX     float64 `json:"scale_x"`
+	ScaleY     float64 `json:"scale_y"`
+}
+
+// Area is a rectangle in fractions of the frame size.
+type Area struct {
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+	Right  float64 `json:"right"`
+	Bottom float64 `json:"bottom"`
+}
+
+func (*Calibration) Type() Type { return TypeCalibration }
+
+// Macros lists the macros that can be run. The server sends it when the
+// control channel opens and to everyone after a change.
+type Macros struct {
+	Macros []Macro `json:"macros"`
+}
+
+func (*Macros) Type() Type { return TypeMacros }
+
+// Macro is a named key sequence. Built-in macros can't be changed.
+type Macro struct {
+	Name    string      `json:"name"`
+	Builtin bool        `json:"builtin,omitempty"`
+	Steps   []MacroStep `json:"steps"`
+}
+
+// MacroStep presses, releases or taps browser key codes, or waits.
+type MacroStep struct {
+	Down []string `json:"down,omitempty"`
+	Up   []string `json:"up,omitempty"`
+	Tap  []string `json:"tap,omitempty"`
+	Wait int64    `json:"wait_ms,omitempty"`
+}
+
+// MacroDone reports a finished macro, carrying the id of its MacroRun.
+type MacroDone struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+func (*MacroDone) Type() Type { return TypeMacroDone }
+
+// Media is the image attached to the mass storage drive, empty while nothing
+// is attached. The server sends it when the control channel opens and to
+// everyone after a change, unless mass storage is disabled.
+type Media struct {
+	Image    string `json:"image"`
+	CDROM    bool   `json:"cdrom"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+func (*Media) Type() Type { return TypeMedia }
+
+// MediaImages lists the images which can be attached, in reply to MediaList.
+type MediaImages struct {
+	Images []Image `json:"images"`
+	// Free is the space left for new images in bytes.
+	Free int64 `json:"free"`
+}
+
+func (*MediaImages) Type() Type { return TypeMediaImages }
+
+type Image struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Modified is a unix timestamp in milliseconds.
+	Modified int64  `json:"modified"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+// ImageProgress reports an upload or fetch into the image library to
+// everyone. Total is -1 while unknown.
+type ImageProgress struct {
+	Name     string `json:"name"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (*ImageProgress) Type() Type { return TypeImageProgress }
+
+// USB is the connection of the gadget to the target, such as "not attached",
+// "configured" or "suspended". Input other than the power, sleep and wake
+// keys is dropped while suspended. The server sends it when the control
+// channel opens and to everyone after a change, unless the device has no USB
+// device controller.
+type USB struct {
+	State string `json:"state"`
+}
+
+func (*USB) Type() Type { return TypeUSB }
+
+// TextProgress reports a text injection, carrying the id of its TextType.
+type TextProgress struct {
+	Typed   int    `json:"typed"`
+	Total   int    `json:"total"`
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (*TextProgress) Type() Type { return TypeTextProgress }
+
+// Ping is echoed back as Pong so the client can measure the round trip.
+type Ping struct {
+	Timestamp int64 `json:"t"`
+}
+
+func (*Ping) Type() Type { return TypePing }
+
+type Pong struct {
+	Timestamp       int64 `json:"t"`
+	ServerTimestamp int64 `json:"server_t"`
+}
+
+func (*Pong) Type() Type { return TypePong }
+
+type Error struct {
+	Error string `json:"error"`
+}
+
+func (*Error) Type() Type { return TypeError }
+
+type Keyframe struct{}
+
+func (*Keyframe) Type() Type { return TypeKeyframe }
+
+type Bitrate struct {
+	Bitrate int64 `json:"bitrate"`
+}
+
+func (*Bitrate) Type() Type { return TypeBitrate }
+
+type ControlRequest struct{}
+
+func (*ControlRequest) Type() Type { return TypeControlRequest }
+
+type ControlGrant struct {
+	Client string `json:"client"`
+}
+
+func (*ControlGrant) Type() Type { return TypeControlGrant }
+
+type ControlTake struct{}
+
+func (*ControlTake) Type() Type { return TypeControlTake }
+
+type ControlRelease struct{}
+
+func (*ControlRelease) Type() Type { return TypeControlRelease }
+
+// TextType types Text on the host. A zero Delay uses the server default and
+// an empty Layout the one selected for the session.
+type TextType struct {
+	Text   string `json:"text"`
+	Delay  int64  `json:"delay_ms,omitempty"`
+	Layout string `json:"layout,omitempty"`
+}
+
+func (*TextType) Type() Type { return TypeTextType }
+
+type TextCancel struct{}
+
+func (*TextCancel) Type() Type { return TypeTextCancel }
+
+// CalibrationDetect asks the server to detect the active area of the current
+// frame and calibrate the pointer with it. The server replies with the new
+// Calibration.
+type CalibrationDetect struct{}
+
+func (*CalibrationDetect) Type() Type { return TypeCalibrationDetect }
+
+// InputRelease lifts every key, button and touch contact held on the target,
+// whoever pressed them.
+type InputRelease struct{}
+
+func (*InputRelease) Type() Type { return TypeInputRelease }
+
+type MacroRun struct {
+	Name string `json:"name"`
+}
+
+func (*MacroRun) Type() Type { return TypeMacroRun }
+
+// MacroRecordStart records the key events of this client until
+// MacroRecordStop.
+type MacroRecordStart struct{}
+
+func (*MacroRecordStart) Type() Type { return TypeMacroRecordStart }
+
+// MacroRecordStop saves the recording under Name, or discards it when Name is
+// empty. Only admins can save, the recording goes on when they can't.
+type MacroRecordStop struct {
+	Name string `json:"name,omitempty"`
+}
+
+func (*MacroRecordStop) Type() Type { return TypeMacroRecordStop }
+
+type MediaList struct{}
+
+func (*MediaList) Type() Type { return TypeMediaList }
+
+// MediaAttach replaces the medium of the mass storage drive with Image.
+type MediaAttach struct {
+	Image    string `json:"image"`
+	CDROM    bool   `json:"cdrom"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+func (*MediaAttach) Type() Type { return TypeMediaAttach }
+
+type MediaDetach struct{}
+
+func (*MediaDetach) Type() Type { return TypeMediaDetach }
+
+// USBWakeup asks the suspended target to resume through remote wakeup.
+type USBWakeup struct{}
+
+func (*USBWakeup) Type() Type { return TypeUSBWakeup }
+
+// USBReplug unplugs the gadget and plugs it back in, only when the server
+// manages the gadget.
+type USBReplug struct{}
+
+func (*USBReplug) Type() Type { return TypeUSBReplug }
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Version is bumped on incompatible changes to the envelope or any message.
+const Version = 1
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnknownType        = errors.New("unknown message type")
+)
+
+type Type string
+
+type Message interface {
+	Type() Type
+}
+
+/*
+Envelope wraps every message on the "control" data channel
+
+	{"v": 1, "type": "ping", "id": "42", "data": {"t": 1700000000000}}
+
+Id is chosen by the client for requests and echoed in the reply.
+*/
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    Type            `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[Type]func() Message)
+)
+
+// Register makes a message type decodable. factory must return a pointer.
+func Register(factory func() Message) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	t := factory().Type()
+	if _, exists := registry[t]; exists {
+		panic(fmt.Sprintf("message type %q registered twice", t))
+	}
+
+	registry[t] = factory
+}
+
+func New(t Type) (Message, error) {
+	registryMutex.RLock()
+	factory, exists := registry[t]
+	registryMutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, t)
+	}
+
+	return factory(), nil
+}
+
+func Encode(id string, msg Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", msg.Type(), err)
+	}
+
+	return json.Marshal(Envelope{
+		Version: Version,
+		Type:    msg.Type(),
+		Id:      id,
+		Data:    data,
+	})
+}
+
+// Decode parses an envelope and its registered message. The envelope is
+// returned even when the message fails to decode, so errors can be replied to.
+func Decode(data []byte) (*Envelope, Message, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal envelope: %w", err)
+	}
+
+	if envelope.Version != Version {
+		return &envelope, nil, fmt.Errorf("%w %d, expected %d", ErrUnsupportedVersion, envelope.Version, Version)
+	}
+
+	msg, err := New(envelope.Type)
+	if err != nil {
+		return &envelope, nil, err
+	}
+
+	if len(envelope.Data) > 0 && string(envelope.Data) != "null" {
+		if err := json.Unmarshal(envelope.Data, msg); err != nil {
+			return &envelope, nil, fmt.Errorf("failed to unmarshal %s: %w", envelope.Type, err)
+		}
+	}
+
+	return &envelope, msg, nil
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		id  string
+		msg Message
+	}{
+		{id: "42", msg: &Ping{Timestamp: 1700000000000}},
+		{id: "42", msg: &Pong{Timestamp: 1700000000000, ServerTimestamp: 1700000000005}},
+		{msg: &Hello{Version: Version, ClientId: "client"}},
+		{id: "7", msg: &Error{Error: "failed"}},
+		{msg: &Keyframe{}},
+	}
+
+	for _, test := range tests {
+		data, err := Encode(test.id, test.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		envelope, msg, err := Decode(data)
+		if err != nil {
+			t.Fatalf("Decode(%s) = %v", data, err)
+		}
+
+		if envelope.Version != Version || envelope.Type != test.msg.Type() || envelope.Id != test.id {
+			t.Errorf("envelope = %+v, want version %d, type %s and id %q", envelope, Version, test.msg.Type(), test.id)
+		}
+
+		if !reflect.DeepEqual(msg, test.msg) {
+			t.Errorf("Decode(%s) = %#v, want %#v", data, msg, test.msg)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+		// id is echoed whenever the envelope could be read
+		id string
+	}{
+		{name: "unknown type", data: `{"v": 1, "type": "nope", "id": "1"}`, want: ErrUnknownType, id: "1"},
+		{name: "old version", data: `{"v": 0, "type": "ping", "id": "2"}`, want: ErrUnsupportedVersion, id: "2"},
+		{name: "newer version", data: `{"v": 2, "type": "ping", "id": "3"}`, want: ErrUnsupportedVersion, id: "3"},
+		{name: "bad data", data: `{"v": 1, "type": "ping", "id": "4", "data": {"t": "now"}}`, id: "4"},
+	}
+
+	for _, test := range tests {
+		envelope, msg, err := Decode([]byte(test.data))
+		if err == nil || test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: Decode = %v, want %v", test.name, err, test.want)
+		}
+
+		if msg != nil {
+			t.Errorf("%s: Decode returned message %#v with an error", test.name, msg)
+		}
+
+		if envelope == nil || envelope.Id != test.id {
+			t.Errorf("%s: envelope = %+v, want id %q", test.name, envelope, test.id)
+		}
+	}
+
+	if envelope, _, err := Decode([]byte("not json")); err == nil || envelope != nil {
+		t.Errorf("Decode of invalid json = %+v, %v, want an error without envelope", envelope, err)
+	}
+}
+
+func TestDecodeWithoutData(t *testing.T) {
+	for _, data := range []string{`{"v": 1, "type": "keyframe"}`, `{"v": 1, "type": "keyframe", "data": null}`} {
+		if _, msg, err := Decode([]byte(data)); err != nil || !reflect.DeepEqual(msg, &Keyframe{}) {
+			t.Errorf("Decode(%s) = %#v, %v", data, msg, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/hid"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RelativeMouseController drives a boot protocol mouse reporting movement
+// deltas, for BIOS setups and programs which ignore absolute pointers.
+type RelativeMouseController struct {
+	device            *os.File
+	eventChan         chan MouseEvent
+	releaseChan       chan struct{}
+	releaseClientChan chan string
+	wheel             *wheelAccumulator
+
+	// writeErrors is only touched by the dispatcher
+	writeErrors writeErrorLog
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closeErr error
+}
+
+func NewRelativeMouseController(ctx context.Context, devicePath string, wheelStep float64) *RelativeMouseController {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &RelativeMouseController{
+		eventChan:         make(chan MouseEvent, 100),
+		releaseChan:       make(chan struct{}, 1),
+		releaseClientChan: make(chan string, 8),
+		writeErrors:       writeErrorLog{device: "relative mouse"},
+		cancel:            cancel,
+		done:              make(chan struct{}),
+		// the boot mouse has neither a resolution multiplier nor a pan axis
+		wheel: newWheelAccumulator(wheelStep, 1),
+	}
+
+	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0666)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", devicePath).Msg("failed to open device")
+	}
+
+	c.device = device
+	go c.usbActionDispatcher(ctx)
+	return c
+}
+
+func (m *RelativeMouseController) usbActionDispatcher(ctx context.Context) {
+	defer close(m.done)
+	pressed := make(pressedButtons)
+	buttons := ButtonNone
+	for {
+		select {
+		case <-ctx.Done():
+			m.closeErr = errors.Join(m.sendReport(ButtonNone, 0, 0, 0), m.device.Close())
+			return
+		case <-m.releaseChan:
+			clear(pressed)
+			buttons = ButtonNone
+			m.wheel.reset()
+			m.writeErrors.check(m.sendReport(buttons, 0, 0, 0), "failed to release buttons")
+		case client := <-m.releaseClientChan:
+			pressed.releaseClient(client)
+			if buttons != pressed.buttons() {
+				buttons = pressed.buttons()
+				m.writeErrors.check(m.sendReport(buttons, 0, 0, 0), "failed to release buttons")
+			}
+		case ml := <-m.eventChan:
+			switch ml.Kind {
+			case MouseMovedEventKind:
+				m.writeErrors.check(m.move(buttons, int(ml.DX), int(ml.DY)), "failed to sendReport mouse movement")
+			case MouseButtonEventKind:
+				if ml.IsDown {
+					pressed[ml.Button.ToMouseButton()] = ml.client
+				} else {
+					delete(pressed, ml.Button.ToMouseButton())
+				}
+
+				buttons = pressed.buttons()
+
+				m.writeErrors.check(m.sendReport(buttons, 0, 0, 0), "failed to sendReport mouse buttons")
+			case MouseWheelEventKind:
+				wheel, _ := m.wheel.add(ml.WheelX, ml.WheelY)
+				m.writeErrors.check(m.scroll(buttons, wheel), "failed to sendReport wheel")
+			}
+		}
+	}
+}
+
+// move splits deltas beyond the range of a report into several reports.
+func (m *RelativeMouseController) move(buttons MouseButton, dx, dy int) error {
+	for dx != 0 || dy != 0 {
+		stepX, stepY := clampDelta(dx), clampDelta(dy)
+		if err := m.sendReport(buttons, stepX, stepY, 0); err != nil {
+			return err
+		}
+
+		dx -= int(stepX)
+		dy -= int(stepY)
+	}
+
+	return nil
+}
+
+// scroll splits wheel units beyond the range of a report into several reports.
+func (m *RelativeMouseController) scroll(buttons MouseButton, wheel int) error {
+	for wheel != 0 {
+		step := clampDelta(wheel)
+		if err := m.sendReport(buttons, 0, 0, step); err != nil {
+			return err
+		}
+
+		wheel -= int(step)
+	}
+
+	return nil
+}
+
+func clampDelta(d int) int8 {
+	return int8(max(-127, min(127, d)))
+}
+
+// relativePointerReportLayout locates the elements of the boot mouse report.
+type relativePointerReportLayout struct {
+	report        *hid.Report
+	buttons       []usageField
+	dx, dy, wheel usageField
+}
+
+var relativePointerLayout = func() relativePointerReportLayout {
+	report := mustReport(bootMouseDescriptor, hid.KindInput, 0)
+	return relativePointerReportLayout{
+		report:  report,
+		buttons: mustButtons(report, 3),
+		dx:      mustUsage(report, hid.PageGenericDesktop, hid.UsageX),
+		dy:      mustUsage(report, hid.PageGenericDesktop, hid.UsageY),
+		wheel:   mustUsage(report, hid.PageGenericDesktop, hid.UsageWheel),
+	}
+}()
+
+/*
+Report Structure for HID Boot Mouse
+
+Byte 0: Button state (bit flags)
+Byte 1: X movement (signed byte)
+Byte 2: Y movement (signed byte)
+Byte 3: Wheel (signed byte)
+*/
+func (m *RelativeMouseController) sendReport(buttons MouseButton, dx, dy, wheel int8) error {
+	report := relativePointerLayout.report.New()
+	putButtons(report, relativePointerLayout.buttons, buttons)
+	relativePointerLayout.dx.put(report, int32(dx))
+	relativePointerLayout.dy.put(report, int32(dy))
+	relativePointerLayout.wheel.put(report, int32(wheel))
+
+	_, err := m.device.Write(report)
+	return err
+}
+
+// ReleaseClient lifts the buttons pressed by the client with the given id.
+func (m *RelativeMouseController) ReleaseClient(id string) {
+	select {
+	case m.releaseClientChan <- id:
+	case <-m.done:
+	}
+}
+
+// Close releases all buttons and closes the device.
+func (m *RelativeMouseController) Close(ctx context.Context) error {
+	m.cancel()
+	select {
+	case <-m.done:
+		return m.closeErr
+	case <-ctx.Done():
+		return fmt.Errorf("failed to close relative mouse: %w", ctx.Err())
+	}
+}
+
+// ReleaseAll lifts every pressed button on the host.
+func (m *RelativeMouseController) ReleaseAll() {
+	select {
+	case m.releaseChan <- struct{}{}:
+	default:
+	}
+}
+
+func (m *RelativeMouseController) EventChan() chan MouseEvent {
+	return m.eventChan
+}
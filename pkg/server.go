@@ -2,9 +2,16 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"mini-kvm/pkg/concurrents"
+	"mini-kvm/pkg/config"
 	"mini-kvm/pkg/gstreamer"
+	"mini-kvm/pkg/layout"
+	"mini-kvm/pkg/protocol"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/interceptor"
@@ -13,30 +20,96 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-var peerConnectionConfiguration = webrtc.Configuration{
-	ICEServers: []webrtc.ICEServer{
-		{
-			URLs: []string{"stun:stun.l.google.com:19302"},
-		},
-	},
-}
+var (
+	ErrClientNotFound = errors.New("client not found")
+	ErrInvalidOffer   = errors.New("invalid offer")
+	ErrNoMedia        = errors.New("no media available")
+	ErrInvalidBitrate = fmt.Errorf("bitrate must be between %d and %d", minBitrate, maxBitrate)
+)
+
+const (
+	minBitrate = 100_000
+	maxBitrate = 50_000_000
+)
 
 func toPtr[T any](t T) *T {
 	return &t
 }
 
 type Server struct {
-	webrtcAPI *webrtc.API
-	clients   concurrents.Map[string, *Client]
+	webrtcAPI                   *webrtc.API
+	peerConnectionConfiguration webrtc.Configuration
+	clients                     concurrents.Map[string, *Client]
 
 	keyboardController *KeyboardController
 	mouseController    *MouseController
+	// relativeMouseController is nil when no relative mouse is configured
+	relativeMouseController *RelativeMouseController
+	// consumerController is nil when no consumer control device is configured
+	consumerController *ConsumerController
+	// touchController is nil when no multi-touch digitizer is configured
+	touchController *TouchController
+	controlArbiter  *ControlArbiter
+	pointerMapper   *PointerMapper
+	// virtualMedia is nil when the gadget has no mass storage function
+	virtualMedia *VirtualMedia
+	// usbLink is nil when the gadget is not managed
+	usbLink *USBLink
+	// configPath is where calibration changes are saved, empty when running
+	// without a config file
+	configPath string
+
+	videoTrack   *webrtc.TrackLocalStaticSample
+	audioTrack   *webrtc.TrackLocalStaticSample
+	videoEncoder *gstreamer.VideoEncoder
+	videoInfo    protocol.Video
+	videoCapture atomic.Pointer[gstreamer.V4L2Capturer]
+
+	// inputIdleTimeout releases the input of a client after this long
+	// without events, 0 disables it
+	inputIdleTimeout time.Duration
+
+	typeDelay     time.Duration
+	typing        typingState
+	defaultLayout *layout.Layout
+
+	macros   macroStore
+	macroRun macroRunState
+
+	mediaAvailable atomic.Bool
+}
+
+// optionalDevice reports whether the HID device at path is used. A missing
+// node only disables it, as gadgets set up by other tools may lack it.
+func optionalDevice(name, path string) bool {
+	if path == "" {
+		return false
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		log.Warn().Str("device", name).Str("path", path).Msg("hid device is missing, disabled")
+		return false
+	}
 
-	videoTrack *webrtc.TrackLocalStaticSample
-	audioTrack *webrtc.TrackLocalStaticSample
+	return true
 }
 
-func NewServer(ctx context.Context, mediaChan chan *media.Sample) (*Server, error) {
+func NewServer(ctx context.Context, cfg *config.Config, mediaChan chan *media.Sample, videoEncoder *gstreamer.VideoEncoder, virtualMedia *VirtualMedia, usbLink *USBLink) (*Server, error) {
+	defaultLayout, err := layout.Get(cfg.HID.Layout)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, macro := range cfg.HID.Macros {
+		if _, exists := findBuiltinMacro(macro.Name); exists {
+			return nil, fmt.Errorf("macro %s: %w", macro.Name, ErrMacroBuiltin)
+		}
+
+		if err := validateMacro(macro); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidMacro, err)
+		}
+	}
+
 	api, err := configureWebRTCApi()
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure webrtc api: %w", err)
@@ -56,21 +129,93 @@ func NewServer(ctx context.Context, mediaChan chan *media.Sample) (*Server, erro
 		return nil, fmt.Errorf("failed to create audio track: %w", err)
 	}
 
-	keyboardController := NewKeyboardController(ctx, "/dev/hidg0")
-	mouseController := NewMouseController(ctx, "/dev/hidg1", 1920, 1080)
+	// the controllers outlive ctx so that keys can be released during shutdown
+	controllerCtx := context.WithoutCancel(ctx)
+	keyboardController := NewKeyboardController(controllerCtx, cfg.HID.Keyboard, keyboardReportFormat(cfg.HID))
+	pointerMapper := NewPointerMapper(cfg.Video.Width, cfg.Video.Height, cfg.HID.Calibration)
+	mouseController := NewMouseController(controllerCtx, cfg.HID.Mouse, pointerMapper, cfg.HID.WheelStep, cfg.HID.WheelMultiplier)
+	var relativeMouseController *RelativeMouseController
+	if optionalDevice("relative mouse", cfg.HID.RelativeMouse) {
+		relativeMouseController = NewRelativeMouseController(controllerCtx, cfg.HID.RelativeMouse, cfg.HID.WheelStep)
+	}
+
+	var consumerController *ConsumerController
+	if optionalDevice("consumer control", cfg.HID.Consumer) {
+		consumerController = NewConsumerController(controllerCtx, cfg.HID.Consumer)
+	}
+
+	var touchController *TouchController
+	if optionalDevice("touch", cfg.HID.Touch) {
+		touchController = NewTouchController(controllerCtx, cfg.HID.Touch, pointerMapper)
+	}
+
+	iceServers := make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
+	for _, iceServer := range cfg.ICEServers {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       iceServer.URLs,
+			Username:   iceServer.Username,
+			Credential: iceServer.Credential,
+		})
+	}
 
 	server := &Server{
-		webrtcAPI:          api,
-		keyboardController: keyboardController,
-		mouseController:    mouseController,
-		videoTrack:         videoTrack,
-		audioTrack:         audioTrack,
+		webrtcAPI:                   api,
+		peerConnectionConfiguration: webrtc.Configuration{ICEServers: iceServers},
+		keyboardController:          keyboardController,
+		mouseController:             mouseController,
+		relativeMouseController:     relativeMouseController,
+		consumerController:          consumerController,
+		touchController:             touchController,
+		pointerMapper:               pointerMapper,
+		virtualMedia:                virtualMedia,
+		usbLink:                     usbLink,
+		configPath:                  cfg.Path,
+		videoTrack:                  videoTrack,
+		audioTrack:                  audioTrack,
+		videoEncoder:                videoEncoder,
+		typeDelay:                   cfg.HID.TypeDelay,
+		inputIdleTimeout:            cfg.HID.InputIdleTimeout,
+		defaultLayout:               defaultLayout,
+		macros:                      macroStore{macros: cfg.HID.Macros},
+		videoInfo: protocol.Video{
+			Width:     cfg.Video.Width,
+			Height:    cfg.Video.Height,
+			Framerate: cfg.Video.Framerate,
+		},
+	}
+	server.controlArbiter = NewControlArbiter(server.onControllerChange)
+	keyboardController.SubscribeLEDs(func(leds KeyboardLEDs) {
+		server.Broadcast(toProtocolLEDs(leds))
+	})
+	if virtualMedia != nil {
+		server.restoreMedium(cfg.MassStorage.Medium)
+	}
+
+	if usbLink != nil {
+		go usbLink.Watch(ctx, server.onUSBStateChange)
 	}
 
 	go server.mediaDistribution(ctx, mediaChan)
 	return server, nil
 }
 
+func keyboardReportFormat(cfg config.HID) KeyboardReportFormat {
+	switch cfg.KeyboardReport {
+	case "nkro":
+		return KeyboardReportNKRO
+	case "6kro":
+		return KeyboardReport6KRO
+	}
+
+	format, err := DetectKeyboardReportFormat(cfg.Keyboard)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to detect keyboard report format, using 6kro")
+	}
+
+	log.Info().Str("format", format.String()).Msg("keyboard report format")
+	return format
+}
+
 func (s *Server) mediaDistribution(ctx context.Context, mediaChan chan *media.Sample) {
 	var err error
 	for {
@@ -78,6 +223,10 @@ func (s *Server) mediaDistribution(ctx context.Context, mediaChan chan *media.Sa
 		case <-ctx.Done():
 			return
 		case media := <-mediaChan:
+			if !s.mediaAvailable.Load() {
+				s.SetMediaAvailable(true)
+			}
+
 			metadata := media.Metadata.(gstreamer.SampleMetadata)
 			switch metadata.MediaType {
 			case gstreamer.MediaTypeVideo:
@@ -135,12 +284,68 @@ func configureWebRTCApi() (api *webrtc.API, err error) {
 	return webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(ir)), nil
 }
 
-func (s *Server) CreateClient(offer webrtc.SessionDescription) (string, *webrtc.SessionDescription, error) {
-	peerConnection, err := s.webrtcAPI.NewPeerConnection(peerConnectionConfiguration)
+// SetMediaAvailable marks whether the capture pipeline is producing samples.
+// New clients are refused while it is not.
+func (s *Server) SetMediaAvailable(available bool) {
+	if s.mediaAvailable.Swap(available) || !available {
+		return
+	}
+
+	s.Broadcast(&protocol.Capture{State: protocol.CaptureStateRecovered})
+}
+
+// CaptureLost marks media unavailable and tells every client why.
+func (s *Server) CaptureLost(err error) {
+	if !s.mediaAvailable.Swap(false) {
+		return
+	}
+
+	msg := &protocol.Capture{State: protocol.CaptureStateLost}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+
+	s.Broadcast(msg)
+}
+
+// Broadcast pushes msg to every client with an open control channel.
+func (s *Server) Broadcast(msg protocol.Message) {
+	for _, client := range s.clients.Values() {
+		if err := client.Send(msg); err != nil && !errors.Is(err, ErrChannelNotOpen) {
+			client.logger.Error().Err(err).Str("type", string(msg.Type())).Msg("failed to send message")
+		}
+	}
+}
+
+func (s *Server) video() *protocol.Video {
+	video := s.videoInfo
+	video.Bitrate = s.videoEncoder.Bitrate()
+	return &video
+}
+
+// CreateClient answers offer for a new viewer. The first viewer gets control
+// while nobody else holds it.
+func (s *Server) CreateClient(offer webrtc.SessionDescription, user string, isAdmin bool) (string, *webrtc.SessionDescription, error) {
+	if !s.mediaAvailable.Load() {
+		return "", nil, ErrNoMedia
+	}
+
+	if _, err := offer.Unmarshal(); err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrInvalidOffer, err)
+	}
+
+	peerConnection, err := s.webrtcAPI.NewPeerConnection(s.peerConnectionConfiguration)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
+	created := false
+	defer func() {
+		if !created {
+			peerConnection.Close()
+		}
+	}()
+
 	for _, track := range []webrtc.TrackLocal{s.videoTrack, s.audioTrack} {
 		sender, err := peerConnection.AddTrack(track)
 		if err != nil {
@@ -158,25 +363,22 @@ func (s *Server) CreateClient(offer webrtc.SessionDescription) (string, *webrtc.
 	}
 
 	id := uuid.NewString()
-	logger := log.With().Str("id", id).Logger()
-	client := NewClient(id, peerConnection, logger, s.mouseController.EventChan(), s.keyboardController.EventChan())
-	s.clients.Set(id, client)
+	logger := log.With().Str("id", id).Str("user", user).Logger()
+	client := NewClient(s, id, user, isAdmin, peerConnection, logger)
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		logger.Info().Str("state", state.String()).Msg("connection state changed")
 		switch state {
 		case webrtc.PeerConnectionStateConnected:
 
-		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
-			if err := client.Close(); err != nil {
-				logger.Error().Err(err).Msg("failed to close client")
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			if err := s.RemoveClient(id); err != nil && !errors.Is(err, ErrClientNotFound) {
+				logger.Error().Err(err).Msg("failed to remove client")
 			}
-
-			s.clients.Delete(id)
 		}
 	})
 
 	if err = peerConnection.SetRemoteDescription(offer); err != nil {
-		return "", nil, fmt.Errorf("failed to set remote desc: %w", err)
+		return "", nil, fmt.Errorf("%w: failed to set remote desc: %w", ErrInvalidOffer, err)
 	}
 
 	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
@@ -190,9 +392,388 @@ func (s *Server) CreateClient(offer webrtc.SessionDescription) (string, *webrtc.
 	}
 
 	<-gatherComplete
+	created = true
+	s.clients.Set(id, client)
+	s.controlArbiter.Request(id)
 	return client.Id(), &answer, nil
 }
 
+// RemoveClient closes the client's peer connection. When it held control, any
+// keys and buttons left pressed on the host are released.
+func (s *Server) RemoveClient(id string) error {
+	client, exists := s.clients.Load(id)
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	s.clients.Delete(id)
+	s.controlArbiter.Release(id)
+	if err := client.Close(); err != nil {
+		return fmt.Errorf("failed to close client %s: %w", id, err)
+	}
+
+	client.logger.Info().Msg("client removed")
+	s.Broadcast(&protocol.Viewers{Count: s.clients.Size()})
+	return nil
+}
+
+// onControlChannelOpen greets the client with the current state.
+func (s *Server) onControlChannelOpen(c *Client) {
+	greeting := []protocol.Message{
+		&protocol.Hello{Version: protocol.Version, ClientId: c.id, User: c.user, Layouts: layout.Names()},
+		&protocol.KeyboardLayout{Layout: c.layout.Name},
+		s.video(),
+		toProtocolLEDs(s.keyboardController.LEDs()),
+		toProtocolCalibration(s.pointerMapper.Calibration()),
+		s.Macros(),
+	}
+	if s.virtualMedia != nil {
+		greeting = append(greeting, toProtocolMedia(s.virtualMedia.Medium()))
+	}
+	if s.usbLink != nil {
+		greeting = append(greeting, toProtocolUSB(s.usbLink.State()))
+	}
+
+	for _, msg := range greeting {
+		if err := c.Send(msg); err != nil {
+			c.logger.Error().Err(err).Str("type", string(msg.Type())).Msg("failed to send message")
+		}
+	}
+
+	c.sendControlState(s.controlArbiter.Controller())
+	s.Broadcast(&protocol.Viewers{Count: s.clients.Size()})
+}
+
+// inputDevice is a controller holding keys, buttons or contacts down on
+// behalf of clients.
+type inputDevice interface {
+	ReleaseAll()
+	ReleaseClient(id string)
+}
+
+func (s *Server) inputDevices() []inputDevice {
+	devices := []inputDevice{s.keyboardController, s.mouseController}
+	if s.relativeMouseController != nil {
+		devices = append(devices, s.relativeMouseController)
+	}
+	if s.consumerController != nil {
+		devices = append(devices, s.consumerController)
+	}
+	if s.touchController != nil {
+		devices = append(devices, s.touchController)
+	}
+
+	return devices
+}
+
+// releaseAllInput lifts every key, button and contact on the host.
+func (s *Server) releaseAllInput() {
+	for _, device := range s.inputDevices() {
+		device.ReleaseAll()
+	}
+}
+
+// releaseClientInput lifts the keys, buttons and contacts pressed by the
+// client with the given id.
+func (s *Server) releaseClientInput(id string) {
+	for _, device := range s.inputDevices() {
+		device.ReleaseClient(id)
+	}
+}
+
+func (s *Server) onControllerChange(previous, controller string) {
+	// input of the previous controller must not stay pressed
+	s.releaseAllInput()
+
+	if err := s.CancelTyping(); err == nil {
+		log.Info().Msg("cancelled typing after controller change")
+	}
+
+	if s.CancelMacro() {
+		log.Info().Msg("cancelled macro after controller change")
+	}
+
+	log.Info().Str("previous", previous).Str("controller", controller).Msg("controller changed")
+	for _, client := range s.clients.Values() {
+		client.sendControlState(controller)
+	}
+}
+
+func toProtocolLEDs(leds KeyboardLEDs) *protocol.KeyboardLEDs {
+	return &protocol.KeyboardLEDs{
+		NumLock:    leds.Has(LEDNumLock),
+		CapsLock:   leds.Has(LEDCapsLock),
+		ScrollLock: leds.Has(LEDScrollLock),
+		Compose:    leds.Has(LEDCompose),
+		Kana:       leds.Has(LEDKana),
+	}
+}
+
+func (s *Server) handleControlMessage(c *Client, id string, msg protocol.Message) {
+	switch msg := msg.(type) {
+	case *protocol.Ping:
+		if err := c.Reply(id, &protocol.Pong{Timestamp: msg.Timestamp, ServerTimestamp: time.Now().UnixMilli()}); err != nil {
+			c.logger.Error().Err(err).Msg("failed to send pong")
+		}
+	case *protocol.Keyframe:
+		// the encoder blocks until the event reached the pipeline
+		go func() {
+			if err := s.videoEncoder.RequestKeyframe(); err != nil {
+				c.sendError(id, err)
+			}
+		}()
+	case *protocol.Bitrate:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		if msg.Bitrate < minBitrate || msg.Bitrate > maxBitrate {
+			c.sendError(id, ErrInvalidBitrate)
+			return
+		}
+
+		if err := s.videoEncoder.SetBitrate(msg.Bitrate); err != nil {
+			c.sendError(id, err)
+			return
+		}
+
+		s.Broadcast(s.video())
+	case *protocol.TextType:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		keyboardLayout := c.layout
+		if msg.Layout != "" {
+			var err error
+			if keyboardLayout, err = layout.Get(msg.Layout); err != nil {
+				c.sendError(id, err)
+				return
+			}
+		}
+
+		err := s.StartTyping(keyboardLayout, msg.Text, time.Duration(msg.Delay)*time.Millisecond, func(progress TypingProgress) {
+			if err := c.Reply(id, (*protocol.TextProgress)(&progress)); err != nil && !errors.Is(err, ErrChannelNotOpen) {
+				c.logger.Error().Err(err).Msg("failed to send typing progress")
+			}
+		})
+		if err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.KeyboardLayout:
+		keyboardLayout, err := layout.Get(msg.Layout)
+		if err != nil {
+			c.sendError(id, err)
+			return
+		}
+
+		c.layout = keyboardLayout
+		if err := c.Reply(id, msg); err != nil {
+			c.logger.Error().Err(err).Msg("failed to confirm keyboard layout")
+		}
+	case *protocol.TextCancel:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		if err := s.CancelTyping(); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.Calibration:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		if err := s.SetCalibration(fromProtocolCalibration(msg)); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.CalibrationDetect:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		// waits for a frame of the capture
+		go func() {
+			if err := s.DetectCalibration(context.Background()); err != nil {
+				c.sendError(id, err)
+				return
+			}
+
+			if err := c.Reply(id, toProtocolCalibration(s.pointerMapper.Calibration())); err != nil {
+				c.logger.Error().Err(err).Msg("failed to send calibration")
+			}
+		}()
+	case *protocol.InputRelease:
+		if !s.controlArbiter.IsController(c.id) && !c.isAdmin {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		s.releaseAllInput()
+	case *protocol.MacroRun:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		err := s.RunMacro(msg.Name, func(err error) {
+			done := &protocol.MacroDone{Name: msg.Name}
+			if errors.Is(err, context.Canceled) {
+				done.Error = "cancelled"
+			} else if err != nil {
+				done.Error = err.Error()
+			}
+
+			if err := c.Reply(id, done); err != nil && !errors.Is(err, ErrChannelNotOpen) {
+				c.logger.Error().Err(err).Msg("failed to send macro result")
+			}
+		})
+		if err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.MacroRecordStart:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		c.recorder.Store(&macroRecorder{})
+	case *protocol.MacroRecordStop:
+		// saving writes the config file like PUT /macros, the recording
+		// is kept so that it can be discarded instead
+		if msg.Name != "" && !c.isAdmin {
+			c.sendError(id, errors.New("only admins can change macros"))
+			return
+		}
+
+		recorder := c.recorder.Swap(nil)
+		if recorder == nil {
+			c.sendError(id, ErrNotRecording)
+			return
+		}
+
+		if msg.Name == "" {
+			return
+		}
+
+		if _, err := s.SaveMacro(recorder.macro(msg.Name)); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.MediaList:
+		images, err := s.mediaImages()
+		if err != nil {
+			c.sendError(id, err)
+			return
+		}
+
+		if err := c.Reply(id, images); err != nil {
+			c.logger.Error().Err(err).Msg("failed to send images")
+		}
+	case *protocol.MediaAttach:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		if err := s.AttachMedium(config.Medium{Image: msg.Image, CDROM: msg.CDROM, ReadOnly: msg.ReadOnly}); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.MediaDetach:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		if err := s.AttachMedium(config.Medium{}); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.USBWakeup:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		if err := s.WakeUpHost(); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.USBReplug:
+		if !s.controlArbiter.IsController(c.id) {
+			c.sendError(id, ErrNotController)
+			return
+		}
+
+		if err := s.ReplugUSB(); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.ControlRequest:
+		if s.controlArbiter.Request(c.id) {
+			return
+		}
+
+		controller, exists := s.clients.Load(s.controlArbiter.Controller())
+		if !exists {
+			return
+		}
+
+		if err := controller.Send(&protocol.ControlRequested{Client: c.id, User: c.user}); err != nil {
+			c.logger.Error().Err(err).Msg("failed to forward control request")
+		}
+	case *protocol.ControlGrant:
+		if _, exists := s.clients.Load(msg.Client); !exists {
+			c.sendError(id, ErrClientNotFound)
+			return
+		}
+
+		if err := s.controlArbiter.Grant(c.id, msg.Client); err != nil {
+			c.sendError(id, err)
+		}
+	case *protocol.ControlTake:
+		if !c.isAdmin {
+			c.sendError(id, errors.New("only admins can take control"))
+			return
+		}
+
+		s.controlArbiter.Take(c.id)
+	case *protocol.ControlRelease:
+		s.controlArbiter.Release(c.id)
+	default:
+		c.sendError(id, fmt.Errorf("unexpected message type %q", msg.Type()))
+	}
+}
+
+// CloseClients disconnects every client.
+func (s *Server) CloseClients() error {
+	var errs []error
+	for _, id := range s.clients.Keys() {
+		if err := s.RemoveClient(id); err != nil && !errors.Is(err, ErrClientNotFound) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CloseControllers releases all keys and buttons and closes the HID devices.
+func (s *Server) CloseControllers(ctx context.Context) error {
+	errs := []error{s.keyboardController.Close(ctx), s.mouseController.Close(ctx)}
+	if s.relativeMouseController != nil {
+		errs = append(errs, s.relativeMouseController.Close(ctx))
+	}
+	if s.consumerController != nil {
+		errs = append(errs, s.consumerController.Close(ctx))
+	}
+	if s.touchController != nil {
+		errs = append(errs, s.touchController.Close(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
 func rtcpDummyReader(sender *webrtc.RTPSender) {
 	rtcpBuf := make([]byte, 1500)
 	for {
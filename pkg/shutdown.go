@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type shutdownStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// shutdown runs steps in order under a shared deadline. A failed or timed out
+// step is reported and the remaining steps still run.
+func shutdown(timeout time.Duration, steps ...shutdownStep) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	for _, step := range steps {
+		start := time.Now()
+		log.Info().Str("step", step.name).Msg("shutting down")
+		if err := runWithContext(ctx, step.run); err != nil {
+			log.Error().Err(err).Str("step", step.name).Msg("shutdown step failed")
+			errs = append(errs, fmt.Errorf("%s: %w", step.name, err))
+			continue
+		}
+
+		log.Info().Str("step", step.name).Dur("took", time.Since(start)).Msg("shutdown step complete")
+	}
+
+	return errors.Join(errs...)
+}
+
+// runWithContext returns when fn does or ctx expires, whichever is first,
+// for steps which block without honouring ctx.
+func runWithContext(ctx context.Context, fn func(ctx context.Context) error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- fn(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
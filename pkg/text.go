@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/layout"
+	"unicode"
+)
+
+var ErrUnsupportedCharacter = errors.New("unsupported character")
+
+// Keystroke is a single key tapped while holding Modifiers.
+type Keystroke struct {
+	Key       Key
+	Modifiers Key
+}
+
+// TextToKeystrokes converts text to the keystrokes typing it on a host using
+// keyboardLayout. Carriage returns are dropped so that CRLF line endings type
+// a single Enter. With capsLock the host inverts Shift for letters, so they
+// are typed with Shift inverted as well.
+func TextToKeystrokes(keyboardLayout *layout.Layout, text string, capsLock bool) ([]Keystroke, error) {
+	keystrokes := make([]Keystroke, 0, len(text))
+	for i, r := range text {
+		if r == '\r' {
+			continue
+		}
+
+		strokes, exists := keyboardLayout.Keystrokes(r)
+		if !exists {
+			return nil, fmt.Errorf("%w %q at offset %d for layout %s", ErrUnsupportedCharacter, r, i, keyboardLayout.Name)
+		}
+
+		for j, stroke := range strokes {
+			key, exists := JSCodeToHID[JSKeyCode(stroke.Code)]
+			if !exists {
+				return nil, fmt.Errorf("%w %q at offset %d: layout %s uses unknown key %s", ErrUnsupportedCharacter, r, i, keyboardLayout.Name, stroke.Code)
+			}
+
+			modifiers := Key(stroke.Modifiers)
+			// the dead key before a composed letter is not a letter itself
+			if capsLock && j == len(strokes)-1 && hasCase(r) {
+				modifiers ^= Key(layout.ModShift)
+			}
+
+			keystrokes = append(keystrokes, Keystroke{Key: key, Modifiers: modifiers})
+		}
+	}
+
+	return keystrokes, nil
+}
+
+// hasCase reports whether Caps Lock changes r.
+func hasCase(r rune) bool {
+	return unicode.ToUpper(r) != unicode.ToLower(r)
+}
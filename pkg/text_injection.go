@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/layout"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTypingInProgress = errors.New("text is already being typed")
+	ErrNotTyping        = errors.New("no text is being typed")
+	ErrInvalidTypeDelay = fmt.Errorf("delay must be between 0 and %s", maxTypeDelay)
+)
+
+const (
+	maxTypeDelay = time.Second
+	// progressInterval limits how often progress is reported while typing.
+	progressInterval = 100 * time.Millisecond
+)
+
+type TypingProgress struct {
+	Typed   int    `json:"typed"`
+	Total   int    `json:"total"`
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"`
+}
+
+// typingState is the single text injection running on the keyboard.
+type typingState struct {
+	mutex    sync.Mutex
+	cancel   context.CancelFunc
+	progress TypingProgress
+}
+
+// StartTyping types text on the host in the background, as keyboardLayout
+// would produce it. A zero delay uses the configured default. onProgress, when
+// not nil, is called while typing and once more when typing has stopped.
+func (s *Server) StartTyping(keyboardLayout *layout.Layout, text string, delay time.Duration, onProgress func(TypingProgress)) error {
+	if delay < 0 || delay > maxTypeDelay {
+		return ErrInvalidTypeDelay
+	}
+
+	if delay == 0 {
+		delay = s.typeDelay
+	}
+
+	capsLock := s.keyboardController.LEDs().Has(LEDCapsLock)
+	keystrokes, err := TextToKeystrokes(keyboardLayout, text, capsLock)
+	if err != nil {
+		return err
+	}
+
+	if s.inputPaused() {
+		return ErrHostSuspended
+	}
+
+	unlock := s.lockKeyboardJobs()
+	if s.macroRun.cancel != nil {
+		unlock()
+		return ErrMacroRunning
+	}
+
+	if s.typing.progress.Running {
+		unlock()
+		return ErrTypingInProgress
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.typing.cancel = cancel
+	s.typing.progress = TypingProgress{Total: len(keystrokes), Running: true}
+	unlock()
+
+	report := func(progress TypingProgress) {
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+
+	go func() {
+		defer cancel()
+		var lastReport time.Time
+		err := s.keyboardController.Type(ctx, keystrokes, delay, func(typed, total int) {
+			progress := s.updateTyping(func(p *TypingProgress) { p.Typed = typed })
+			if time.Since(lastReport) >= progressInterval && typed < total {
+				lastReport = time.Now()
+				report(progress)
+			}
+		})
+
+		progress := s.updateTyping(func(p *TypingProgress) {
+			p.Running = false
+			if errors.Is(err, context.Canceled) {
+				p.Error = "cancelled"
+			} else if err != nil {
+				p.Error = err.Error()
+			}
+		})
+		report(progress)
+	}()
+
+	return nil
+}
+
+func (s *Server) updateTyping(update func(p *TypingProgress)) TypingProgress {
+	s.typing.mutex.Lock()
+	defer s.typing.mutex.Unlock()
+	update(&s.typing.progress)
+	return s.typing.progress
+}
+
+// CancelTyping stops the running text injection after the current keystroke.
+func (s *Server) CancelTyping() error {
+	s.typing.mutex.Lock()
+	defer s.typing.mutex.Unlock()
+	if !s.typing.progress.Running {
+		return ErrNotTyping
+	}
+
+	s.typing.cancel()
+	return nil
+}
+
+// TypingProgress returns the state of the running or last text injection.
+func (s *Server) TypingProgress() TypingProgress {
+	s.typing.mutex.Lock()
+	defer s.typing.mutex.Unlock()
+	return s.typing.progress
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"mini-kvm/pkg/layout"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTextToKeystrokesCapsLock(t *testing.T) {
+	us, err := layout.Get("us")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shift := Key(layout.ModShift)
+	tests := []struct {
+		capsLock bool
+		want     []Keystroke
+	}{
+		{capsLock: false, want: []Keystroke{{Key: KeyA}, {Key: KeyB, Modifiers: shift}, {Key: Key1}, {Key: Key1, Modifiers: shift}}},
+		{capsLock: true, want: []Keystroke{{Key: KeyA, Modifiers: shift}, {Key: KeyB}, {Key: Key1}, {Key: Key1, Modifiers: shift}}},
+	}
+
+	for _, test := range tests {
+		keystrokes, err := TextToKeystrokes(us, "aB1!", test.capsLock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(keystrokes, test.want) {
+			t.Errorf("caps lock %t: keystrokes = %v, want %v", test.capsLock, keystrokes, test.want)
+		}
+	}
+}
+
+func TestTypingAndMacroExclude(t *testing.T) {
+	keyboard, _ := newTestKeyboard(t, KeyboardReport6KRO)
+	server := &Server{keyboardController: keyboard}
+	us, err := layout.Get("us")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 20 {
+		typed := make(chan struct{})
+		macroDone := make(chan struct{})
+		var typingErr, macroErr error
+		var wg sync.WaitGroup
+		wg.Go(func() {
+			typingErr = server.StartTyping(us, "slow typing", maxTypeDelay, func(progress TypingProgress) {
+				if !progress.Running {
+					close(typed)
+				}
+			})
+		})
+		wg.Go(func() {
+			macroErr = server.RunMacro("alt-sysrq-reisub", func(error) { close(macroDone) })
+		})
+		wg.Wait()
+
+		if (typingErr == nil) == (macroErr == nil) {
+			t.Fatalf("StartTyping = %v and RunMacro = %v, want exactly one to start", typingErr, macroErr)
+		}
+
+		if typingErr == nil {
+			server.CancelTyping()
+			waitFor(t, typed)
+		} else {
+			server.CancelMacro()
+			waitFor(t, macroDone)
+		}
+	}
+}
+
+func waitFor(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
@@ -0,0 +1,147 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const validity = 825 * 24 * time.Hour
+
+var ErrIncompletePair = errors.New("only one of certificate and key exists")
+
+// EnsureSelfSigned generates a self-signed certificate for this device and
+// stores it at certPath/keyPath while neither file exists. A certificate or
+// key the operator supplied is never replaced.
+func EnsureSelfSigned(certPath, keyPath string, extraHosts []string) error {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return fmt.Errorf("failed to stat certificate: %w", certErr)
+	}
+
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return fmt.Errorf("failed to stat key: %w", keyErr)
+	}
+
+	switch {
+	case certErr == nil && keyErr == nil:
+		return nil
+	case certErr == nil:
+		return fmt.Errorf("%w: %s has no key at %s", ErrIncompletePair, certPath, keyPath)
+	case keyErr == nil:
+		return fmt.Errorf("%w: %s has no certificate at %s", ErrIncompletePair, keyPath, certPath)
+	}
+
+	dnsNames, ips := Hosts(extraHosts)
+	certPEM, keyPEM, err := Generate(dnsNames, ips)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+	}
+
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+
+	log.Info().Strs("dns", dnsNames).Interface("ips", ips).Str("path", certPath).Msg("generated self-signed certificate")
+	return nil
+}
+
+// Hosts returns the names and addresses the device is reachable under: its
+// hostname, localhost, every interface address and extraHosts.
+func Hosts(extraHosts []string) ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		dnsNames = append(dnsNames, hostname, hostname+".local")
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	for _, host := range extraHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else if !slices.Contains(dnsNames, host) {
+			dnsNames = append(dnsNames, host)
+		}
+	}
+
+	return dnsNames, ips
+}
+
+// Generate returns a self-signed server certificate for dnsNames and ips. It
+// is a leaf rather than a CA, so trusting it does not let its key sign
+// certificates for other hosts.
+func Generate(dnsNames []string, ips []net.IP) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial: %w", err)
+	}
+
+	commonName := "mini-kvm"
+	if len(dnsNames) > 1 {
+		commonName = dnsNames[1]
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"mini-kvm"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
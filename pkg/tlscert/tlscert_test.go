@@ -0,0 +1,135 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func parseCertificate(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("no PEM block in certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestGenerate(t *testing.T) {
+	dnsNames := []string{"localhost", "kvm", "kvm.local"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.ParseIP("192.168.1.20")}
+	certPEM, keyPEM, err := Generate(dnsNames, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("key does not match certificate: %v", err)
+	}
+
+	cert := parseCertificate(t, certPEM)
+	if cert.IsCA || !cert.BasicConstraintsValid {
+		t.Errorf("IsCA = %t, BasicConstraintsValid = %t, want a leaf", cert.IsCA, cert.BasicConstraintsValid)
+	}
+
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("KeyUsage = %v, want digital signature only", cert.KeyUsage)
+	}
+
+	if !slices.Equal(cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+		t.Errorf("ExtKeyUsage = %v, want server auth", cert.ExtKeyUsage)
+	}
+
+	if cert.Subject.CommonName != "kvm" {
+		t.Errorf("CommonName = %q, want kvm", cert.Subject.CommonName)
+	}
+
+	for _, host := range []string{"localhost", "kvm", "kvm.local", "127.0.0.1", "192.168.1.20"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := cert.VerifyHostname("example.com"); err == nil {
+		t.Error("certificate is valid for example.com")
+	}
+}
+
+func TestHosts(t *testing.T) {
+	dnsNames, ips := Hosts([]string{"kvm.example.com", "10.0.0.5"})
+	if dnsNames[0] != "localhost" || !slices.Contains(dnsNames, "kvm.example.com") {
+		t.Errorf("dns names = %v", dnsNames)
+	}
+
+	if !slices.ContainsFunc(ips, func(ip net.IP) bool { return ip.Equal(net.ParseIP("10.0.0.5")) }) {
+		t.Errorf("ips = %v, want 10.0.0.5", ips)
+	}
+
+	if !slices.ContainsFunc(ips, func(ip net.IP) bool { return ip.IsLoopback() }) {
+		t.Errorf("ips = %v, want the loopback address", ips)
+	}
+}
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls/cert.pem"), filepath.Join(dir, "tls/key.pem")
+	if err := EnsureSelfSigned(certPath, keyPath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	// an existing pair is kept
+	if err := EnsureSelfSigned(certPath, keyPath, []string{"other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := os.ReadFile(certPath); string(again) != string(certPEM) {
+		t.Error("existing certificate was replaced")
+	}
+}
+
+func TestEnsureSelfSignedIncompletePair(t *testing.T) {
+	for _, existing := range []string{"cert.pem", "key.pem"} {
+		t.Run(existing, func(t *testing.T) {
+			dir := t.TempDir()
+			certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+			supplied := []byte("supplied by the operator")
+			if err := os.WriteFile(filepath.Join(dir, existing), supplied, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := EnsureSelfSigned(certPath, keyPath, nil); !errors.Is(err, ErrIncompletePair) {
+				t.Fatalf("EnsureSelfSigned = %v, want %v", err, ErrIncompletePair)
+			}
+
+			if data, _ := os.ReadFile(filepath.Join(dir, existing)); string(data) != string(supplied) {
+				t.Errorf("%s was overwritten", existing)
+			}
+
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 {
+				t.Errorf("%d files in %s, want only %s", len(entries), dir, existing)
+			}
+		})
+	}
+}
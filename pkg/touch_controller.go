@@ -0,0 +1,261 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/hid"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type TouchEventKind uint8
+
+const (
+	TouchStartEventKind TouchEventKind = iota
+	TouchMoveEventKind
+	TouchEndEventKind
+	TouchCancelEventKind
+)
+
+// TouchEvent is a single contact of a browser touch event. Id is the
+// Touch.identifier of the browser and only needs to be unique among the
+// contacts on screen.
+type TouchEvent struct {
+	Kind TouchEventKind `json:"a"`
+	Id   uint32         `json:"id"`
+	X    uint16         `json:"x"`
+	Y    uint16         `json:"y"`
+
+	// client is the id of the client touching the screen
+	client string
+}
+
+const (
+	maxTouchContacts     = 10
+	touchReportId        = 0x01
+	touchFeatureReportId = 0x02
+)
+
+type touchContact struct {
+	client string
+	id     uint32
+	x, y   uint16
+	// lifted contacts are reported once without the tip switch, then removed
+	lifted bool
+}
+
+// TouchController drives a multi-touch digitizer reporting all contacts in
+// every report.
+type TouchController struct {
+	device            *os.File
+	eventChan         chan TouchEvent
+	releaseChan       chan struct{}
+	releaseClientChan chan string
+	mapper            *PointerMapper
+
+	// writeErrors is only touched by the dispatcher
+	writeErrors writeErrorLog
+
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closeErr error
+}
+
+func NewTouchController(ctx context.Context, devicePath string, mapper *PointerMapper) *TouchController {
+	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0666)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", devicePath).Msg("failed to open device")
+	}
+
+	return newTouchController(ctx, device, mapper)
+}
+
+func newTouchController(ctx context.Context, device *os.File, mapper *PointerMapper) *TouchController {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &TouchController{
+		device:            device,
+		eventChan:         make(chan TouchEvent, 100),
+		releaseChan:       make(chan struct{}, 1),
+		releaseClientChan: make(chan string, 8),
+		writeErrors:       writeErrorLog{device: "touch"},
+		cancel:            cancel,
+		done:              make(chan struct{}),
+		mapper:            mapper,
+	}
+
+	go c.usbActionDispatcher(ctx)
+	return c
+}
+
+func (m *TouchController) usbActionDispatcher(ctx context.Context) {
+	defer close(m.done)
+	// slots keeps the contact identifier reported to the host stable for as
+	// long as a finger touches the screen
+	var slots [maxTouchContacts]*touchContact
+	start := time.Now()
+	lift := func(client string) bool {
+		lifted := false
+		for _, contact := range slots {
+			if contact != nil && (client == "" || contact.client == client) {
+				contact.lifted = true
+				lifted = true
+			}
+		}
+
+		return lifted
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			lift("")
+			m.closeErr = errors.Join(m.sendReport(&slots, start), m.device.Close())
+			return
+		case <-m.releaseChan:
+			lift("")
+			m.writeErrors.check(m.sendReport(&slots, start), "failed to release contacts")
+		case client := <-m.releaseClientChan:
+			if !lift(client) {
+				continue
+			}
+
+			m.writeErrors.check(m.sendReport(&slots, start), "failed to release contacts")
+		case te := <-m.eventChan:
+			slot := -1
+			free := -1
+			for i, contact := range slots {
+				if contact != nil && contact.client == te.client && contact.id == te.Id {
+					slot = i
+				} else if contact == nil && free == -1 {
+					free = i
+				}
+			}
+
+			x, y := m.mapper.ToHID(te.X, te.Y)
+			switch te.Kind {
+			case TouchStartEventKind, TouchMoveEventKind:
+				if slot == -1 {
+					if free == -1 {
+						log.Warn().Uint32("id", te.Id).Msg("too many touch contacts")
+						continue
+					}
+
+					slot = free
+					slots[slot] = &touchContact{client: te.client, id: te.Id}
+				}
+
+				slots[slot].x, slots[slot].y = x, y
+			case TouchEndEventKind, TouchCancelEventKind:
+				if slot == -1 {
+					continue
+				}
+
+				slots[slot].x, slots[slot].y = x, y
+				slots[slot].lifted = true
+			}
+
+			m.writeErrors.check(m.sendReport(&slots, start), "failed to sendReport touch contacts")
+		}
+	}
+}
+
+// touchReportLayout locates the contacts, contact count and scan time of
+// the digitizer report.
+type touchReportLayout struct {
+	report          *hid.Report
+	tip, id, x, y   []usageField
+	count, scanTime usageField
+}
+
+var touchLayout = func() touchReportLayout {
+	report := mustReport(touchDescriptor, hid.KindInput, touchReportId)
+	return touchReportLayout{
+		report:   report,
+		tip:      mustUsages(report, hid.PageDigitizer, hid.UsageTipSwitch, maxTouchContacts),
+		id:       mustUsages(report, hid.PageDigitizer, hid.UsageContactID, maxTouchContacts),
+		x:        mustUsages(report, hid.PageGenericDesktop, hid.UsageX, maxTouchContacts),
+		y:        mustUsages(report, hid.PageGenericDesktop, hid.UsageY, maxTouchContacts),
+		count:    mustUsage(report, hid.PageDigitizer, hid.UsageContactCount),
+		scanTime: mustUsage(report, hid.PageDigitizer, hid.UsageScanTime),
+	}
+}()
+
+/*
+Report Structure for HID Multi-Touch Digitizer
+
+Byte 0:     Report ID (always 0x01)
+Byte 1-60:  10 contacts of 6 bytes each
+Byte 61:    Contact count
+Byte 62-63: Scan time in 100µs units (little endian)
+
+Each contact is laid out as:
+
+Byte 0:   Tip switch (bit 0)
+Byte 1:   Contact identifier (0-9)
+Byte 2-3: X coordinate (little endian)
+Byte 4-5: Y coordinate (little endian)
+
+Contacts are packed at the front and the contact count covers the contacts
+lifted with this report.
+*/
+func (m *TouchController) sendReport(slots *[maxTouchContacts]*touchContact, start time.Time) error {
+	report := touchLayout.report.New()
+	count := 0
+	for i, contact := range slots {
+		if contact == nil {
+			continue
+		}
+
+		if !contact.lifted {
+			touchLayout.tip[count].put(report, 1)
+		}
+		touchLayout.id[count].put(report, int32(i))
+		touchLayout.x[count].put(report, int32(contact.x))
+		touchLayout.y[count].put(report, int32(contact.y))
+		count++
+
+		if contact.lifted {
+			slots[i] = nil
+		}
+	}
+
+	touchLayout.count.put(report, int32(count))
+	touchLayout.scanTime.put(report, int32(uint16(time.Since(start)/(100*time.Microsecond))))
+
+	_, err := m.device.Write(report)
+	return err
+}
+
+// ReleaseClient lifts the contacts of the client with the given id.
+func (m *TouchController) ReleaseClient(id string) {
+	select {
+	case m.releaseClientChan <- id:
+	case <-m.done:
+	}
+}
+
+// Close lifts all contacts and closes the device.
+func (m *TouchController) Close(ctx context.Context) error {
+	m.cancel()
+	select {
+	case <-m.done:
+		return m.closeErr
+	case <-ctx.Done():
+		return fmt.Errorf("failed to close touch: %w", ctx.Err())
+	}
+}
+
+// ReleaseAll lifts every contact on the host.
+func (m *TouchController) ReleaseAll() {
+	select {
+	case m.releaseChan <- struct{}{}:
+	default:
+	}
+}
+
+func (m *TouchController) EventChan() chan TouchEvent {
+	return m.eventChan
+}
@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"context"
+	"mini-kvm/pkg/config"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestDevice returns both ends of a socket pair keeping the reports
+// apart: the device a controller writes to, and the host reading them.
+func newTestDevice(t *testing.T) (device, host *os.File) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host = os.NewFile(uintptr(fds[1]), "host")
+	t.Cleanup(func() { host.Close() })
+	return os.NewFile(uintptr(fds[0]), "hidg"), host
+}
+
+// readReports reads n reports written to the device.
+func readReports(t *testing.T, host *os.File, n int) [][]byte {
+	t.Helper()
+	reports := make([][]byte, 0, n)
+	for range n {
+		report := make([]byte, 64)
+		length, err := host.Read(report)
+		if err != nil {
+			t.Fatalf("read report %d: %v", len(reports), err)
+		}
+
+		reports = append(reports, report[:length])
+	}
+
+	return reports
+}
+
+// reportedContact is a contact as the host reads it from a touch report.
+type reportedContact struct {
+	tip  bool
+	id   int32
+	x, y int32
+}
+
+// newTestTouch returns a touch controller writing to a test device, mapping
+// a 100x100 frame onto the whole target screen, and the host end of it.
+func newTestTouch(t *testing.T) (*TouchController, *os.File) {
+	t.Helper()
+	device, host := newTestDevice(t)
+	touch := newTouchController(context.Background(), device, NewPointerMapper(100, 100, config.Calibration{ScaleX: 1, ScaleY: 1}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		touch.Close(ctx)
+	})
+
+	return touch, host
+}
+
+// readContacts reads n touch reports and returns their contacts.
+func readContacts(t *testing.T, host *os.File, n int) [][]reportedContact {
+	t.Helper()
+	var contacts [][]reportedContact
+	for _, report := range readReports(t, host, n) {
+		count := touchLayout.count.field.Get(report, touchLayout.count.index)
+		reported := make([]reportedContact, count)
+		for i := range reported {
+			get := func(fields []usageField) int32 { return fields[i].field.Get(report, fields[i].index) }
+			reported[i] = reportedContact{tip: get(touchLayout.tip) != 0, id: get(touchLayout.id), x: get(touchLayout.x), y: get(touchLayout.y)}
+		}
+
+		contacts = append(contacts, reported)
+	}
+
+	return contacts
+}
+
+func assertContacts(t *testing.T, got, want [][]reportedContact) {
+	t.Helper()
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("contacts = %+v, want %+v", got, want)
+	}
+}
+
+func TestTouchStartMoveEnd(t *testing.T) {
+	touch, host := newTestTouch(t)
+	touch.EventChan() <- TouchEvent{Kind: TouchStartEventKind, Id: 7, X: 0, Y: 100, client: "a"}
+	touch.EventChan() <- TouchEvent{Kind: TouchStartEventKind, Id: 3, X: 50, Y: 50, client: "a"}
+	touch.EventChan() <- TouchEvent{Kind: TouchMoveEventKind, Id: 7, X: 100, Y: 0, client: "a"}
+	touch.EventChan() <- TouchEvent{Kind: TouchEndEventKind, Id: 7, X: 100, Y: 0, client: "a"}
+	touch.EventChan() <- TouchEvent{Kind: TouchCancelEventKind, Id: 3, X: 50, Y: 50, client: "a"}
+	// the end of a contact which never started is ignored
+	touch.EventChan() <- TouchEvent{Kind: TouchEndEventKind, Id: 9, client: "a"}
+	// slots are reused after a contact was lifted
+	touch.EventChan() <- TouchEvent{Kind: TouchStartEventKind, Id: 3, X: 0, Y: 0, client: "a"}
+
+	assertContacts(t, readContacts(t, host, 6), [][]reportedContact{
+		{{tip: true, id: 0, x: 0, y: hidAbsoluteMax}},
+		{{tip: true, id: 0, x: 0, y: hidAbsoluteMax}, {tip: true, id: 1, x: 16383, y: 16383}},
+		{{tip: true, id: 0, x: hidAbsoluteMax, y: 0}, {tip: true, id: 1, x: 16383, y: 16383}},
+		{{tip: false, id: 0, x: hidAbsoluteMax, y: 0}, {tip: true, id: 1, x: 16383, y: 16383}},
+		{{tip: false, id: 1, x: 16383, y: 16383}},
+		{{tip: true, id: 0, x: 0, y: 0}},
+	})
+}
+
+func TestTouchEleventhContact(t *testing.T) {
+	touch, host := newTestTouch(t)
+	for id := range uint32(maxTouchContacts + 1) {
+		touch.EventChan() <- TouchEvent{Kind: TouchStartEventKind, Id: id, X: uint16(id), client: "a"}
+	}
+	touch.EventChan() <- TouchEvent{Kind: TouchEndEventKind, Id: 0, client: "a"}
+
+	// the 11th contact sends no report
+	contacts := readContacts(t, host, maxTouchContacts+1)
+	full := contacts[maxTouchContacts-1]
+	if len(full) != maxTouchContacts {
+		t.Fatalf("%d contacts, want %d", len(full), maxTouchContacts)
+	}
+
+	for i, contact := range full {
+		if contact.id != int32(i) || !contact.tip {
+			t.Errorf("contact %d = %+v", i, contact)
+		}
+	}
+
+	if lifted := contacts[maxTouchContacts]; len(lifted) != maxTouchContacts || lifted[0].tip || lifted[0].x != 0 {
+		t.Errorf("contacts after lifting the first = %+v", lifted)
+	}
+}
+
+func TestTouchReleaseClient(t *testing.T) {
+	touch, host := newTestTouch(t)
+	// both clients use the same identifier for their first finger
+	touch.EventChan() <- TouchEvent{Kind: TouchStartEventKind, Id: 0, X: 0, client: "a"}
+	touch.EventChan() <- TouchEvent{Kind: TouchStartEventKind, Id: 0, X: 100, client: "b"}
+	readContacts(t, host, 2)
+
+	touch.ReleaseClient("c")
+	touch.ReleaseClient("a")
+	assertContacts(t, readContacts(t, host, 1), [][]reportedContact{
+		{{tip: false, id: 0, x: 0}, {tip: true, id: 1, x: hidAbsoluteMax}},
+	})
+
+	touch.EventChan() <- TouchEvent{Kind: TouchMoveEventKind, Id: 0, X: 50, client: "b"}
+	assertContacts(t, readContacts(t, host, 1), [][]reportedContact{
+		{{tip: true, id: 1, x: 16383}},
+	})
+}
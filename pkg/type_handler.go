@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"mini-kvm/pkg/auth"
+	"mini-kvm/pkg/layout"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxTypeTextSize limits the text typed by a single request.
+const maxTypeTextSize = 64 << 10
+
+type typeRequest struct {
+	Text  string `json:"text"`
+	Delay int64  `json:"delay_ms,omitempty"`
+	// Layout defaults to the configured layout of the target.
+	Layout string `json:"layout,omitempty"`
+}
+
+/*
+typeHandler types text on the host
+
+	POST   /type  {"text": "...", "delay_ms": 20, "layout": "de"}  starts typing, 202
+	GET    /type                                                    progress of the current or last text
+	DELETE /type                                                    cancels typing, 204
+*/
+func (h *HttpHandler) typeHandler(res http.ResponseWriter, req *http.Request) {
+	h.setCORSHeaders(res, req, "GET, POST, DELETE")
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	req, ok := h.authenticate(res, req)
+	if !ok {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(res, http.StatusOK, h.server.TypingProgress())
+	case http.MethodPost:
+		h.handleTypePost(res, req)
+	case http.MethodDelete:
+		if !h.mayType(res, req) {
+			return
+		}
+
+		if err := h.server.CancelTyping(); err != nil {
+			writeProblem(res, http.StatusNotFound, err.Error())
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(res, "GET, POST, DELETE, OPTIONS")
+	}
+}
+
+// mayType lets admins type at any time and everyone else only while no
+// viewer holds control.
+func (h *HttpHandler) mayType(res http.ResponseWriter, req *http.Request) bool {
+	if session, ok := auth.SessionFromContext(req.Context()); ok && !session.Admin && h.server.controlArbiter.Controller() != "" {
+		writeProblem(res, http.StatusForbidden, "another viewer is in control")
+		return false
+	}
+
+	return true
+}
+
+func (h *HttpHandler) handleTypePost(res http.ResponseWriter, req *http.Request) {
+	if !hasContentType(req, "application/json") {
+		writeProblem(res, http.StatusUnsupportedMediaType, "text must be sent as application/json")
+		return
+	}
+
+	if !h.mayType(res, req) {
+		return
+	}
+
+	var body typeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxTypeTextSize)).Decode(&body); err != nil {
+		writeProblem(res, http.StatusBadRequest, "invalid type request")
+		return
+	}
+
+	// a huge delay_ms would overflow the duration and pass the check in
+	// StartTyping
+	if body.Delay < 0 || body.Delay > maxTypeDelay.Milliseconds() {
+		writeProblem(res, http.StatusUnprocessableEntity, ErrInvalidTypeDelay.Error())
+		return
+	}
+
+	keyboardLayout := h.server.defaultLayout
+	if body.Layout != "" {
+		var err error
+		if keyboardLayout, err = layout.Get(body.Layout); err != nil {
+			writeProblem(res, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	if err := h.server.StartTyping(keyboardLayout, body.Text, time.Duration(body.Delay)*time.Millisecond, nil); err != nil {
+		switch {
+		case errors.Is(err, ErrTypingInProgress), errors.Is(err, ErrMacroRunning), errors.Is(err, ErrHostSuspended):
+			writeProblem(res, http.StatusConflict, err.Error())
+		case errors.Is(err, ErrUnsupportedCharacter), errors.Is(err, ErrInvalidTypeDelay):
+			writeProblem(res, http.StatusUnprocessableEntity, err.Error())
+		default:
+			log.Error().Err(err).Msg("failed to start typing")
+			writeProblem(res, http.StatusInternalServerError, "failed to start typing")
+		}
+		return
+	}
+
+	writeJSON(res, http.StatusAccepted, h.server.TypingProgress())
+}
@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"fmt"
+	"mini-kvm/pkg/config"
+	"mini-kvm/pkg/gadget"
+	"mini-kvm/pkg/hid"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+// gadgetFunctions returns the HID functions of the gadget by their name in
+// the config.
+func gadgetFunctions(cfg config.HID) map[string]gadget.HIDFunction {
+	keyboard := gadget.HIDFunction{Name: "keyboard", Protocol: 1, Subclass: 1, Descriptor: bootKeyboardDescriptor}
+	if cfg.KeyboardReport == "nkro" {
+		// the bitmap doesn't fit the boot protocol
+		keyboard = gadget.HIDFunction{Name: "keyboard", Descriptor: nkroKeyboardDescriptor}
+	}
+
+	functions := map[string]gadget.HIDFunction{
+		"keyboard": keyboard,
+		"mouse": {
+			Name: "mouse", Descriptor: pointerDescriptor(cfg.WheelMultiplier),
+			// hosts enable the wheel multiplier with SET_REPORT, which f_hid
+			// only accepts on the control endpoint
+			NoOutEndpoint: cfg.WheelMultiplier > 1,
+		},
+		"consumer":       {Name: "consumer", Descriptor: consumerDescriptor},
+		"relative_mouse": {Name: "relative_mouse", Protocol: 2, Subclass: 1, Descriptor: bootMouseDescriptor},
+		"touch":          {Name: "touch", Descriptor: touchDescriptor},
+	}
+
+	for name, function := range functions {
+		// report_length is the longest input report of the function
+		function.ReportLength = mustLayout(function.Descriptor).MaxLength(hid.KindInput)
+		functions[name] = function
+	}
+
+	return functions
+}
+
+// SetupGadget creates or updates the USB gadget described by cfg.Gadget and
+// points the device paths of cfg.HID at its functions.
+func SetupGadget(manager *gadget.Manager, cfg *config.Config) error {
+	serial := cfg.Gadget.SerialNumber
+	if serial == "" {
+		var err error
+		if serial, err = manager.MachineSerial(); err != nil {
+			return fmt.Errorf("failed to derive serial number: %w", err)
+		}
+	}
+
+	usbGadget := gadget.Gadget{
+		Name:         cfg.Gadget.Name,
+		VendorID:     cfg.Gadget.VendorID,
+		ProductID:    cfg.Gadget.ProductID,
+		DeviceBCD:    0x0100,
+		Manufacturer: cfg.Gadget.Manufacturer,
+		Product:      cfg.Gadget.Product,
+		SerialNumber: serial,
+		MaxPower:     250,
+		// lets the wake key resume a suspended host
+		RemoteWakeup: true,
+	}
+
+	available := gadgetFunctions(cfg.HID)
+	for _, name := range cfg.Gadget.Functions {
+		if name == "mass_storage" {
+			usbGadget.Functions = append(usbGadget.Functions, massStorageFunction)
+			continue
+		}
+
+		usbGadget.Functions = append(usbGadget.Functions, available[name])
+	}
+
+	if err := manager.Apply(usbGadget, cfg.Gadget.UDC); err != nil {
+		return fmt.Errorf("failed to set up usb gadget: %w", err)
+	}
+
+	paths := map[string]*string{
+		"keyboard":       &cfg.HID.Keyboard,
+		"mouse":          &cfg.HID.Mouse,
+		"consumer":       &cfg.HID.Consumer,
+		"relative_mouse": &cfg.HID.RelativeMouse,
+		"touch":          &cfg.HID.Touch,
+	}
+	for name, path := range paths {
+		*path = ""
+		if !slices.Contains(cfg.Gadget.Functions, name) {
+			continue
+		}
+
+		device, err := manager.DevicePath(cfg.Gadget.Name, available[name])
+		if err != nil {
+			return fmt.Errorf("failed to set up usb gadget: %w", err)
+		}
+
+		log.Info().Str("function", name).Str("device", device).Msg("usb gadget function ready")
+		*path = device
+	}
+
+	return nil
+}
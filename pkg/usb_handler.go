@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"errors"
+	"mini-kvm/pkg/gadget"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+/*
+usbHandler shows and changes the connection of the gadget to the target
+
+	GET  /usb          the state, such as {"state": "suspended"}
+	POST /usb/wakeup   resumes the suspended target, 204
+	POST /usb/replug   unplugs the gadget and plugs it back in, 204
+*/
+func (h *HttpHandler) usbHandler(res http.ResponseWriter, req *http.Request) {
+	action := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/usb"), "/")
+	methods := "GET"
+	switch action {
+	case "":
+	case "wakeup", "replug":
+		methods = "POST"
+	default:
+		http.NotFound(res, req)
+		return
+	}
+
+	h.setCORSHeaders(res, req, methods)
+	if req.Method == http.MethodOptions {
+		return
+	}
+
+	req, ok := h.authenticate(res, req)
+	if !ok {
+		return
+	}
+
+	if h.server.usbLink == nil {
+		writeUSBError(res, gadget.ErrNoUDC)
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodGet && action == "":
+		writeJSON(res, http.StatusOK, toProtocolUSB(h.server.usbLink.State()))
+	case req.Method == http.MethodPost && action != "":
+		if !h.mayType(res, req) {
+			return
+		}
+
+		change := h.server.WakeUpHost
+		if action == "replug" {
+			change = h.server.ReplugUSB
+		}
+
+		if err := change(); err != nil {
+			writeUSBError(res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(res, methods+", OPTIONS")
+	}
+}
+
+func writeUSBError(res http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, gadget.ErrNoUDC):
+		writeProblem(res, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrGadgetDisabled), errors.Is(err, ErrHostNotSuspended), errors.Is(err, gadget.ErrNotBound):
+		writeProblem(res, http.StatusConflict, err.Error())
+	default:
+		log.Error().Err(err).Msg("failed to change usb connection")
+		writeProblem(res, http.StatusInternalServerError, "failed to change usb connection")
+	}
+}
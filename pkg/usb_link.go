@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"mini-kvm/pkg/gadget"
+	"mini-kvm/pkg/protocol"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrGadgetDisabled   = errors.New("usb gadget is not managed by mini-kvm")
+	ErrHostNotSuspended = errors.New("host is not suspended")
+	ErrHostSuspended    = errors.New("host is suspended, wake it up first")
+)
+
+// usbStatePollInterval is how often the state of the device controller is
+// read. sysfs notifies changes of the attribute, but not on every
+// controller.
+const usbStatePollInterval = 250 * time.Millisecond
+
+// USBLink follows the connection of the gadget to the host and re-plugs it.
+type USBLink struct {
+	manager *gadget.Manager
+	// gadget is empty when another tool, such as usb_init.sh, sets up the
+	// gadget
+	gadget string
+	// udc is the controller from the config. It is empty for the first one
+	// when the gadget is managed, and always set otherwise.
+	udc string
+
+	mutex sync.Mutex
+	state gadget.State
+}
+
+// NewUSBLink follows the gadget named gadgetName, or the controller udc when
+// gadgetName is empty. Only a managed gadget can be re-plugged.
+func NewUSBLink(manager *gadget.Manager, gadgetName, udc string) *USBLink {
+	return &USBLink{
+		manager: manager,
+		gadget:  gadgetName,
+		udc:     udc,
+	}
+}
+
+// State returns the state last read from the controller, empty before the
+// first read.
+func (l *USBLink) State() gadget.State {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.state
+}
+
+// Suspended reports whether the host is asleep. Reports written to the HID
+// functions meanwhile queue up in the kernel until it wakes.
+func (l *USBLink) Suspended() bool {
+	return l.State() == gadget.StateSuspended
+}
+
+// Watch reads the state of the controller until ctx is done and calls
+// onChange with every change, starting with the first state read.
+func (l *USBLink) Watch(ctx context.Context, onChange func(previous, state gadget.State)) {
+	ticker := time.NewTicker(usbStatePollInterval)
+	defer ticker.Stop()
+
+	var failing bool
+	for {
+		state, err := l.readState()
+		if err != nil && !failing {
+			log.Error().Err(err).Msg("failed to read usb state")
+		}
+
+		failing = err != nil
+		if err == nil {
+			l.mutex.Lock()
+			previous := l.state
+			l.state = state
+			l.mutex.Unlock()
+
+			if state != previous {
+				onChange(previous, state)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *USBLink) readState() (gadget.State, error) {
+	if l.gadget == "" {
+		return l.manager.UDCState(l.udc)
+	}
+
+	return l.manager.State(l.gadget)
+}
+
+// Wakeup asks the suspended host to resume.
+func (l *USBLink) Wakeup() error {
+	if !l.Suspended() {
+		return ErrHostNotSuspended
+	}
+
+	if l.gadget == "" {
+		return l.manager.WakeupUDC(l.udc)
+	}
+
+	return l.manager.Wakeup(l.gadget)
+}
+
+// Replug unbinds the gadget and binds it again, which the host sees as the
+// cable being unplugged and plugged back in.
+func (l *USBLink) Replug() error {
+	if l.gadget == "" {
+		return ErrGadgetDisabled
+	}
+
+	udc, err := l.manager.BoundUDC(l.gadget)
+	if err != nil {
+		return err
+	}
+
+	if udc == "" {
+		udc = l.udc
+	}
+
+	return l.manager.Rebind(l.gadget, udc)
+}
+
+// inputPaused reports whether input from clients is dropped: a suspended
+// host would receive it all at once when it wakes.
+func (s *Server) inputPaused() bool {
+	return s.usbLink != nil && s.usbLink.Suspended()
+}
+
+// WakeUpHost signals remote wakeup to the suspended host.
+func (s *Server) WakeUpHost() error {
+	if s.usbLink == nil {
+		return gadget.ErrNoUDC
+	}
+
+	if err := s.usbLink.Wakeup(); err != nil {
+		return err
+	}
+
+	log.Info().Msg("sent remote wakeup to the host")
+	return nil
+}
+
+// ReplugUSB re-enumerates the gadget on the host.
+func (s *Server) ReplugUSB() error {
+	if s.usbLink == nil {
+		return gadget.ErrNoUDC
+	}
+
+	if err := s.usbLink.Replug(); err != nil {
+		return err
+	}
+
+	log.Info().Msg("usb gadget re-plugged")
+	return nil
+}
+
+func (s *Server) onUSBStateChange(previous, state gadget.State) {
+	log.Info().Str("previous", string(previous)).Str("state", string(state)).Msg("usb state changed")
+	switch {
+	case state == gadget.StateSuspended:
+		// typing would only continue once the host wakes
+		if err := s.CancelTyping(); err == nil {
+			log.Info().Msg("cancelled typing after the host suspended")
+		}
+
+		if s.CancelMacro() {
+			log.Info().Msg("cancelled macro after the host suspended")
+		}
+	case state == gadget.StateConfigured && previous != "":
+		// the releases of keys held when the host left were dropped
+		s.releaseAllInput()
+	}
+
+	s.Broadcast(toProtocolUSB(state))
+}
+
+func toProtocolUSB(state gadget.State) *protocol.USB {
+	return &protocol.USB{State: string(state)}
+}
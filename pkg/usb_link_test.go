@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"mini-kvm/pkg/gadget"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnmanagedUSBLink(t *testing.T) {
+	root := t.TempDir()
+	udc := filepath.Join(root, "sys/class/udc/dummy_udc.0")
+	if err := os.MkdirAll(udc, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(udc, "state"), []byte("suspended\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	link := NewUSBLink(gadget.NewManager(root), "", "dummy_udc.0")
+	ctx, cancel := context.WithCancel(context.Background())
+	link.Watch(ctx, func(previous, state gadget.State) { cancel() })
+	if !link.Suspended() {
+		t.Fatalf("State = %q, want %q", link.State(), gadget.StateSuspended)
+	}
+
+	if err := link.Wakeup(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFile(t, filepath.Join(udc, "srp"), "1\n")
+	if err := link.Replug(); !errors.Is(err, ErrGadgetDisabled) {
+		t.Errorf("Replug = %v, want %v", err, ErrGadgetDisabled)
+	}
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"mini-kvm/pkg/config"
+	"mini-kvm/pkg/gadget"
+	"mini-kvm/pkg/protocol"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrMassStorageDisabled = errors.New("mass storage is not enabled")
+	ErrImageNotFound       = errors.New("image not found")
+	ErrInvalidImageName    = errors.New("image name must be a file name not starting with a dot")
+)
+
+// massStorageFunction is the drive images are attached to.
+var massStorageFunction = gadget.MassStorageFunction{Name: "media"}
+
+// VirtualMedia attaches the images of a library to the mass storage function
+// of the gadget.
+type VirtualMedia struct {
+	manager *gadget.Manager
+	gadget  string
+	images  *ImageLibrary
+
+	mutex  sync.Mutex
+	medium config.Medium
+}
+
+func NewVirtualMedia(manager *gadget.Manager, gadgetName string, images *ImageLibrary) *VirtualMedia {
+	return &VirtualMedia{
+		manager: manager,
+		gadget:  gadgetName,
+		images:  images,
+	}
+}
+
+// Medium returns the attached medium, with an empty image while detached.
+func (v *VirtualMedia) Medium() config.Medium {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.medium
+}
+
+// Attach replaces the medium of the drive, or ejects it when medium has no
+// image.
+func (v *VirtualMedia) Attach(medium config.Medium) error {
+	if medium.CDROM {
+		medium.ReadOnly = true
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if medium.Image == "" {
+		if err := v.manager.Eject(v.gadget, massStorageFunction); err != nil {
+			return err
+		}
+
+		v.medium = config.Medium{}
+		log.Info().Msg("virtual media detached")
+		return nil
+	}
+
+	path, err := v.images.Path(medium.Image)
+	if err != nil {
+		return err
+	}
+
+	if err := v.manager.Insert(v.gadget, massStorageFunction, gadget.Medium{
+		Path:     path,
+		CDROM:    medium.CDROM,
+		ReadOnly: medium.ReadOnly,
+	}); err != nil {
+		return err
+	}
+
+	v.medium = medium
+	log.Info().Str("image", medium.Image).Bool("cdrom", medium.CDROM).Bool("read_only", medium.ReadOnly).Msg("virtual media attached")
+	return nil
+}
+
+// Images lists the images which can be attached.
+func (s *Server) Images() ([]Image, error) {
+	images, err := s.imageLibrary()
+	if err != nil {
+		return nil, err
+	}
+
+	return images.Images()
+}
+
+// AttachMedium replaces the medium of the mass storage drive, saves it to the
+// config file and tells every client. A medium without image detaches it.
+func (s *Server) AttachMedium(medium config.Medium) error {
+	if s.virtualMedia == nil {
+		return ErrMassStorageDisabled
+	}
+
+	if err := s.virtualMedia.Attach(medium); err != nil {
+		return err
+	}
+
+	medium = s.virtualMedia.Medium()
+	s.Broadcast(toProtocolMedia(medium))
+	if s.configPath == "" {
+		log.Warn().Msg("running without a config file, the attached image is lost on restart")
+		return nil
+	}
+
+	if err := config.SaveMedium(s.configPath, medium); err != nil {
+		return fmt.Errorf("failed to save medium: %w", err)
+	}
+
+	return nil
+}
+
+// restoreMedium attaches the medium saved in the config file on start. The
+// drive may still hold the image of the previous run, so it is ejected when
+// the saved image is gone.
+func (s *Server) restoreMedium(medium config.Medium) {
+	err := s.virtualMedia.Attach(medium)
+	if err != nil && medium.Image != "" {
+		log.Error().Err(err).Str("image", medium.Image).Msg("failed to attach saved image")
+		err = s.virtualMedia.Attach(config.Medium{})
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to eject virtual media")
+	}
+}
+
+func (s *Server) mediaImages() (*protocol.MediaImages, error) {
+	images, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	free, err := s.virtualMedia.images.FreeSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &protocol.MediaImages{Images: make([]protocol.Image, 0, len(images)), Free: free}
+	for _, image := range images {
+		msg.Images = append(msg.Images, protocol.Image(image))
+	}
+
+	return msg, nil
+}
+
+func toProtocolMedia(medium config.Medium) *protocol.Media {
+	return &protocol.Media{
+		Image:    medium.Image,
+		CDROM:    medium.CDROM,
+		ReadOnly: medium.ReadOnly,
+	}
+}
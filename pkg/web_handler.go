@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mini-kvm/web"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+type WebHandler struct {
+	fileServer http.Handler
+	etags      map[string]string
+	fromDisk   bool
+}
+
+// NewWebHandler serves the embedded web UI, or the contents of dir when it is
+// set so the UI can be edited without rebuilding the binary.
+func NewWebHandler(dir string) (*WebHandler, error) {
+	if dir != "" {
+		return &WebHandler{
+			fileServer: http.FileServer(http.FS(os.DirFS(dir))),
+			fromDisk:   true,
+		}, nil
+	}
+
+	etags := make(map[string]string)
+	err := fs.WalkDir(web.FS, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		data, err := fs.ReadFile(web.FS, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		etags[name] = `"` + hex.EncodeToString(sum[:8]) + `"`
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index embedded web files: %w", err)
+	}
+
+	return &WebHandler{
+		fileServer: http.FileServer(http.FS(web.FS)),
+		etags:      etags,
+	}, nil
+}
+
+func (h *WebHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		res.Header().Set("Allow", "GET, HEAD")
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.fromDisk {
+		res.Header().Set("Cache-Control", "no-store")
+		h.fileServer.ServeHTTP(res, req)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(req.URL.Path), "/")
+	if name == "" || strings.HasSuffix(req.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	// embedded files have no modification time, so clients revalidate
+	// against the content hash instead
+	if etag, exists := h.etags[name]; exists {
+		res.Header().Set("ETag", etag)
+		res.Header().Set("Cache-Control", "no-cache")
+	}
+
+	h.fileServer.ServeHTTP(res, req)
+}
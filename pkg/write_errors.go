@@ -0,0 +1,33 @@
+package pkg
+
+import "github.com/rs/zerolog/log"
+
+// writeErrorLog logs the first of consecutive failed writes to a HID device.
+// f_hid fails every write while the host is unplugged or rebooting, which
+// would otherwise log every event. It is only used by the dispatcher of a
+// controller.
+type writeErrorLog struct {
+	device  string
+	failing bool
+}
+
+// check logs err with msg unless the previous write failed too, and notes
+// when writes succeed again.
+func (l *writeErrorLog) check(err error, msg string) {
+	if err == nil {
+		if l.failing {
+			l.failing = false
+			log.Info().Str("device", l.device).Msg("hid device writable again")
+		}
+
+		return
+	}
+
+	if l.failing {
+		log.Debug().Err(err).Str("device", l.device).Msg(msg)
+		return
+	}
+
+	l.failing = true
+	log.Error().Err(err).Str("device", l.device).Msg(msg + ", not logging further failures until a write succeeds")
+}
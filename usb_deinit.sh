@@ -1,5 +1,8 @@
 #!/bin/bash
 
+# Superseded by gadget.enabled in the config, which builds the same gadget
+# from the service. Kept for setups which create the gadget themselves.
+
 GADGET_NAME="hid_devices"
 GADGET_PATH="/sys/kernel/config/usb_gadget/$GADGET_NAME"
 
@@ -16,10 +19,16 @@ echo "" > "$GADGET_PATH/UDC"
 # Remove symlinks
 rm -f "$GADGET_PATH/configs/c.1/hid.usb0"
 rm -f "$GADGET_PATH/configs/c.1/hid.usb1"
+rm -f "$GADGET_PATH/configs/c.1/hid.usb2"
+rm -f "$GADGET_PATH/configs/c.1/hid.usb3"
+rm -f "$GADGET_PATH/configs/c.1/hid.usb4"
 
 # Remove functions
 rmdir "$GADGET_PATH/functions/hid.usb0" 2>/dev/null
 rmdir "$GADGET_PATH/functions/hid.usb1" 2>/dev/null
+rmdir "$GADGET_PATH/functions/hid.usb2" 2>/dev/null
+rmdir "$GADGET_PATH/functions/hid.usb3" 2>/dev/null
+rmdir "$GADGET_PATH/functions/hid.usb4" 2>/dev/null
 
 # Remove strings
 rmdir "$GADGET_PATH/configs/c.1/strings/0x409" 2>/dev/null
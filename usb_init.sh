@@ -1,9 +1,20 @@
 #!/bin/bash
 
+# Superseded by gadget.enabled in the config, which builds the same gadget
+# from the service. Kept for setups which create the gadget themselves.
+
 GADGET_DIR="/sys/kernel/config/usb_gadget"
 GADGET_NAME="hid_devices"
 GADGET_PATH="$GADGET_DIR/$GADGET_NAME"
 
+# 6kro is the boot protocol keyboard BIOS and UEFI setup screens understand,
+# nkro reports every key but only works once an OS driver is loaded
+KEYBOARD_MODE="${KEYBOARD_MODE:-6kro}"
+
+# wheel and pan units per notch reported by the pointer, 1-127. Must match
+# hid.wheel_multiplier of the config.
+WHEEL_MULTIPLIER="${WHEEL_MULTIPLIER:-1}"
+
 # Remove existing gadget if it exists
 if [ -d "$GADGET_PATH" ]; then
     echo "" > /sys/kernel/config/usb_gadget/$GADGET_NAME/UDC
@@ -27,34 +38,95 @@ mkdir -p configs/c.1
 mkdir -p configs/c.1/strings/0x409
 echo "Config 1" > configs/c.1/strings/0x409/configuration
 echo 250 > configs/c.1/MaxPower
+# bus powered with remote wakeup, so the wake key can resume a suspended host
+echo 0xa0 > configs/c.1/bmAttributes
 
 # Keyboard function
 mkdir -p functions/hid.usb0
-echo 1 > functions/hid.usb0/protocol
-echo 1 > functions/hid.usb0/subclass
-echo 8 > functions/hid.usb0/report_length
-echo -ne \\x05\\x01\\x09\\x06\\xa1\\x01\\x05\\x07\\x19\\xe0\\x29\\xe7\\x15\\x00\\x25\\x01\\x75\\x01\\x95\\x08\\x81\\x02\\x95\\x01\\x75\\x08\\x81\\x03\\x95\\x05\\x75\\x01\\x05\\x08\\x19\\x01\\x29\\x05\\x91\\x02\\x95\\x01\\x75\\x03\\x91\\x03\\x95\\x06\\x75\\x08\\x15\\x00\\x25\\x65\\x05\\x07\\x19\\x00\\x29\\x65\\x81\\x00\\xc0 > functions/hid.usb0/report_desc
+if [ "$KEYBOARD_MODE" = "nkro" ]; then
+    # modifier byte followed by a bitmap of the usages 0x00-0x9f
+    echo 0 > functions/hid.usb0/protocol
+    echo 0 > functions/hid.usb0/subclass
+    echo 21 > functions/hid.usb0/report_length
+    echo -ne \\x05\\x01\\x09\\x06\\xa1\\x01\\x05\\x07\\x19\\xe0\\x29\\xe7\\x15\\x00\\x25\\x01\\x75\\x01\\x95\\x08\\x81\\x02\\x95\\x05\\x75\\x01\\x05\\x08\\x19\\x01\\x29\\x05\\x91\\x02\\x95\\x01\\x75\\x03\\x91\\x03\\x05\\x07\\x19\\x00\\x29\\x9f\\x15\\x00\\x25\\x01\\x75\\x01\\x95\\xa0\\x81\\x02\\xc0 > functions/hid.usb0/report_desc
+else
+    echo 1 > functions/hid.usb0/protocol
+    echo 1 > functions/hid.usb0/subclass
+    echo 8 > functions/hid.usb0/report_length
+    echo -ne \\x05\\x01\\x09\\x06\\xa1\\x01\\x05\\x07\\x19\\xe0\\x29\\xe7\\x15\\x00\\x25\\x01\\x75\\x01\\x95\\x08\\x81\\x02\\x95\\x01\\x75\\x08\\x81\\x03\\x95\\x05\\x75\\x01\\x05\\x08\\x19\\x01\\x29\\x05\\x91\\x02\\x95\\x01\\x75\\x03\\x91\\x03\\x95\\x06\\x75\\x08\\x15\\x00\\x25\\x65\\x05\\x07\\x19\\x00\\x29\\x65\\x81\\x00\\xc0 > functions/hid.usb0/report_desc
+fi
 
 # HID Report Descriptor for absolute pointer (digitizer)
-# This defines a touchscreen with absolute X/Y coordinates (0-32767 range)
+# This defines a touchscreen with absolute X/Y coordinates (0-32767 range),
+# a wheel and AC Pan in report 1, and their resolution multiplier as feature
+# report 2
 mkdir -p functions/hid.usb1
 echo 0 > functions/hid.usb1/protocol
 echo 0 > functions/hid.usb1/subclass
-echo 7 > functions/hid.usb1/report_length
+echo 8 > functions/hid.usb1/report_length
+if [ "$WHEEL_MULTIPLIER" -gt 1 ] && [ -f functions/hid.usb1/no_out_endpoint ]; then
+    # hosts enable the multiplier with SET_REPORT, which f_hid only accepts
+    # on the control endpoint
+    echo 1 > functions/hid.usb1/no_out_endpoint
+fi
+WHEEL_MULTIPLIER_HEX=$(printf '\\x%02x' "$WHEEL_MULTIPLIER")
+
+echo -ne \\x05\\x0d\\x09\\x04\\xa1\\x01\\x85\\x01\\x05\\x09\\x19\\x01\\x29\\x03\\x15\\x00\\x25\\x01\\x75\\x01\\x95\\x03\\x81\\x02\\x95\\x05\\x81\\x03\\x05\\x01\\x09\\x30\\x09\\x31\\x16\\x00\\x00\\x26\\xff\\x7f\\x36\\x00\\x00\\x46\\xff\\x7f\\x66\\x00\\x00\\x75\\x10\\x95\\x02\\x81\\x02\\xa1\\x02\\x85\\x02\\x09\\x48\\x15\\x00\\x25\\x01\\x35\\x01\\x45${WHEEL_MULTIPLIER_HEX}\\x75\\x02\\x95\\x01\\xb1\\x02\\x75\\x06\\xb1\\x03\\x85\\x01\\x09\\x38\\x15\\x81\\x25\\x7f\\x35\\x00\\x45\\x00\\x75\\x08\\x95\\x01\\x81\\x06\\x05\\x0c\\x0a\\x38\\x02\\x81\\x06\\xc0\\xc0 > functions/hid.usb1/report_desc
+# HID Report Descriptor for consumer control (report 1, media keys) and
+# system control (report 2, power down/sleep/wake up)
+mkdir -p functions/hid.usb2
+echo 0 > functions/hid.usb2/protocol
+echo 0 > functions/hid.usb2/subclass
+echo 3 > functions/hid.usb2/report_length
+echo -ne \\x05\\x0c\\x09\\x01\\xa1\\x01\\x85\\x01\\x15\\x00\\x26\\xff\\x03\\x19\\x00\\x2a\\xff\\x03\\x75\\x10\\x95\\x01\\x81\\x00\\xc0\\x05\\x01\\x09\\x80\\xa1\\x01\\x85\\x02\\x19\\x81\\x29\\x83\\x15\\x01\\x25\\x03\\x75\\x02\\x95\\x01\\x81\\x00\\x75\\x06\\x81\\x03\\xc0 > functions/hid.usb2/report_desc
+
+# HID Report Descriptor for relative boot mouse
+# 3 buttons, X/Y deltas and wheel (-127..127)
+mkdir -p functions/hid.usb3
+echo 2 > functions/hid.usb3/protocol
+echo 1 > functions/hid.usb3/subclass
+echo 4 > functions/hid.usb3/report_length
+echo -ne \\x05\\x01\\x09\\x02\\xa1\\x01\\x09\\x01\\xa1\\x00\\x05\\x09\\x19\\x01\\x29\\x03\\x15\\x00\\x25\\x01\\x95\\x03\\x75\\x01\\x81\\x02\\x95\\x01\\x75\\x05\\x81\\x03\\x05\\x01\\x09\\x30\\x09\\x31\\x09\\x38\\x15\\x81\\x25\\x7f\\x75\\x08\\x95\\x03\\x81\\x06\\xc0\\xc0 > functions/hid.usb3/report_desc
+
+# HID Report Descriptor for multi-touch digitizer
+# 10 finger collections (tip switch, contact id, X/Y 0-32767), contact count
+# and scan time in report 1, contact count maximum as feature report 2
+TOUCH_FINGER='\x05\x0d\x09\x22\xa1\x02\x09\x42\x15\x00\x25\x01\x75\x01\x95\x01\x81\x02\x75\x07\x81\x03\x09\x51\x25\x09\x75\x08\x81\x02\x05\x01\x09\x30\x09\x31\x26\xff\x7f\x75\x10\x95\x02\x81\x02\xc0'
+TOUCH_DESC='\x05\x0d\x09\x04\xa1\x01\x85\x01'
+for i in $(seq 10); do
+    TOUCH_DESC="$TOUCH_DESC$TOUCH_FINGER"
+done
+TOUCH_DESC="$TOUCH_DESC"'\x05\x0d\x09\x54\x25\x0a\x75\x08\x95\x01\x81\x02\x09\x56\x27\xff\xff\x00\x00\x75\x10\x81\x02\x85\x02\x09\x55\x25\x0a\x75\x08\xb1\x02\xc0'
+mkdir -p functions/hid.usb4
+echo 0 > functions/hid.usb4/protocol
+echo 0 > functions/hid.usb4/subclass
+echo 64 > functions/hid.usb4/report_length
+echo -ne "$TOUCH_DESC" > functions/hid.usb4/report_desc
 
-echo -ne \\x05\\x0d\\x09\\x04\\xa1\\x01\\x85\\x01\\x05\\x09\\x19\\x01\\x29\\x03\\x15\\x00\\x25\\x01\\x75\\x01\\x95\\x03\\x81\\x02\\x95\\x05\\x81\\x03\\x05\\x01\\x09\\x30\\x09\\x31\\x16\\x00\\x00\\x26\\xff\\x7f\\x36\\x00\\x00\\x46\\xff\\x7f\\x66\\x00\\x00\\x75\\x10\\x95\\x02\\x81\\x02\\x09\\x38\\x15\\x81\\x25\\x7f\\x75\\x08\\x95\\x01\\x81\\x06\\xc0 > functions/hid.usb1/report_desc
 ln -s functions/hid.usb0 configs/c.1/
 ln -s functions/hid.usb1 configs/c.1/
+ln -s functions/hid.usb2 configs/c.1/
+ln -s functions/hid.usb3 configs/c.1/
+ln -s functions/hid.usb4 configs/c.1/
 
 UDC=$(ls /sys/class/udc | head -n1)
 echo "$UDC" > UDC
 
 chown :vkeyboard /dev/hidg0
 chown :vmouse /dev/hidg1
+chown :vkeyboard /dev/hidg2
+chown :vmouse /dev/hidg3
+chown :vmouse /dev/hidg4
 
 chmod 660 /dev/hidg0
 chmod 660 /dev/hidg1
+chmod 660 /dev/hidg2
+chmod 660 /dev/hidg3
+chmod 660 /dev/hidg4
 
 echo "USB HID gadget created successfully"
 echo "Keyboard: /dev/hidg0"
-echo "Touchscreen: /dev/hidg1"
\ No newline at end of file
+echo "Touchscreen: /dev/hidg1"
+echo "Consumer control: /dev/hidg2"
+echo "Relative mouse: /dev/hidg3"
+echo "Multi-touch: /dev/hidg4"
\ No newline at end of file
@@ -522,10 +522,11 @@ class WHEPClient extends EventTarget
         if (this.token)
             headers["Authorization"] = "Bearer " + this.token;
 
-        //Send a delete
+        //Send a delete, keepalive lets it outlive a closing tab
         await fetch(this.resourceURL, {
             method: "DELETE",
-            headers
+            headers,
+            keepalive: true
         });
     }
 }
\ No newline at end of file
@@ -0,0 +1,8 @@
+package web
+
+import "embed"
+
+// FS holds the bundled browser client served at the root of the HTTP server.
+//
+//go:embed index.html assets
+var FS embed.FS